@@ -0,0 +1,69 @@
+package wireguardhttps
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+)
+
+const (
+	// ScopeDevicesRead allows listing and viewing devices.
+	ScopeDevicesRead = "devices:read"
+	// ScopeDevicesWrite allows creating, rekeying and deleting devices.
+	ScopeDevicesWrite = "devices:write"
+
+	apiTokenPrefix = "wgh_"
+
+	defaultAPITokenDays = 30
+	maxAPITokenDays     = 365
+)
+
+// APITokenScopes are the scopes a user can grant an APIToken.
+var APITokenScopes = []string{ScopeDevicesRead, ScopeDevicesWrite}
+
+// InvalidScopeError is returned when a token is requested with a scope that doesn't exist.
+type InvalidScopeError struct {
+	Scope string
+}
+
+func (i *InvalidScopeError) Error() string {
+	return fmt.Sprintf("%v is not a valid API token scope", i.Scope)
+}
+
+// ValidateScopes checks that every scope is in APITokenScopes.
+func ValidateScopes(scopes []string) error {
+	for _, scope := range scopes {
+		valid := false
+		for _, allowed := range APITokenScopes {
+			if scope == allowed {
+				valid = true
+				break
+			}
+		}
+
+		if !valid {
+			return &InvalidScopeError{Scope: scope}
+		}
+	}
+	return nil
+}
+
+// GenerateAPIToken returns a new random API token.
+// The token is shown to the user once; only its hash should be stored.
+func GenerateAPIToken() (string, error) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+
+	return apiTokenPrefix + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// HashAPIToken returns the hash of token stored in the Database.
+func HashAPIToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
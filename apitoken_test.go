@@ -0,0 +1,178 @@
+package wireguardhttps
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func serveWithToken(config *ServerConfig, token, method, url string) (*httptest.ResponseRecorder, error) {
+	request, err := http.NewRequest(method, url, bytes.NewReader([]byte("{}")))
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set("Authorization", "Bearer "+token)
+	writer := httptest.NewRecorder()
+	Router(config).ServeHTTP(writer, request)
+	return writer, nil
+}
+
+func TestAPITokensAuthenticateWithinScope(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	user, err := db.RegisterUser("jontom@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := testServerConfig(t, db)
+
+	testRouter := Router(config)
+	writer := httptest.NewRecorder()
+	jsonBody, _ := json.Marshal(APITokenRequest{Name: "ci", Scopes: []string{ScopeDevicesRead}})
+	request, err := http.NewRequest("POST", "/api/tokens", bytes.NewReader(jsonBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := config.SessionStore.Get(request, config.SessionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session.Values["user"] = &user
+	err = session.Save(request, writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testRouter.ServeHTTP(writer, request)
+	if writer.Code != 201 {
+		t.Fatalf("Expected status code 201 for /tokens, got %v", writer.Code)
+	}
+
+	var tokenResponse APITokenResponse
+	err = json.NewDecoder(writer.Body).Decode(&tokenResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		method       string
+		url          string
+		expectedCode int
+	}{
+		{"GET", "/api/devices", 200},
+		{"POST", "/api/devices", 403},
+		{"GET", "/api/tokens", 403},
+		{"GET", "/api/admin/users", 403},
+	}
+	for _, testCase := range cases {
+		writer, err := serveWithToken(config, tokenResponse.Token, testCase.method, testCase.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if writer.Code != testCase.expectedCode {
+			t.Fatalf("Expected status code %v for %v %v, got %v", testCase.expectedCode, testCase.method, testCase.url, writer.Code)
+		}
+	}
+
+	err = db.RevokeAPIToken(user, int(tokenResponse.APIToken.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer, err = serveWithToken(config, tokenResponse.Token, "GET", "/api/devices")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if writer.Code != 401 {
+		t.Fatalf("Expected status code 401 for revoked token, got %v", writer.Code)
+	}
+}
+
+func TestExpiredAPITokensAreRejected(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	user, err := db.RegisterUser("jontom@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := GenerateAPIToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.CreateAPIToken(user, APIToken{
+		Name:      "expired",
+		TokenHash: HashAPIToken(secret),
+		Scopes:    ScopeDevicesRead,
+		ExpiresAt: time.Now().Add(-time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.AuthenticateAPIToken(HashAPIToken(secret))
+	if _, ok := err.(*RecordNotFoundError); !ok {
+		t.Fatalf("Expected RecordNotFoundError, got %v", err)
+	}
+
+	err = ValidateScopes([]string{ScopeDevicesRead, "admin"})
+	if err == nil {
+		t.Fatalf("Expected admin to be rejected as a scope")
+	}
+}
+
+func TestDeletedUsersAPITokensAreRejected(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	user, err := db.RegisterUser("leaver@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := GenerateAPIToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.CreateAPIToken(user, APIToken{
+		Name:      "ci",
+		TokenHash: HashAPIToken(secret),
+		Scopes:    ScopeDevicesWrite,
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.DeleteUser(int(user.ID), func(device Device) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.AuthenticateAPIToken(HashAPIToken(secret))
+	if _, ok := err.(*RecordNotFoundError); !ok {
+		t.Fatalf("Expected RecordNotFoundError for a deleted user's token, got %v", err)
+	}
+
+	tokens, err := db.APITokens(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tokens) != 0 {
+		t.Fatalf("Expected the deleted user's tokens to be deleted, got %v", tokens)
+	}
+}
@@ -0,0 +1,90 @@
+package wireguardhttps
+
+import (
+	"log"
+	"time"
+)
+
+// Audit actions recorded in AuditEvent.Action.
+const (
+	AuditActionLogin               = "auth.login"
+	AuditActionLoginDenied         = "auth.login_denied"
+	AuditActionLogout              = "auth.logout"
+	AuditActionDeviceCreate        = "device.create"
+	AuditActionDeviceRekey         = "device.rekey"
+	AuditActionDeviceExtend        = "device.extend"
+	AuditActionDeviceDelete        = "device.delete"
+	AuditActionDeviceExpire        = "device.expire"
+	AuditActionDeviceDisable       = "device.disable"
+	AuditActionDeviceDownload      = "device.download"
+	AuditActionTokenCreate         = "token.create"
+	AuditActionTokenRevoke         = "token.revoke"
+	AuditActionAdminDeviceDelete   = "admin.device.delete"
+	AuditActionAdminUserDelete     = "admin.user.delete"
+	AuditActionAdminRoutingProfile = "admin.routing_profile.save"
+	AuditActionAdminPromote        = "admin.user.promote"
+	AuditActionAdminDemote         = "admin.user.demote"
+)
+
+// defaultAuditEventLimit is how many events the admin audit log API returns unless asked for more.
+const defaultAuditEventLimit = 100
+
+// SystemActor is the AuditEvent.Actor for actions taken by background jobs rather than a user.
+// CLIActor is the AuditEvent.Actor for actions taken with the wireguardhttps command line tool.
+const (
+	SystemActor = "system"
+	CLIActor    = "cli"
+)
+
+// AuditFilter restricts the AuditEvents returned by the Database.
+// Zero values don't filter. Actor matches events taken by or affecting the user.
+type AuditFilter struct {
+	Actor    string
+	Action   string
+	DeviceID *uint
+	Since    *time.Time
+	Until    *time.Time
+	Limit    int
+}
+
+// RecordAuditEvent records event, logging rather than returning failures since the audited action has already happened.
+func RecordAuditEvent(database Database, event AuditEvent) {
+	err := database.RecordAuditEvent(event)
+	if err != nil {
+		log.Printf("Failed to record audit event %v: %v", event.Action, err)
+	}
+}
+
+// PublishAuditEvent records event and queues it for dispatcher's webhooks.
+func PublishAuditEvent(database Database, dispatcher *WebhookDispatcher, event AuditEvent) {
+	RecordAuditEvent(database, event)
+	dispatcher.Notify(event)
+}
+
+// DeleteUserAndDevices deletes user and removes their devices with deleteFunc, then publishes event for the user and an admin.device.delete event with the same actor for each device removed.
+// Webhooks subscribed to device deletions would otherwise never hear about devices deleted along with their owner.
+func DeleteUserAndDevices(database Database, dispatcher *WebhookDispatcher, user UserProfile, deleteFunc DeviceDeleteFunc, event AuditEvent) error {
+	removed := []Device{}
+	err := database.DeleteUser(int(user.ID), func(device Device) error {
+		err := deleteFunc(device)
+		if err != nil {
+			return err
+		}
+		removed = append(removed, device)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, device := range removed {
+		device := device
+		deviceEvent := event
+		deviceEvent.Action = AuditActionAdminDeviceDelete
+		deviceEvent.DeviceID = &device.ID
+		deviceEvent.Details = device.Name
+		PublishAuditEvent(database, dispatcher, deviceEvent)
+	}
+	PublishAuditEvent(database, dispatcher, event)
+	return nil
+}
@@ -0,0 +1,141 @@
+package wireguardhttps
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestDeviceActionsAreAuditedAndExportable(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	err := db.RegisterSubnet(mustParseCIDR("10.0.0.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.RegisterUser("jontom@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin, err := db.RegisterUser("admin@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin, err = db.SetAdmin(admin.AuthPlatform, admin.AuthPlatformUserID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := testServerConfig(t, db)
+
+	writer := serveAsUser(t, config, &user, "POST", "/api/devices", DeviceRequest{Name: "Laptop", OS: "Linux", PublicKey: mustGenerateKey(t)})
+	if writer.Code != 200 {
+		t.Fatalf("Expected status code 200 for /devices, got %v", writer.Code)
+	}
+
+	devices, err := db.Devices(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer = serveAsUser(t, config, &admin, "DELETE", fmt.Sprintf("/api/admin/devices/%v", devices[0].ID), nil)
+	if writer.Code != 204 {
+		t.Fatalf("Expected status code 204 for admin delete, got %v", writer.Code)
+	}
+
+	writer = serveAsUser(t, config, &user, "GET", "/api/admin/audit", nil)
+	if writer.Code != 403 {
+		t.Fatalf("Expected status code 403 for non-admin, got %v", writer.Code)
+	}
+
+	writer = serveAsUser(t, config, &admin, "GET", "/api/admin/audit?action="+AuditActionDeviceCreate, nil)
+	if writer.Code != 200 {
+		t.Fatalf("Expected status code 200 for /admin/audit, got %v", writer.Code)
+	}
+
+	var events []AuditEvent
+	err = json.NewDecoder(writer.Body).Decode(&events)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 device.create event, got %v", events)
+	}
+
+	event := events[0]
+	if event.Actor != user.AuthPlatformUserID || event.DeviceID == nil || *event.DeviceID != devices[0].ID {
+		t.Fatalf("Expected event for %v creating device %v, got %v", user.AuthPlatformUserID, devices[0].ID, event)
+	}
+
+	if event.SourceIP != "192.0.2.10" || event.UserAgent != testUserAgent {
+		t.Fatalf("Expected event from %v with user agent %v, got %v and %v", testRemoteAddr, testUserAgent, event.SourceIP, event.UserAgent)
+	}
+
+	writer = serveAsUser(t, config, &admin, "GET", fmt.Sprintf("/api/admin/audit?format=jsonl&actor=%v", user.AuthPlatformUserID), nil)
+	if writer.Code != 200 {
+		t.Fatalf("Expected status code 200 for /admin/audit export, got %v", writer.Code)
+	}
+
+	actions := []string{}
+	scanner := bufio.NewScanner(writer.Body)
+	for scanner.Scan() {
+		var exported AuditEvent
+		err = json.Unmarshal(scanner.Bytes(), &exported)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actions = append(actions, exported.Action)
+	}
+
+	// Filtering by actor includes actions that affected the user, newest first.
+	if len(actions) != 2 || actions[0] != AuditActionAdminDeviceDelete || actions[1] != AuditActionDeviceCreate {
+		t.Fatalf("Expected admin delete and device create events, got %v", actions)
+	}
+
+	writer = serveAsUser(t, config, &admin, "GET", "/api/admin/audit?since=yesterday", nil)
+	if writer.Code != 400 {
+		t.Fatalf("Expected status code 400 for invalid since, got %v", writer.Code)
+	}
+}
+
+func TestForwardedForIsOnlyTrustedBehindAProxy(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	for _, trustProxyHeaders := range []bool{false, true} {
+		config := testServerConfig(t, db)
+		config.TrustProxyHeaders = trustProxyHeaders
+		router := Router(config)
+		router.GET("/test/client-ip", func(c *gin.Context) {
+			c.String(http.StatusOK, c.ClientIP())
+		})
+
+		request, err := http.NewRequest("GET", "/test/client-ip", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.RemoteAddr = testRemoteAddr
+		request.Header.Set("X-Forwarded-For", "203.0.113.7")
+
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, request)
+
+		expectedIP := "192.0.2.10"
+		if trustProxyHeaders {
+			expectedIP = "203.0.113.7"
+		}
+		if writer.Body.String() != expectedIP {
+			t.Fatalf("Expected client IP %v when trusting proxy headers is %v, got %v", expectedIP, trustProxyHeaders, writer.Body.String())
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -38,24 +39,157 @@ func main() {
 				Usage:       "sets up the database tables and allocates IP addresses in the provided subnet",
 				Description: "sets up database tables and IP addresses in the given subnet",
 				Flags: []cli.Flag{
-					&cli.StringFlag{
+					&cli.StringSliceFlag{
 						Name:  "subnet",
-						Value: "10.0.0.0/24",
-						Usage: "the client device subnet in valid CIDR notation (example: 10.0.0.0/24)",
+						Value: cli.NewStringSlice("10.0.0.0/24"),
+						Usage: "the client device subnets in valid CIDR notation. pass an IPv4 and an IPv6 subnet for dual-stack (example: 10.0.0.0/24, fd00::/64)",
 					},
 					&cli.StringFlag{
 						Name:     "connection-string",
 						Usage:    "postgresql database connection string",
 						Required: true,
 					},
+					&cli.BoolFlag{
+						Name:  "lazy-allocation",
+						Value: false,
+						Usage: "store only assigned IPv4 addresses and compute free ones as devices are created, instead of inserting every address in the subnet",
+					},
+					&cli.StringFlag{
+						Name:  "pool",
+						Usage: "add or update a named address pool with the given subnets instead of the default pool. requires --subnet. subnets can't overlap other pools' subnets or allocated addresses. existing devices are left untouched",
+					},
+					&cli.StringSliceFlag{
+						Name:  "pool-dns",
+						Usage: "DNS server IP addresses for clients in the pool. defaults to --client-dns from serve",
+					},
+					&cli.StringSliceFlag{
+						Name:  "pool-allowed-ips",
+						Usage: "routes clients in the pool send through the VPN in valid CIDR notation. defaults to all traffic",
+					},
+					&cli.StringSliceFlag{
+						Name:  "pool-member",
+						Usage: "users allowed to use the pool as provider:user-id. can be repeated. if none are given, anyone can use it",
+					},
+					&cli.DurationFlag{
+						Name:  "pool-device-lifetime",
+						Value: 0,
+						Usage: "how long devices in the pool stay on the VPN before they're revoked. defaults to --device-lifetime from serve",
+					},
 				},
 				Action: actionInitialize,
 			},
+			{
+				Name:        "users",
+				Usage:       "manages wireguardhttps users",
+				Description: "manages users who have logged in to wireguardhttps",
+				Subcommands: []*cli.Command{
+					{
+						Name:        "promote",
+						Usage:       "makes a user an admin",
+						Description: "allows a user to see and revoke every user's devices",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "user-id",
+								Usage:    "the user's login provider and its user ID as provider:user-id, such as azureadv2:6b3f2c1e-8a4d-4f7b-9c2e-1d5a7e9b3f40. they must have logged in at least once",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:     "connection-string",
+								Usage:    "postgresql database connection string",
+								Required: true,
+							},
+						},
+						Action: actionSetAdmin(true),
+					},
+					{
+						Name:        "demote",
+						Usage:       "removes a user's admin rights",
+						Description: "removes a user's admin rights",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "user-id",
+								Usage:    "the user's login provider and its user ID as provider:user-id, such as azureadv2:6b3f2c1e-8a4d-4f7b-9c2e-1d5a7e9b3f40",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:     "connection-string",
+								Usage:    "postgresql database connection string",
+								Required: true,
+							},
+						},
+						Action: actionSetAdmin(false),
+					},
+					{
+						Name:        "device-lifetime",
+						Usage:       "sets how long a user's devices stay on the VPN",
+						Description: "overrides the pool and server device lifetimes for a user's new and extended devices. 0 falls back to them. takes effect for the user's next new or extended device",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "user-id",
+								Usage:    "the user's login provider and its user ID as provider:user-id, such as azureadv2:6b3f2c1e-8a4d-4f7b-9c2e-1d5a7e9b3f40. they must have logged in at least once",
+								Required: true,
+							},
+							&cli.DurationFlag{
+								Name:     "lifetime",
+								Usage:    "how long the user's devices stay on the VPN before they're revoked",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:     "connection-string",
+								Usage:    "postgresql database connection string",
+								Required: true,
+							},
+						},
+						Action: actionSetDeviceLifetime,
+					},
+					{
+						Name:        "device-limit",
+						Usage:       "sets how many devices a user can have",
+						Description: "overrides the server's device limit for a user's role. 0 falls back to it. takes effect for the user's next new device",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "user-id",
+								Usage:    "the user's login provider and its user ID as provider:user-id, such as azureadv2:6b3f2c1e-8a4d-4f7b-9c2e-1d5a7e9b3f40. they must have logged in at least once",
+								Required: true,
+							},
+							&cli.IntFlag{
+								Name:     "limit",
+								Usage:    "how many devices the user can have",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:     "connection-string",
+								Usage:    "postgresql database connection string",
+								Required: true,
+							},
+						},
+						Action: actionSetDeviceLimit,
+					},
+					{
+						Name:        "delete",
+						Usage:       "deletes a user and all of their devices",
+						Description: "removes every device belonging to a user from the Wireguard interface, then deletes the user and releases their IP addresses",
+						Flags: append([]cli.Flag{
+							&cli.StringFlag{
+								Name:     "user-id",
+								Usage:    "the user's login provider and its user ID as provider:user-id, such as azureadv2:6b3f2c1e-8a4d-4f7b-9c2e-1d5a7e9b3f40",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:     "connection-string",
+								Usage:    "postgresql database connection string",
+								Required: true,
+							},
+						}, append(webhookFlags(), wgrpcdFlags()...)...),
+						Action: actionDeleteUser,
+					},
+				},
+			},
 			{
 				Name:        "serve",
 				Usage:       "starts the web application",
-				Description: "starts the web application",
-				Flags: []cli.Flag{
+				Description: "starts the web application. client generated public keys (public_key) and preshared keys (preshared_key) need a wgrpcd that can import peers and set preshared keys, which the supported wgrpcd release can't, so those requests are answered with 501 Not Implemented",
+				Flags: append([]cli.Flag{
 					&cli.IntFlag{
 						Name:  "wireguard-listen-port",
 						Value: 51820,
@@ -76,11 +210,6 @@ func main() {
 						Usage: "a list of DNS server IP addresses for clients",
 						Value: cli.NewStringSlice("1.1.1.1"),
 					},
-					&cli.StringFlag{
-						Name:  "wgrpcd-address",
-						Value: "localhost:15002",
-						Usage: "the wgrpcd gRPC server on localhost. It must be running to run this program.",
-					},
 					&cli.StringFlag{
 						Name:  "http-listen-addr",
 						Value: ":443",
@@ -91,30 +220,22 @@ func main() {
 						Usage:    "directory containing templates for Wireguard config",
 						Required: true,
 					},
-					&cli.StringFlag{
-						Name:  "wireguard-device",
-						Value: "wg0",
-						Usage: "wireguard device name as shown in network interfaces",
-					},
 					&cli.StringFlag{
 						Name:     "connection-string",
 						Usage:    "postgresql database connection strings",
 						Required: true,
 					},
 					&cli.StringFlag{
-						Name:     "azure-ad-key",
-						Usage:    "azure ad client key",
-						Required: true,
+						Name:  "azure-ad-key",
+						Usage: "azure ad client key",
 					},
 					&cli.StringFlag{
-						Name:     "azure-ad-secret",
-						Usage:    "azure ad client secret",
-						Required: true,
+						Name:  "azure-ad-secret",
+						Usage: "azure ad client secret",
 					},
 					&cli.StringFlag{
-						Name:     "azure-ad-callback-url",
-						Usage:    "azure ad oauth callback url",
-						Required: true,
+						Name:  "azure-ad-callback-url",
+						Usage: "azure ad oauth callback url",
 					},
 					&cli.BoolFlag{
 						Name:  "debug",
@@ -131,9 +252,16 @@ func main() {
 						Usage: "key for signing CSRF tokens. keep as safe as the session key.",
 					},
 					&cli.StringFlag{
-						Name:     "ad-tenant",
-						Usage:    "ad tenant name",
-						Required: true,
+						Name:  "ad-tenant",
+						Usage: "ad tenant name",
+					},
+					&cli.StringSliceFlag{
+						Name:  "azure-ad-allowed-email-domains",
+						Usage: "only allow azure ad users whose user principal name is on these domains to log in. all users in the tenant are allowed if none are given",
+					},
+					&cli.StringSliceFlag{
+						Name:  "oidc-provider",
+						Usage: "an OpenID Connect login provider as semicolon separated key=value pairs. repeat for each provider (example: name=okta;discovery-url=https://example.okta.com/.well-known/openid-configuration;client-id=id;client-secret=secret;scopes=openid email)",
 					},
 					&cli.StringFlag{
 						Name:     "session-secret",
@@ -145,54 +273,150 @@ func main() {
 						Usage:    "frontend js app",
 						Required: true,
 					},
-					&cli.StringFlag{
-						Name:     "openid-provider",
-						Usage:    "Client ID from the OAuth2 provider",
-						Required: true,
+					&cli.StringSliceFlag{
+						Name:     "allowed-cdn",
+						Required: false,
+						Usage:    "CDN whitelist for CSP",
 					},
-					&cli.StringFlag{
-						Name:     "openid-client-id",
-						Usage:    "Client ID from the OAuth2 provider",
-						Required: true,
+					&cli.DurationFlag{
+						Name:  "peer-status-ttl",
+						Value: 10 * time.Second,
+						Usage: "how long to cache device connection status from wgrpcd",
 					},
-					&cli.StringFlag{
-						Name:     "openid-client-secret",
-						Usage:    "Client secret from the OAuth2 provider",
-						Required: true,
+					&cli.DurationFlag{
+						Name:  "reconcile-interval",
+						Value: 0,
+						Usage: "how often to check the database against the Wireguard interface. 0 disables reconciliation",
+					},
+					&cli.BoolFlag{
+						Name:  "reconcile-repair",
+						Value: false,
+						Usage: "remove orphan peers from the Wireguard interface once they've been orphaned for a full --reconcile-interval",
+					},
+					&cli.DurationFlag{
+						Name:  "device-lifetime",
+						Value: 0,
+						Usage: "how long devices stay on the VPN before they're revoked, unless their pool or owner sets a lifetime. 0 means devices never expire",
+					},
+					&cli.DurationFlag{
+						Name:  "expiry-interval",
+						Value: time.Minute,
+						Usage: "how often to revoke expired devices. 0 disables expiry",
+					},
+					&cli.DurationFlag{
+						Name:  "expiry-warning",
+						Value: 72 * time.Hour,
+						Usage: "how long before a device expires to email its owner. Requires --smtp-addr",
+					},
+					&cli.IntFlag{
+						Name:  "device-limit",
+						Value: 0,
+						Usage: "how many devices each user can have. 0 means there is no limit",
+					},
+					&cli.IntFlag{
+						Name:  "admin-device-limit",
+						Value: 0,
+						Usage: "how many devices each admin can have. 0 means there is no limit",
+					},
+					&cli.DurationFlag{
+						Name:  "max-key-age",
+						Value: 0,
+						Usage: "how old a device's key can get before the device is disabled until its owner rekeys it. 0 disables key rotation enforcement",
+					},
+					&cli.DurationFlag{
+						Name:  "key-rotation-warning",
+						Value: 7 * 24 * time.Hour,
+						Usage: "how long before --max-key-age devices are flagged as needing a rekey",
+					},
+					&cli.DurationFlag{
+						Name:  "key-rotation-interval",
+						Value: time.Hour,
+						Usage: "how often to disable devices with stale keys",
 					},
 					&cli.StringFlag{
-						Name:     "openid-audience",
-						Usage:    "Audience from the OAuth2 provider",
-						Required: true,
+						Name:  "metrics-listen-addr",
+						Value: "",
+						Usage: "address to serve Prometheus metrics on at /metrics, kept off the public listener. Empty disables metrics",
+					},
+					&cli.DurationFlag{
+						Name:  "webhook-retry-interval",
+						Value: 10 * time.Second,
+						Usage: "how often to retry failed webhook deliveries",
 					},
 					&cli.StringFlag{
-						Name:     "openid-token-url",
-						Usage:    "Token url from the OAuth2 provider",
-						Required: true,
+						Name:  "smtp-addr",
+						Value: "",
+						Usage: "host:port of the mail server used to email device owners about changes to their devices. Empty disables email",
 					},
 					&cli.StringFlag{
-						Name:  "wgrpcd-ca-cert",
-						Usage: "wgrpcd CA cert",
-						Value: "cacert.pem",
+						Name:  "smtp-username",
+						Usage: "username for the mail server, if it requires auth",
 					},
 					&cli.StringFlag{
-						Name:  "wgrpcd-client-cert",
-						Usage: "wgrpcd client cert",
-						Value: "clientcert.pem",
+						Name:  "smtp-password",
+						Usage: "password for the mail server, if it requires auth",
 					},
 					&cli.StringFlag{
-						Name:  "wgrpcd-client-key",
-						Usage: "wgrpcd client key",
-						Value: "clientkey.pem",
+						Name:  "smtp-from",
+						Usage: "address emails are sent from",
+					},
+					&cli.BoolFlag{
+						Name:  "mobileconfig-on-demand",
+						Value: true,
+						Usage: "make Apple configuration profiles connect the VPN automatically",
 					},
 					&cli.StringSliceFlag{
-						Name:     "allowed-cdn",
-						Required: false,
-						Usage:    "CDN whitelist for CSP",
+						Name:  "mobileconfig-trusted-ssid",
+						Usage: "Wi-Fi network where Apple configuration profiles don't connect the VPN automatically. Can be repeated",
 					},
-				},
+					&cli.PathFlag{
+						Name:  "mobileconfig-cert",
+						Usage: "PEM certificate chain to sign Apple configuration profiles with, leaf certificate first. Profiles are unsigned without it",
+					},
+					&cli.PathFlag{
+						Name:  "mobileconfig-key",
+						Usage: "PEM private key for --mobileconfig-cert",
+					},
+					&cli.DurationFlag{
+						Name:  "download-link-ttl",
+						Value: wireguardhttps.DefaultConfigDownloadTTL,
+						Usage: "how long one-time config download links stay valid. Unclaimed configs are deleted within a minute of expiring",
+					},
+					&cli.BoolFlag{
+						Name:  "trust-proxy-headers",
+						Usage: "take client IPs for audit logs and emails from X-Forwarded-For. Only set this behind a reverse proxy that overwrites the header. Always on for Heroku",
+					},
+				}, append(webhookFlags(), wgrpcdFlags()...)...),
 				Action: actionServe,
 			},
+			{
+				Name:        "reconcile",
+				Usage:       "compares the database with the Wireguard interface",
+				Description: "reports peers on the Wireguard interface with no device and devices with no peer, and repairs them unless --dry-run is set. peers being added by a running server can briefly look orphaned, so orphan peers are only removed if they're still orphaned after --orphan-grace-period",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:     "connection-string",
+						Usage:    "postgresql database connection string",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Value: false,
+						Usage: "report drift without repairing it",
+					},
+					&cli.BoolFlag{
+						Name:  "prune-missing",
+						Value: false,
+						Usage: "delete devices missing from the Wireguard interface. their owners will have to create them again",
+					},
+					&cli.DurationFlag{
+						Name:  "orphan-grace-period",
+						Value: time.Minute,
+						Usage: "how long a peer must stay orphaned before it's removed",
+					},
+				}, wgrpcdFlags()...),
+				Action: actionReconcile,
+			},
 		},
 	}
 
@@ -202,6 +426,105 @@ func main() {
 	}
 }
 
+// webhookFlags are the flags needed by every command that sends events to webhooks.
+// Commands other than serve only queue their events in the database, and a running serve delivers them.
+func webhookFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "webhook-url",
+			Usage: "URL to POST signed JSON notifications of device and admin events to. Can be repeated",
+		},
+		&cli.StringFlag{
+			Name:  "webhook-secret",
+			Usage: "key used to sign webhook payloads with HMAC-SHA256",
+		},
+		&cli.StringSliceFlag{
+			Name:  "webhook-event",
+			Usage: "audit action to send to webhooks, such as device.create. Can be repeated. Defaults to every device and admin event",
+		},
+	}
+}
+
+// webhookDispatcher builds a WebhookDispatcher from --webhook-url, --webhook-secret and --webhook-event.
+// It returns nil if no webhooks are configured.
+func webhookDispatcher(c *cli.Context, database wireguardhttps.Database) (*wireguardhttps.WebhookDispatcher, error) {
+	webhookURLs := c.StringSlice("webhook-url")
+	if len(webhookURLs) == 0 {
+		return nil, nil
+	}
+
+	webhookSecret := c.String("webhook-secret")
+	if webhookSecret == "" {
+		return nil, fmt.Errorf("--webhook-secret is required with --webhook-url")
+	}
+
+	webhooks := []wireguardhttps.Webhook{}
+	for _, webhookURL := range webhookURLs {
+		webhooks = append(webhooks, wireguardhttps.Webhook{
+			URL:    webhookURL,
+			Secret: []byte(webhookSecret),
+			Events: c.StringSlice("webhook-event"),
+		})
+	}
+	return wireguardhttps.NewWebhookDispatcher(database, webhooks), nil
+}
+
+// wgrpcdFlags are the flags needed by every command that talks to wgrpcd.
+func wgrpcdFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "wgrpcd-address",
+			Value: "localhost:15002",
+			Usage: "the wgrpcd gRPC server on localhost. It must be running to run this program.",
+		},
+		&cli.StringFlag{
+			Name:  "wireguard-device",
+			Value: "wg0",
+			Usage: "wireguard device name as shown in network interfaces",
+		},
+		&cli.StringFlag{
+			Name:     "openid-provider",
+			Usage:    "Client ID from the OAuth2 provider",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "openid-client-id",
+			Usage:    "Client ID from the OAuth2 provider",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "openid-client-secret",
+			Usage:    "Client secret from the OAuth2 provider",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "openid-audience",
+			Usage:    "Audience from the OAuth2 provider",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "openid-token-url",
+			Usage:    "Token url from the OAuth2 provider",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "wgrpcd-ca-cert",
+			Usage: "wgrpcd CA cert",
+			Value: "cacert.pem",
+		},
+		&cli.StringFlag{
+			Name:  "wgrpcd-client-cert",
+			Usage: "wgrpcd client cert",
+			Value: "clientcert.pem",
+		},
+		&cli.StringFlag{
+			Name:  "wgrpcd-client-key",
+			Usage: "wgrpcd client key",
+			Value: "clientkey.pem",
+		},
+	}
+}
+
 func prompt() {
 	log.Println("wireguardhttps 0.0.1")
 	log.Println("This software has not been audited.\nVulnerabilities in this can compromise your server and user data.\nDo not run this in production")
@@ -218,14 +541,15 @@ func checkWireguardDevice(wireguardDevice string, foundDevices []string) bool {
 }
 
 func actionInitialize(c *cli.Context) error {
-	subnet := c.String("subnet")
-	_, network, err := net.ParseCIDR(subnet)
-	if err != nil {
-		return fmt.Errorf("--subnet must be a subnet specified in valid CIDR notation, got %v", subnet)
+	addressRanges := []*wireguardhttps.AddressRange{}
+	for _, subnet := range c.StringSlice("subnet") {
+		_, network, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return fmt.Errorf("--subnet must be a subnet specified in valid CIDR notation, got %v", subnet)
+		}
+		addressRanges = append(addressRanges, &wireguardhttps.AddressRange{Network: *network})
 	}
-	addressRange := &wireguardhttps.AddressRange{Network: *network}
 	prompt()
-	log.Println("Allocating IP addresses in", network)
 
 	connectionString := c.String("connection-string")
 	database, err := wireguardhttps.NewPostgresDatabase(connectionString)
@@ -239,46 +563,219 @@ func actionInitialize(c *cli.Context) error {
 		return err
 	}
 
-	addresses := addressRange.Addresses()
-	err = database.AllocateSubnet(addresses)
+	if poolName := c.String("pool"); poolName != "" {
+		// --subnet defaults to the default pool's subnet, which a named pool must never share.
+		if !c.IsSet("subnet") {
+			return fmt.Errorf("--subnet is required with --pool")
+		}
+		return initializePool(c, database, poolName, addressRanges)
+	}
+
+	for _, addressRange := range addressRanges {
+		network := addressRange.Network
+		// IPv6 subnets are too large to store every address, so they're always allocated as devices are created.
+		if addressRange.IsIPv6() || c.Bool("lazy-allocation") {
+			err = database.RegisterSubnet(network)
+			if err != nil {
+				return err
+			}
+
+			log.Println("Registered subnet", network.String(), "for lazy allocation")
+			continue
+		}
+
+		log.Println("Allocating IP addresses in", network.String())
+		// We don't allocate the server, network or broadcast addresses.
+		addresses := []net.IP{}
+		for _, address := range addressRange.Addresses() {
+			if !addressRange.IsReserved(address) {
+				addresses = append(addresses, address)
+			}
+		}
+
+		err = database.AllocateSubnet(addresses)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Allocated %v addresses in %v\n", len(addresses), network.String())
+	}
+	return nil
+}
+
+func initializePool(c *cli.Context, database wireguardhttps.Database, poolName string, addressRanges []*wireguardhttps.AddressRange) error {
+	dnsServers, err := wgrpcd.StringsToIPs(c.StringSlice("pool-dns"))
+	if err != nil {
+		return fmt.Errorf("--pool-dns must be valid IP addresses. %v", err)
+	}
+
+	allowedIPs := c.StringSlice("pool-allowed-ips")
+	for _, allowedIP := range allowedIPs {
+		_, _, err := net.ParseCIDR(allowedIP)
+		if err != nil {
+			return fmt.Errorf("--pool-allowed-ips must be subnets specified in valid CIDR notation, got %v", allowedIP)
+		}
+	}
+
+	networks := []net.IPNet{}
+	for _, addressRange := range addressRanges {
+		networks = append(networks, addressRange.Network)
+	}
+
+	pool := wireguardhttps.AddressPool{
+		Name:           poolName,
+		DNSServers:     strings.Join(wgrpcd.IPsToStrings(dnsServers), ","),
+		AllowedIPs:     strings.Join(allowedIPs, ","),
+		DeviceLifetime: c.Duration("pool-device-lifetime"),
+	}
+	members := []wireguardhttps.AddressPoolMember{}
+	for _, qualifiedID := range c.StringSlice("pool-member") {
+		authPlatform, authPlatformUserID, err := wireguardhttps.ParseQualifiedUserID(qualifiedID)
+		if err != nil {
+			return fmt.Errorf("--pool-member is invalid. %v", err)
+		}
+		members = append(members, wireguardhttps.AddressPoolMember{AuthPlatform: authPlatform, AuthPlatformUserID: authPlatformUserID})
+	}
+
+	pool, err = database.SavePool(pool, networks, members)
 	if err != nil {
 		return err
 	}
 
-	// We don't allocate the server, network or broadcast addresses.
-	log.Printf("Allocated %v addresses in %v\n", len(addresses)-3, network)
+	log.Printf("Saved pool %v with subnets %v and %v members\n", pool.Name, wgrpcd.IPNetsToStrings(networks), len(pool.Members))
 	return nil
 }
 
-func actionServe(c *cli.Context) error {
-	serverHostName := c.String("wireguard-host")
-	wireguardListenPort := c.Int("wireguard-listen-port")
+func actionSetAdmin(isAdmin bool) func(*cli.Context) error {
+	return func(c *cli.Context) error {
+		database, err := wireguardhttps.NewPostgresDatabase(c.String("connection-string"))
+		if err != nil {
+			return err
+		}
+		defer database.Close()
 
-	endpointURL, err := url.Parse(fmt.Sprintf("%v:%v", serverHostName, wireguardListenPort))
+		err = database.Initialize()
+		if err != nil {
+			return err
+		}
+
+		authPlatform, authPlatformUserID, err := wireguardhttps.ParseQualifiedUserID(c.String("user-id"))
+		if err != nil {
+			return fmt.Errorf("--user-id is invalid. %v", err)
+		}
+
+		user, err := database.SetAdmin(authPlatform, authPlatformUserID, isAdmin)
+		if err != nil {
+			return err
+		}
+
+		action := wireguardhttps.AuditActionAdminDemote
+		if isAdmin {
+			action = wireguardhttps.AuditActionAdminPromote
+		}
+		wireguardhttps.RecordAuditEvent(database, wireguardhttps.AuditEvent{Action: action, Actor: wireguardhttps.CLIActor, Subject: user.AuthPlatformUserID})
+
+		log.Printf("Set admin to %v for user %v\n", isAdmin, user.AuthPlatformUserID)
+		return nil
+	}
+}
+
+func actionSetDeviceLifetime(c *cli.Context) error {
+	database, err := wireguardhttps.NewPostgresDatabase(c.String("connection-string"))
 	if err != nil {
-		return fmt.Errorf("--wireguard-host must be a valid URL, got %v", serverHostName)
+		return err
 	}
+	defer database.Close()
 
-	httpHost, err := url.Parse(c.String("http-host"))
+	err = database.Initialize()
 	if err != nil {
-		return fmt.Errorf("--http-host must be a valid URL, got %v", httpHost)
+		return err
 	}
 
-	dnsServers, err := wgrpcd.StringsToIPs(c.StringSlice("client-dns"))
+	authPlatform, authPlatformUserID, err := wireguardhttps.ParseQualifiedUserID(c.String("user-id"))
 	if err != nil {
-		return fmt.Errorf("--client-dns must be valid IP addresses. %v", err)
+		return fmt.Errorf("--user-id is invalid. %v", err)
 	}
 
-	templatesDirectory := c.Path("templates-directory")
-	wgRPCdAddress := c.String("wgrpcd-address")
-	wireguardDevice := c.String("wireguard-device")
-	connectionString := c.String("connection-string")
-	azureADKey := c.String("azure-ad-key")
-	azureADSecret := c.String("azure-ad-secret")
-	azureADCallbackURL := c.String("azure-ad-callback-url")
-	listenAddr := c.String("http-listen-addr")
+	user, err := database.SetDeviceLifetime(authPlatform, authPlatformUserID, c.Duration("lifetime"))
+	if err != nil {
+		return err
+	}
 
-	database, err := wireguardhttps.NewPostgresDatabase(connectionString)
+	log.Printf("Set device lifetime to %v for user %v\n", c.Duration("lifetime"), user.AuthPlatformUserID)
+	return nil
+}
+
+func actionSetDeviceLimit(c *cli.Context) error {
+	database, err := wireguardhttps.NewPostgresDatabase(c.String("connection-string"))
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	err = database.Initialize()
+	if err != nil {
+		return err
+	}
+
+	authPlatform, authPlatformUserID, err := wireguardhttps.ParseQualifiedUserID(c.String("user-id"))
+	if err != nil {
+		return fmt.Errorf("--user-id is invalid. %v", err)
+	}
+
+	user, err := database.SetDeviceLimit(authPlatform, authPlatformUserID, c.Int("limit"))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Set device limit to %v for user %v\n", c.Int("limit"), user.AuthPlatformUserID)
+	return nil
+}
+
+func actionDeleteUser(c *cli.Context) error {
+	database, err := wireguardhttps.NewPostgresDatabase(c.String("connection-string"))
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	err = database.Initialize()
+	if err != nil {
+		return err
+	}
+
+	authPlatform, authPlatformUserID, err := wireguardhttps.ParseQualifiedUserID(c.String("user-id"))
+	if err != nil {
+		return fmt.Errorf("--user-id is invalid. %v", err)
+	}
+
+	user, err := database.FindUser(authPlatform, authPlatformUserID)
+	if err != nil {
+		return err
+	}
+
+	dispatcher, err := webhookDispatcher(c, database)
+	if err != nil {
+		return err
+	}
+
+	wireguardClient, err := connectWireguardClient(c)
+	if err != nil {
+		return err
+	}
+	defer wireguardClient.Close()
+
+	event := wireguardhttps.AuditEvent{Action: wireguardhttps.AuditActionAdminUserDelete, Actor: wireguardhttps.CLIActor, Subject: user.AuthPlatformUserID}
+	err = wireguardhttps.DeleteUserAndDevices(database, dispatcher, user, wireguardhttps.RemovePeer(wireguardClient, c.String("wireguard-device")), event)
+	if err != nil {
+		return err
+	}
+	log.Printf("Deleted user %v and their devices\n", user.AuthPlatformUserID)
+	return nil
+}
+
+func actionReconcile(c *cli.Context) error {
+	database, err := wireguardhttps.NewPostgresDatabase(c.String("connection-string"))
 	if err != nil {
 		return err
 	}
@@ -289,6 +786,86 @@ func actionServe(c *cli.Context) error {
 		return err
 	}
 
+	wireguardClient, err := connectWireguardClient(c)
+	if err != nil {
+		return err
+	}
+	defer wireguardClient.Close()
+
+	reconciler := &wireguardhttps.Reconciler{
+		Database:            database,
+		WireguardClient:     wireguardClient,
+		WireguardDeviceName: c.String("wireguard-device"),
+		PruneMissing:        c.Bool("prune-missing"),
+	}
+	report, err := reconciler.Reconcile(false)
+	if err != nil {
+		return err
+	}
+
+	if !c.Bool("dry-run") && !report.InSync() {
+		gracePeriod := c.Duration("orphan-grace-period")
+		log.Printf("Checking again in %v before repairing\n", gracePeriod)
+		time.Sleep(gracePeriod)
+
+		report, err = reconciler.Reconcile(true)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, orphan := range report.OrphanPeers {
+		log.Println("Orphan peer:", orphan)
+	}
+
+	for _, device := range report.MissingPeers {
+		log.Printf("Missing peer: device %v (%v) owned by %v\n", device.ID, device.PublicKey, device.Owner.AuthPlatformUserID)
+	}
+
+	if report.InSync() {
+		log.Println("Database and Wireguard interface are in sync")
+	}
+	return nil
+}
+
+// loginProviders builds the Azure AD provider if it's configured and every --oidc-provider, along with their login policies keyed by provider name.
+func loginProviders(c *cli.Context, httpHost *url.URL) ([]goth.Provider, map[string]*wireguardhttps.LoginPolicy, error) {
+	providers := []goth.Provider{}
+	policies := map[string]*wireguardhttps.LoginPolicy{}
+	if azureADKey := c.String("azure-ad-key"); azureADKey != "" {
+		provider := azureadv2.New(
+			azureADKey,
+			c.String("azure-ad-secret"),
+			c.String("azure-ad-callback-url"),
+			azureadv2.ProviderOptions{Tenant: azureadv2.TenantType(c.String("ad-tenant"))},
+		)
+		providers = append(providers, provider)
+		policies[provider.Name()] = &wireguardhttps.LoginPolicy{AllowedEmailDomains: c.StringSlice("azure-ad-allowed-email-domains"), VerifiedEmailClaim: "userPrincipalName"}
+	}
+
+	for _, spec := range c.StringSlice("oidc-provider") {
+		config, err := wireguardhttps.ParseOIDCProviderConfig(spec, httpHost)
+		if err != nil {
+			return nil, nil, fmt.Errorf("--oidc-provider is invalid. %v", err)
+		}
+
+		provider, err := config.Provider()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to set up OpenID Connect provider %v: %v", config.Name, err)
+		}
+		providers = append(providers, provider)
+		policies[config.Name] = &config.Policy
+	}
+
+	if len(providers) == 0 {
+		return nil, nil, fmt.Errorf("configure a login provider with --azure-ad-key or --oidc-provider")
+	}
+	return providers, policies, nil
+}
+
+// connectWireguardClient connects to wgrpcd and checks that --wireguard-device exists.
+// extraOptions are added to the dial options built from the flags.
+func connectWireguardClient(c *cli.Context, extraOptions ...grpc.DialOption) (*wgrpcd.Client, error) {
 	clientKeyBytes, err := ioutil.ReadFile(c.String("wgrpcd-client-key"))
 	if err != nil {
 		log.Fatalf("failed to read client key: %v", err)
@@ -305,7 +882,7 @@ func actionServe(c *cli.Context) error {
 	audience := c.String("openid-audience")
 	openIDProvider := c.String("openid-provider")
 
-	opts := []grpc.DialOption{}
+	opts := append([]grpc.DialOption{}, extraOptions...)
 	switch openIDProvider {
 	case "auth0":
 		creds := grpcauth.Auth0M2MClientCredentials(
@@ -327,52 +904,179 @@ func actionServe(c *cli.Context) error {
 		opts = append(opts, creds)
 
 	default:
-		return fmt.Errorf("--openid-provider must be 'aws' or 'auth0', got %s", openIDProvider)
+		return nil, fmt.Errorf("--openid-provider must be 'aws' or 'auth0', got %s", openIDProvider)
 	}
 
 	config := &wgrpcd.ClientConfig{
 		ClientKeyBytes:  clientKeyBytes,
 		ClientCertBytes: clientCertBytes,
 		CACertFilename:  c.String("wgrpcd-ca-cert"),
-		GRPCAddress:     wgRPCdAddress,
+		GRPCAddress:     c.String("wgrpcd-address"),
 		Options:         opts,
 	}
 
 	wireguardClient, err := wgrpcd.NewClient(config)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	err = wireguardClient.Connect()
+	if err != nil {
+		return nil, err
+	}
+
+	devices, err := wireguardClient.Devices(context.Background())
+	if err != nil {
+		wireguardClient.Close()
+		return nil, err
+	}
+
+	wireguardDevice := c.String("wireguard-device")
+	if !checkWireguardDevice(wireguardDevice, devices) {
+		wireguardClient.Close()
+		return nil, fmt.Errorf("%v is not a Wireguard device. Found %v", wireguardDevice, devices)
+	}
+
+	return wireguardClient, nil
+}
+
+// mobileConfigSettings loads the Apple configuration profile settings, including the signing certificate if one is configured.
+func mobileConfigSettings(c *cli.Context) (wireguardhttps.MobileConfigSettings, error) {
+	settings := wireguardhttps.MobileConfigSettings{
+		OnDemand:     c.Bool("mobileconfig-on-demand"),
+		TrustedSSIDs: c.StringSlice("mobileconfig-trusted-ssid"),
+	}
+
+	certFile, keyFile := c.Path("mobileconfig-cert"), c.Path("mobileconfig-key")
+	if certFile == "" && keyFile == "" {
+		return settings, nil
+	}
+
+	keyPair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return settings, fmt.Errorf("--mobileconfig-cert and --mobileconfig-key must be a PEM certificate and its key. %v", err)
+	}
+
+	certificates := []*x509.Certificate{}
+	for _, der := range keyPair.Certificate {
+		certificate, err := x509.ParseCertificate(der)
+		if err != nil {
+			return settings, err
+		}
+		certificates = append(certificates, certificate)
+	}
+
+	settings.Certificate = certificates[0]
+	settings.Intermediates = certificates[1:]
+	settings.PrivateKey = keyPair.PrivateKey
+	return settings, nil
+}
+
+func actionServe(c *cli.Context) error {
+	serverHostName := c.String("wireguard-host")
+	wireguardListenPort := c.Int("wireguard-listen-port")
+
+	endpointURL, err := url.Parse(fmt.Sprintf("%v:%v", serverHostName, wireguardListenPort))
+	if err != nil {
+		return fmt.Errorf("--wireguard-host must be a valid URL, got %v", serverHostName)
+	}
+
+	httpHost, err := url.Parse(c.String("http-host"))
+	if err != nil {
+		return fmt.Errorf("--http-host must be a valid URL, got %v", httpHost)
+	}
+
+	dnsServers, err := wgrpcd.StringsToIPs(c.StringSlice("client-dns"))
+	if err != nil {
+		return fmt.Errorf("--client-dns must be valid IP addresses. %v", err)
+	}
+
+	templatesDirectory := c.Path("templates-directory")
+	wireguardDevice := c.String("wireguard-device")
+	connectionString := c.String("connection-string")
+	listenAddr := c.String("http-listen-addr")
+
+	database, err := wireguardhttps.NewPostgresDatabase(connectionString)
 	if err != nil {
 		return err
 	}
+	defer database.Close()
 
-	defer wireguardClient.Close()
+	err = database.Initialize()
+	if err != nil {
+		return err
+	}
 
-	devices, err := wireguardClient.Devices(context.Background())
+	var metrics *wireguardhttps.Metrics
+	var wireguardOptions []grpc.DialOption
+	metricsListenAddr := c.String("metrics-listen-addr")
+	if metricsListenAddr != "" {
+		metrics = wireguardhttps.NewMetrics(database)
+		wireguardOptions = append(wireguardOptions, grpc.WithChainUnaryInterceptor(metrics.UnaryClientInterceptor()))
+	}
+
+	wireguardClient, err := connectWireguardClient(c, wireguardOptions...)
 	if err != nil {
 		return err
 	}
+	defer wireguardClient.Close()
+
+	var client interface{} = wireguardClient
+	if _, ok := client.(wireguardhttps.PeerImporter); !ok {
+		log.Println("wgrpcd can't import peers. Devices with client generated public keys are unavailable")
+	}
+
+	if _, ok := client.(wireguardhttps.PresharedKeyConfigurer); !ok {
+		log.Println("wgrpcd can't set preshared keys. Devices with preshared keys are unavailable")
+	}
 
 	addresses, err := database.Addresses()
 	if err != nil {
 		return err
 	}
 
-	if len(addresses) == 0 {
+	subnets, err := database.Subnets()
+	if err != nil {
+		return err
+	}
+
+	if len(addresses) == 0 && len(subnets) == 0 {
 		return fmt.Errorf("allocate a subnet first with initialize")
 	}
 
-	if !checkWireguardDevice(wireguardDevice, devices) {
-		return fmt.Errorf("%v is not a Wireguard device. Found %v", wireguardDevice, devices)
+	templates, err := wireguardhttps.LoadConfigTemplates(filepath.Join(templatesDirectory, "config"))
+	if err != nil {
+		return err
 	}
+	templates["peer_config"] = template.Must(
+		template.New("peerconfig.tmpl").
+			Funcs(wireguardhttps.ConfigTemplateFuncs).
+			ParseFiles(filepath.Join(templatesDirectory, "ini/peerconfig.tmpl")),
+	)
+
+	var mailer *wireguardhttps.Mailer
+	if smtpAddr := c.String("smtp-addr"); smtpAddr != "" {
+		smtpFrom := c.String("smtp-from")
+		if smtpFrom == "" {
+			return fmt.Errorf("--smtp-from is required with --smtp-addr")
+		}
 
-	templates := map[string]*template.Template{
-		"peer_config": template.Must(
-			template.New("peerconfig.tmpl").
-				Funcs(map[string]interface{}{"StringsJoin": strings.Join}).
-				ParseFiles(filepath.Join(templatesDirectory, "ini/peerconfig.tmpl")),
-		),
+		for _, email := range []string{
+			wireguardhttps.EmailDeviceCreated,
+			wireguardhttps.EmailDeviceRekeyed,
+			wireguardhttps.EmailDeviceDeleted,
+			wireguardhttps.EmailDeviceExpiring,
+		} {
+			templates["email_"+email] = template.Must(
+				template.ParseFiles(filepath.Join(templatesDirectory, "email", email+".tmpl")),
+			)
+		}
+
+		mailer = wireguardhttps.NewMailer(wireguardhttps.SMTPConfig{
+			Addr:     smtpAddr,
+			Username: c.String("smtp-username"),
+			Password: c.String("smtp-password"),
+			From:     smtpFrom,
+		}, templates)
 	}
 
 	debugMode := c.Bool("debug")
@@ -404,6 +1108,16 @@ func actionServe(c *cli.Context) error {
 		cdnWhitelist = append(cdnWhitelist, origin)
 	}
 
+	authProviders, loginPolicies, err := loginProviders(c, httpHost)
+	if err != nil {
+		return err
+	}
+
+	mobileConfig, err := mobileConfigSettings(c)
+	if err != nil {
+		return err
+	}
+
 	isHeroku := os.Getenv("HEROKU") != ""
 	serverConfig := &wireguardhttps.ServerConfig{
 		DNSServers:          dnsServers,
@@ -413,17 +1127,80 @@ func actionServe(c *cli.Context) error {
 		WireguardDeviceName: wireguardDevice,
 		WireguardClient:     wireguardClient,
 		Database:            database,
-		AuthProviders: []goth.Provider{
-			azureadv2.New(azureADKey, azureADSecret, azureADCallbackURL, azureadv2.ProviderOptions{Tenant: azureadv2.TenantType(c.String("ad-tenant"))}),
-		},
-		SessionStore:    gothic.Store,
-		SessionName:     c.String("api-session-name"),
-		IsDebug:         debugMode,
-		CSRFKey:         csrfSessionKey,
-		StaticAssetsDir: c.String("static-assets-dir"),
-		MaxCookieAge:    maxCookieAge,
-		IsHeroku:        isHeroku,
-		CDNWhitelist:    cdnWhitelist,
+		AuthProviders:       authProviders,
+		LoginPolicies:       loginPolicies,
+		SessionStore:        gothic.Store,
+		SessionName:         c.String("api-session-name"),
+		IsDebug:             debugMode,
+		CSRFKey:             csrfSessionKey,
+		StaticAssetsDir:     c.String("static-assets-dir"),
+		MaxCookieAge:        maxCookieAge,
+		IsHeroku:            isHeroku,
+		TrustProxyHeaders:   isHeroku || c.Bool("trust-proxy-headers"),
+		CDNWhitelist:        cdnWhitelist,
+		PeerStatusTTL:       c.Duration("peer-status-ttl"),
+		DeviceLifetime:      c.Duration("device-lifetime"),
+		MaxKeyAge:           c.Duration("max-key-age"),
+		KeyRotationWarning:  c.Duration("key-rotation-warning"),
+		DeviceLimit:         c.Int("device-limit"),
+		AdminDeviceLimit:    c.Int("admin-device-limit"),
+		Metrics:             metrics,
+		Mailer:              mailer,
+		MobileConfig:        mobileConfig,
+		ConfigDownloadTTL:   c.Duration("download-link-ttl"),
+	}
+
+	serverConfig.WebhookDispatcher, err = webhookDispatcher(c, database)
+	if err != nil {
+		return err
+	}
+
+	if serverConfig.WebhookDispatcher != nil {
+		go serverConfig.WebhookDispatcher.Run(context.Background(), c.Duration("webhook-retry-interval"))
+	}
+
+	if interval := c.Duration("reconcile-interval"); interval > 0 {
+		reconciler := &wireguardhttps.Reconciler{
+			Database:            database,
+			WireguardClient:     wireguardClient,
+			WireguardDeviceName: wireguardDevice,
+		}
+		go reconciler.Run(context.Background(), interval, c.Bool("reconcile-repair"))
+	}
+
+	configDownloadPurger := &wireguardhttps.ConfigDownloadPurger{Database: database}
+	go configDownloadPurger.Run(context.Background(), time.Minute)
+
+	if interval := c.Duration("expiry-interval"); interval > 0 {
+		expiryScheduler := &wireguardhttps.ExpiryScheduler{
+			Database:            database,
+			WireguardClient:     wireguardClient,
+			WireguardDeviceName: wireguardDevice,
+			Mailer:              mailer,
+			ExpiryWarning:       c.Duration("expiry-warning"),
+			WebhookDispatcher:   serverConfig.WebhookDispatcher,
+		}
+		go expiryScheduler.Run(context.Background(), interval)
+	}
+
+	maxKeyAge := c.Duration("max-key-age")
+	if interval := c.Duration("key-rotation-interval"); maxKeyAge > 0 && interval > 0 {
+		keyRotationEnforcer := &wireguardhttps.KeyRotationEnforcer{
+			Database:            database,
+			WireguardClient:     wireguardClient,
+			WireguardDeviceName: wireguardDevice,
+			MaxKeyAge:           maxKeyAge,
+			WebhookDispatcher:   serverConfig.WebhookDispatcher,
+		}
+		go keyRotationEnforcer.Run(context.Background(), interval)
+	}
+
+	if metrics != nil {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", metrics.Handler())
+		go func() {
+			log.Fatal(http.ListenAndServe(metricsListenAddr, metricsMux))
+		}()
 	}
 
 	router := wireguardhttps.Router(serverConfig)
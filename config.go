@@ -1,25 +1,57 @@
 package wireguardhttps
 
 import (
+	"context"
 	"net"
 	"net/url"
 	"text/template"
+	"time"
 
 	"github.com/gorilla/sessions"
 	"github.com/joncooperworks/wgrpcd"
 	"github.com/markbates/goth"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
+// WireguardClient is the subset of the wgrpcd client API wireguardhttps uses to manage peers.
+// *wgrpcd.Client satisfies it; tests can substitute their own implementation.
+type WireguardClient interface {
+	CreatePeer(ctx context.Context, deviceName string, allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error)
+	RekeyPeer(ctx context.Context, deviceName string, oldPublicKey wgtypes.Key, allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error)
+	ChangeListenPort(ctx context.Context, deviceName string, listenPort int) (int32, error)
+	RemovePeer(ctx context.Context, deviceName string, publicKey wgtypes.Key) (bool, error)
+	ListPeers(ctx context.Context, deviceName string) ([]*wgrpcd.Peer, error)
+	Devices(ctx context.Context) ([]string, error)
+}
+
+// PeerImporter is implemented by Wireguard clients that can add a peer using a public key generated by the client device.
+// presharedKey is set on the peer in the same call if it isn't nil.
+// The pinned wgrpcd release only supports server generated keys, so *wgrpcd.Client doesn't implement this and requests for client generated keys return 501.
+// wireguardhttps checks for it at request time instead of requiring it in WireguardClient, so a wgrpcd client that supports it is used without other changes.
+type PeerImporter interface {
+	ImportPeer(ctx context.Context, deviceName string, publicKey wgtypes.Key, presharedKey *wgtypes.Key, allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error)
+}
+
+// PresharedKeyConfigurer is implemented by Wireguard clients that can create and rekey peers with a preshared key.
+// The key is set in the same call that changes the peer, so a failure can't leave the interface with a peer the Database doesn't know about.
+// Like PeerImporter, *wgrpcd.Client doesn't implement this in the pinned release, so requests for preshared keys return 501.
+type PresharedKeyConfigurer interface {
+	CreatePeerWithPresharedKey(ctx context.Context, deviceName string, presharedKey wgtypes.Key, allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error)
+	RekeyPeerWithPresharedKey(ctx context.Context, deviceName string, oldPublicKey, presharedKey wgtypes.Key, allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error)
+}
+
 // ServerConfig contains all info needed to configure a WireguardHTTPS instance.
+// TrustProxyHeaders takes client IPs from X-Forwarded-For and X-Real-IP; only set it behind a reverse proxy that overwrites them.
 type ServerConfig struct {
 	DNSServers          []net.IP
 	Endpoint            *url.URL
 	HTTPHost            *url.URL
 	Templates           map[string]*template.Template
 	WireguardDeviceName string
-	WireguardClient     *wgrpcd.Client
+	WireguardClient     WireguardClient
 	Database            Database
 	AuthProviders       []goth.Provider
+	LoginPolicies       map[string]*LoginPolicy
 	IsDebug             bool
 	SessionStore        sessions.Store
 	SessionName         string
@@ -28,4 +60,35 @@ type ServerConfig struct {
 	CDNWhitelist        []*url.URL
 	MaxCookieAge        int
 	IsHeroku            bool
+	TrustProxyHeaders   bool
+	PeerStatusTTL       time.Duration
+	DeviceLifetime      time.Duration
+	MaxKeyAge           time.Duration
+	KeyRotationWarning  time.Duration
+	DeviceLimit         int
+	AdminDeviceLimit    int
+	Metrics             *Metrics
+	WebhookDispatcher   *WebhookDispatcher
+	Mailer              *Mailer
+	MobileConfig        MobileConfigSettings
+	ConfigDownloadTTL   time.Duration
+}
+
+// RemovePeer returns a DeviceDeleteFunc that removes devices from deviceName using client.
+// The CLI uses this to tear down devices outside of an HTTP request.
+// Disabled devices have already been removed from the interface, so they're skipped.
+func RemovePeer(client WireguardClient, deviceName string) DeviceDeleteFunc {
+	return func(device Device) error {
+		if device.DisabledAt != nil {
+			return nil
+		}
+
+		publicKey, err := wgtypes.ParseKey(device.PublicKey)
+		if err != nil {
+			return err
+		}
+
+		_, err = client.RemovePeer(context.Background(), deviceName, publicKey)
+		return err
+	}
 }
@@ -0,0 +1,151 @@
+package wireguardhttps
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/url"
+	"time"
+)
+
+// DefaultConfigDownloadTTL is how long a download link is valid for when ServerConfig.ConfigDownloadTTL isn't set.
+const DefaultConfigDownloadTTL = 15 * time.Minute
+
+// configDownloadKeyInfo separates the key that encrypts a download's config from the token hash stored next to it.
+const configDownloadKeyInfo = "wireguardhttps config download"
+
+// configDownloadPage is served when a download link is opened.
+// It only claims the link when the form is submitted, so link previews and scanners that fetch it don't use it up.
+// The form posts back to the page's own URL, keeping any format in the query string.
+var configDownloadPage = template.Must(template.New("download").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Download VPN config</title>
+</head>
+<body>
+<p>This link can only be used once.</p>
+<form method="post">
+<button type="submit">Download VPN config</button>
+</form>
+</body>
+</html>
+`))
+
+var errConfigDownloadCorrupt = errors.New("config download could not be decrypted")
+
+// GenerateConfigDownloadToken returns a new random token for a one-time download link.
+// The token is only ever part of the link; the Database stores its hash, and it's the only way to derive the config's encryption key.
+func GenerateConfigDownloadToken() (string, error) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// configDownloadURL is the link a download's token is claimed from.
+func configDownloadURL(httpHost *url.URL, token string) string {
+	downloadURL := url.URL{
+		Scheme: "https",
+		Host:   httpHost.String(),
+		Path:   "/api/downloads/" + token,
+	}
+	return downloadURL.String()
+}
+
+// configDownloadKey derives the AES-256 key for a download from its token.
+func configDownloadKey(token string) []byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(configDownloadKeyInfo))
+	return mac.Sum(nil)
+}
+
+func configDownloadCipher(token string) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(configDownloadKey(token))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SealConfigDownload encrypts rendered config files with AES-GCM under a key derived from token.
+// The nonce is prepended to the returned ciphertext.
+func SealConfigDownload(token string, files map[string][]byte) ([]byte, error) {
+	plaintext, err := json.Marshal(files)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := configDownloadCipher(token)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// OpenConfigDownload decrypts config files sealed by SealConfigDownload.
+func OpenConfigDownload(token string, ciphertext []byte) (map[string][]byte, error) {
+	aead, err := configDownloadCipher(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errConfigDownloadCorrupt
+	}
+
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, errConfigDownloadCorrupt
+	}
+
+	var files map[string][]byte
+	err = json.Unmarshal(plaintext, &files)
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// ConfigDownloadPurger deletes expired download links and the configs sealed in them.
+// It runs whether or not devices expire, so unclaimed configs never outlive their links for long.
+type ConfigDownloadPurger struct {
+	Database Database
+}
+
+// Run deletes expired download links every interval until ctx is cancelled.
+func (p *ConfigDownloadPurger) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			_, err := p.Database.PurgeConfigDownloads(now)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
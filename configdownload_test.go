@@ -0,0 +1,232 @@
+package wireguardhttps
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joncooperworks/wgrpcd"
+)
+
+// claimConfigDownload sends method to a download link without a session, as a phone opening the link would.
+func claimConfigDownload(t *testing.T, config *ServerConfig, method, downloadURL string) *httptest.ResponseRecorder {
+	writer := httptest.NewRecorder()
+	request, err := http.NewRequest(method, downloadURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.RemoteAddr = testRemoteAddr
+
+	Router(config).ServeHTTP(writer, request)
+	return writer
+}
+
+func TestConfigDownloadCanOnlyBeOpenedWithItsToken(t *testing.T) {
+	token, err := GenerateConfigDownloadToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{wgQuickFileName: []byte(expectedPeerConfig)}
+	ciphertext, err := SealConfigDownload(token, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(ciphertext), testPrivateKey) {
+		t.Fatalf("Expected the private key to be encrypted")
+	}
+
+	otherToken, err := GenerateConfigDownloadToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenConfigDownload(otherToken, ciphertext)
+	if err != errConfigDownloadCorrupt {
+		t.Fatalf("Expected another token not to decrypt the config, got %v", err)
+	}
+
+	opened, err := OpenConfigDownload(token, ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(opened[wgQuickFileName]) != expectedPeerConfig {
+		t.Fatalf("Expected the sealed config, got %s", opened[wgQuickFileName])
+	}
+}
+
+func TestNewDeviceWithOneTimeDownloadLink(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	err := db.RegisterSubnet(mustParseCIDR("10.0.0.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.RegisterUser("jontom@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := testServerConfig(t, db)
+	config.ConfigDownloadTTL = time.Hour
+
+	writer := serveAsUser(t, config, &user, "POST", "/api/devices", DeviceRequest{Name: "Phone", OS: "iOS", DownloadLink: true})
+	if writer.Code != 200 || strings.Contains(writer.Body.String(), testPrivateKey) {
+		t.Fatalf("Expected status code 200 with a link instead of the config, got %v %v", writer.Code, writer.Body.String())
+	}
+
+	var response ConfigDownloadResponse
+	err = json.NewDecoder(writer.Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(response.URL, "https://localhost/api/downloads/") || response.DeviceID == 0 || time.Until(response.ExpiresAt) <= 0 {
+		t.Fatalf("Expected an unexpired download link for the new device, got %v", response)
+	}
+
+	downloadURL, err := url.Parse(response.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer = claimConfigDownload(t, config, "POST", downloadURL.Path+"?format=bmp")
+	if writer.Code != 400 {
+		t.Fatalf("Expected status code 400 for an unknown format, got %v", writer.Code)
+	}
+
+	// Link previews fetch the link with GET, which must not use it up.
+	for i := 0; i < 2; i++ {
+		writer = claimConfigDownload(t, config, "GET", downloadURL.Path)
+		if writer.Code != 200 || !strings.Contains(writer.Body.String(), `<form method="post">`) || strings.Contains(writer.Body.String(), testPrivateKey) {
+			t.Fatalf("Expected status code 200 with a download form, got %v %v", writer.Code, writer.Body.String())
+		}
+	}
+
+	writer = claimConfigDownload(t, config, "POST", downloadURL.Path)
+	if writer.Code != 200 || writer.Body.String() != expectedPeerConfig {
+		t.Fatalf("Expected status code 200 with the device's config, got %v %v", writer.Code, writer.Body.String())
+	}
+
+	writer = claimConfigDownload(t, config, "POST", downloadURL.Path)
+	if writer.Code != 404 {
+		t.Fatalf("Expected status code 404 once the link has been used, got %v", writer.Code)
+	}
+
+	events, err := db.AuditEvents(AuditFilter{Action: AuditActionDeviceDownload})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 || events[0].Actor != user.AuthPlatformUserID || *events[0].DeviceID != response.DeviceID {
+		t.Fatalf("Expected one download to be audited for %v, got %v", user.AuthPlatformUserID, events)
+	}
+}
+
+func TestExpiredConfigDownloadsArePurged(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	user, err := db.RegisterUser("jontom@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for _, expiresAt := range []time.Time{now.Add(-time.Minute), now.Add(time.Minute)} {
+		token, err := GenerateConfigDownloadToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = db.CreateConfigDownload(user, ConfigDownload{TokenHash: HashAPIToken(token), Ciphertext: []byte("sealed"), ExpiresAt: expiresAt})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = db.ClaimConfigDownload(HashAPIToken(token), now)
+		if expiresAt.Before(now) {
+			if _, ok := err.(*RecordNotFoundError); !ok {
+				t.Fatalf("Expected expired link not to be claimable, got %v", err)
+			}
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	purged, err := db.PurgeConfigDownloads(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if purged != 1 {
+		t.Fatalf("Expected the expired download to be purged, got %v", purged)
+	}
+}
+
+func TestDownloadLinksAreDeletedWhenTheirDeviceIsRekeyedOrRemoved(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	err := db.RegisterSubnet(mustParseCIDR("10.0.0.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.RegisterUser("jontom@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deviceFunc := func(allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
+		return &wgrpcd.PeerConfigInfo{PublicKey: testPublicKey, AllowedIPs: allowedIPs}, nil
+	}
+	device, _, err := db.CreateDevice(user, nil, Device{Name: "Phone", OS: "iOS"}, nil, deviceFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createDownload := func() string {
+		token, err := GenerateConfigDownloadToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = db.CreateConfigDownload(user, ConfigDownload{DeviceID: device.ID, TokenHash: HashAPIToken(token), Ciphertext: []byte("sealed"), ExpiresAt: time.Now().Add(time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	token := createDownload()
+	device, _, err = db.RekeyDevice(user, device, deviceFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.ClaimConfigDownload(HashAPIToken(token), time.Now())
+	if _, ok := err.(*RecordNotFoundError); !ok {
+		t.Fatalf("Expected a link to the old key to be deleted on rekey, got %v", err)
+	}
+
+	token = createDownload()
+	err = db.RemoveDevice(user, device, func() error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.ClaimConfigDownload(HashAPIToken(token), time.Now())
+	if _, ok := err.(*RecordNotFoundError); !ok {
+		t.Fatalf("Expected a link to a removed device to be deleted, got %v", err)
+	}
+}
@@ -0,0 +1,271 @@
+package wireguardhttps
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ConfigFormatWGQuick is the wg-quick INI format rendered by the peer_config template.
+// It's the default client config format, and the only one that can be returned as a QR code.
+const ConfigFormatWGQuick = "wg-quick"
+
+const (
+	// configTemplatePrefix prefixes the Templates keys of every client config format except ConfigFormatWGQuick.
+	configTemplatePrefix = "config_"
+
+	// wgQuickFileName is the file the peer_config template is downloaded as.
+	wgQuickFileName = "wg0.conf"
+
+	configTemplateExtension = ".tmpl"
+)
+
+// ConfigTemplateFuncs are the functions available to client config templates.
+var ConfigTemplateFuncs = template.FuncMap{
+	"StringsJoin": strings.Join,
+	"ToJSON":      toJSON,
+	"IPv4":        filterIPFamily(false),
+	"IPv6":        filterIPFamily(true),
+	"Inc":         func(i int) int { return i + 1 },
+	"Host":        endpointHost,
+	"Port":        endpointPort,
+}
+
+// ConfigFormat is a client config format devices can be downloaded in.
+// Files are the names of the files it renders. Formats with more than one file are downloaded as a zip archive.
+type ConfigFormat struct {
+	Name   string   `json:"name"`
+	Files  []string `json:"files"`
+	QRCode bool     `json:"qr_code"`
+}
+
+// LoadConfigTemplates parses each subdirectory of directory as a client config format named after the subdirectory.
+// Each .tmpl file in a format's directory renders one file, named after the template without its .tmpl extension.
+// The returned templates are keyed for ServerConfig.Templates.
+// A missing directory means there are no extra formats, so template directories from before config formats existed keep working.
+func LoadConfigTemplates(directory string) (map[string]*template.Template, error) {
+	templates := map[string]*template.Template{}
+	entries, err := ioutil.ReadDir(directory)
+	if os.IsNotExist(err) {
+		return templates, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == ConfigFormatWGQuick {
+			continue
+		}
+
+		files, err := filepath.Glob(filepath.Join(directory, entry.Name(), "*"+configTemplateExtension))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(files) == 0 {
+			continue
+		}
+
+		tmpl, err := template.New(entry.Name()).
+			Funcs(ConfigTemplateFuncs).
+			ParseFiles(files...)
+		if err != nil {
+			return nil, err
+		}
+		templates[configTemplatePrefix+entry.Name()] = tmpl
+	}
+	return templates, nil
+}
+
+// ConfigFormats lists the client config formats in templates, sorted by name.
+func ConfigFormats(templates map[string]*template.Template) []ConfigFormat {
+	formats := []ConfigFormat{}
+	if _, ok := templates["peer_config"]; ok {
+		formats = append(formats,
+			ConfigFormat{Name: ConfigFormatWGQuick, Files: []string{wgQuickFileName}, QRCode: true},
+			ConfigFormat{Name: ConfigFormatMobileConfig, Files: []string{mobileConfigFileName}},
+		)
+	}
+
+	for key, tmpl := range templates {
+		if !strings.HasPrefix(key, configTemplatePrefix) {
+			continue
+		}
+		formats = append(formats, ConfigFormat{Name: strings.TrimPrefix(key, configTemplatePrefix), Files: configFileNames(tmpl)})
+	}
+
+	sort.Slice(formats, func(i, j int) bool {
+		return formats[i].Name < formats[j].Name
+	})
+	return formats
+}
+
+// configTemplate returns the template for the client config format name.
+// Apple configuration profiles embed the wg-quick config, so they're rendered from the peer_config template too.
+func configTemplate(templates map[string]*template.Template, name string) (*template.Template, bool) {
+	if name == ConfigFormatWGQuick || name == ConfigFormatMobileConfig {
+		tmpl, ok := templates["peer_config"]
+		return tmpl, ok
+	}
+
+	tmpl, ok := templates[configTemplatePrefix+name]
+	return tmpl, ok
+}
+
+// configFileNames returns the files a config format template renders, sorted by name.
+// Templates defined inside the files aren't files themselves, so they're skipped.
+func configFileNames(tmpl *template.Template) []string {
+	names := []string{}
+	for _, file := range tmpl.Templates() {
+		if strings.HasSuffix(file.Name(), configTemplateExtension) {
+			names = append(names, strings.TrimSuffix(file.Name(), configTemplateExtension))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// renderConfigFiles renders each file of a config format template with peerConfig.
+func renderConfigFiles(tmpl *template.Template, peerConfig *PeerConfigINI) (map[string][]byte, error) {
+	files := map[string][]byte{}
+	for _, name := range configFileNames(tmpl) {
+		buffer := &bytes.Buffer{}
+		err := tmpl.ExecuteTemplate(buffer, name+configTemplateExtension, peerConfig)
+		if err != nil {
+			return nil, err
+		}
+		files[name] = buffer.Bytes()
+	}
+	return files, nil
+}
+
+// renderDeviceConfig renders device's peerConfig with the template for configFormat, keyed by file name.
+func (wh *WireguardHandlers) renderDeviceConfig(configFormat string, tmpl *template.Template, peerConfig *PeerConfigINI, device Device) (map[string][]byte, error) {
+	if configFormat != ConfigFormatWGQuick && configFormat != ConfigFormatMobileConfig {
+		return renderConfigFiles(tmpl, peerConfig)
+	}
+
+	buffer := &bytes.Buffer{}
+	err := tmpl.Execute(buffer, peerConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if configFormat == ConfigFormatWGQuick {
+		return map[string][]byte{wgQuickFileName: buffer.Bytes()}, nil
+	}
+
+	profile, err := MobileConfig(wh.MobileConfig, mobileConfigIdentifier(wh.HTTPHost.String()), device, peerConfig.ServerName, buffer.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]byte{mobileConfigFileName: profile}, nil
+}
+
+// writeDeviceConfig writes files rendered by renderDeviceConfig.
+// wg-quick configs are written as text or a QR code depending on format, as they always have been.
+func writeDeviceConfig(c *gin.Context, format, configFormat string, files map[string][]byte) error {
+	if configFormat == ConfigFormatWGQuick {
+		return writePeerConfig(c, format, files[wgQuickFileName])
+	}
+	return writeConfigFiles(c, configFormat, files)
+}
+
+// writeConfigFiles downloads a single rendered file as is, and several as a zip archive named after the format.
+// Configs contain private keys, so they must never be cached.
+func writeConfigFiles(c *gin.Context, format string, files map[string][]byte) error {
+	c.Header("Cache-Control", "no-store")
+	if len(files) == 1 {
+		for name, data := range files {
+			contentType := mime.TypeByExtension(filepath.Ext(name))
+			if name == mobileConfigFileName {
+				contentType = mobileConfigContentType
+			}
+
+			if contentType == "" {
+				contentType = "text/plain"
+			}
+			c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%v"`, name))
+			c.Data(http.StatusOK, contentType, data)
+		}
+		return nil
+	}
+
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buffer := &bytes.Buffer{}
+	archive := zip.NewWriter(buffer)
+	for _, name := range names {
+		writer, err := archive.Create(name)
+		if err != nil {
+			return err
+		}
+
+		_, err = writer.Write(files[name])
+		if err != nil {
+			return err
+		}
+	}
+
+	err := archive.Close()
+	if err != nil {
+		return err
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%v.zip"`, format))
+	c.Data(http.StatusOK, "application/zip", buffer.Bytes())
+	return nil
+}
+
+func toJSON(value interface{}) (string, error) {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// filterIPFamily returns a template function that keeps the IPv4 or IPv6 addresses and networks from a list.
+func filterIPFamily(ipv6 bool) func([]string) []string {
+	return func(addresses []string) []string {
+		filtered := []string{}
+		for _, address := range addresses {
+			ip := net.ParseIP(address)
+			if ip == nil {
+				ip, _, _ = net.ParseCIDR(address)
+			}
+
+			if ip != nil && (ip.To4() == nil) == ipv6 {
+				filtered = append(filtered, address)
+			}
+		}
+		return filtered
+	}
+}
+
+func endpointHost(endpoint string) (string, error) {
+	host, _, err := net.SplitHostPort(endpoint)
+	return host, err
+}
+
+func endpointPort(endpoint string) (string, error) {
+	_, port, err := net.SplitHostPort(endpoint)
+	return port, err
+}
@@ -0,0 +1,182 @@
+package wireguardhttps
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func testConfigTemplates(t *testing.T) map[string]*template.Template {
+	templates, err := LoadConfigTemplates("templates/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, tmpl := range testTemplates(t) {
+		templates[key] = tmpl
+	}
+	return templates
+}
+
+func TestConfigFormatsAreLoadedFromTemplateDirectory(t *testing.T) {
+	formats := ConfigFormats(testConfigTemplates(t))
+	expected := []ConfigFormat{
+		{Name: "json", Files: []string{"wg0.json"}},
+		{Name: ConfigFormatMobileConfig, Files: []string{"wg0.mobileconfig"}},
+		{Name: "networkmanager", Files: []string{"wg0.nmconnection"}},
+		{Name: "openwrt", Files: []string{"network"}},
+		{Name: "systemd-networkd", Files: []string{"wg0.netdev", "wg0.network"}},
+		{Name: ConfigFormatWGQuick, Files: []string{"wg0.conf"}, QRCode: true},
+	}
+
+	if !reflect.DeepEqual(formats, expected) {
+		t.Fatalf("Expected formats %v, got %v", expected, formats)
+	}
+}
+
+func TestConfigTemplatesRenderEachAddressFamily(t *testing.T) {
+	templates := testConfigTemplates(t)
+	peerConfig := &PeerConfigINI{
+		PublicKey:    testServerPublicKey,
+		PrivateKey:   testPrivateKey,
+		PresharedKey: "preshared",
+		AllowedIPs:   []string{"0.0.0.0/0", "::/0"},
+		Addresses:    []string{"10.0.0.2/32", "fd00::2/128"},
+		DNSServers:   []string{"10.0.0.1", "fd00::1"},
+		ServerName:   testServerName,
+	}
+
+	tests := []struct {
+		format   string
+		file     string
+		expected []string
+	}{
+		{"networkmanager", "wg0.nmconnection", []string{
+			"private-key=" + testPrivateKey + "\n",
+			"[wireguard-peer." + testServerPublicKey + "]\nendpoint=" + testServerName + "\npreshared-key=preshared\n",
+			"allowed-ips=0.0.0.0/0;::/0;\n",
+			"[ipv4]\nmethod=manual\naddress1=10.0.0.2/32\ndns=10.0.0.1;\n",
+			"[ipv6]\nmethod=manual\naddress1=fd00::2/128\ndns=fd00::1;\n",
+		}},
+		{"systemd-networkd", "wg0.netdev", []string{"PrivateKey=" + testPrivateKey + "\n", "PresharedKey=preshared\n", "Endpoint=" + testServerName + "\n"}},
+		{"systemd-networkd", "wg0.network", []string{"Address=10.0.0.2/32\nAddress=fd00::2/128\n", "DNS=10.0.0.1\nDNS=fd00::1\n", "[Route]\nDestination=::/0\n"}},
+		{"openwrt", "network", []string{"option private_key '" + testPrivateKey + "'\n", "option endpoint_host 'gateway.myprivate.network'\n", "option endpoint_port '51820'\n", "list allowed_ips '::/0'\n"}},
+	}
+
+	for _, test := range tests {
+		tmpl, ok := configTemplate(templates, test.format)
+		if !ok {
+			t.Fatalf("Expected %v format to be loaded", test.format)
+		}
+
+		files, err := renderConfigFiles(tmpl, peerConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, expected := range test.expected {
+			if !strings.Contains(string(files[test.file]), expected) {
+				t.Fatalf("Expected %v %v to contain %q, got\n%s", test.format, test.file, expected, files[test.file])
+			}
+		}
+	}
+}
+
+func TestNewDeviceInRequestedConfigFormat(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	err := db.RegisterSubnet(mustParseCIDR("10.0.0.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.RegisterUser("jontom@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := testServerConfig(t, db)
+	config.Templates = testConfigTemplates(t)
+
+	writer := serveAsUser(t, config, &user, "GET", "/api/config-formats", nil)
+	if writer.Code != 200 {
+		t.Fatalf("Expected status code 200 for /config-formats, got %v", writer.Code)
+	}
+
+	var formats []ConfigFormat
+	err = json.NewDecoder(writer.Body).Decode(&formats)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(formats) != 6 {
+		t.Fatalf("Expected 6 config formats, got %v", formats)
+	}
+
+	writer = serveAsUser(t, config, &user, "POST", "/api/devices?config=json", DeviceRequest{Name: "Laptop", OS: "Linux", PublicKey: mustGenerateKey(t)})
+	if writer.Code != 200 || writer.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("Expected status code 200 with a JSON config, got %v %v", writer.Code, writer.Header().Get("Content-Type"))
+	}
+
+	var peerConfig PeerConfigINI
+	err = json.NewDecoder(writer.Body).Decode(&peerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if peerConfig.PublicKey != testServerPublicKey || peerConfig.ServerName != testServerName || peerConfig.PrivateKey != ClientPrivateKeyPlaceholder {
+		t.Fatalf("Expected JSON config for the new device, got %v", peerConfig)
+	}
+
+	writer = serveAsUser(t, config, &user, "POST", "/api/devices?config=systemd-networkd", DeviceRequest{Name: "Server", OS: "Linux", PublicKey: mustGenerateKey(t)})
+	if writer.Code != 200 || writer.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("Expected status code 200 with a zip archive, got %v %v", writer.Code, writer.Header().Get("Content-Type"))
+	}
+
+	body, err := ioutil.ReadAll(writer.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(archive.File) != 2 || archive.File[0].Name != "wg0.netdev" || archive.File[1].Name != "wg0.network" {
+		t.Fatalf("Expected wg0.netdev and wg0.network in the archive, got %v", archive.File)
+	}
+
+	for _, query := range []string{"config=mikrotik", "config=openwrt&format=png"} {
+		writer = serveAsUser(t, config, &user, "POST", "/api/devices?"+query, DeviceRequest{Name: "Router", OS: "Linux", PublicKey: mustGenerateKey(t)})
+		if writer.Code != 400 {
+			t.Fatalf("Expected status code 400 for %v, got %v", query, writer.Code)
+		}
+	}
+
+	devices, err := db.Devices(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(devices) != 2 {
+		t.Fatalf("Expected rejected config formats not to create devices, got %v devices", len(devices))
+	}
+}
+
+func TestMissingConfigTemplateDirectoryHasNoFormats(t *testing.T) {
+	templates, err := LoadConfigTemplates("testdata/missing/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(templates) != 0 {
+		t.Fatalf("Expected no config formats, got %v", templates)
+	}
+}
@@ -1,7 +1,9 @@
 package wireguardhttps
 
 import (
+	"fmt"
 	"net"
+	"time"
 
 	"github.com/joncooperworks/wgrpcd"
 )
@@ -12,24 +14,71 @@ type Database interface {
 	Initialize() error
 	Addresses() ([]IPAddress, error)
 	AllocateSubnet(addresses []net.IP) error
-	CreateDevice(owner UserProfile, name, os string, deviceFunc DeviceFunc) (Device, *wgrpcd.PeerConfigInfo, error)
+	RegisterSubnet(network net.IPNet) error
+	Subnets() ([]Subnet, error)
+	SavePool(pool AddressPool, networks []net.IPNet, members []AddressPoolMember) (AddressPool, error)
+	Pools(owner UserProfile) ([]AddressPool, error)
+	AllPools() ([]AddressPool, error)
+	Pool(owner UserProfile, name string) (AddressPool, error)
+	SaveRoutingProfile(profile RoutingProfile) (RoutingProfile, error)
+	RoutingProfiles() ([]RoutingProfile, error)
+	RoutingProfile(name string) (RoutingProfile, error)
+	CreateDevice(owner UserProfile, pool *AddressPool, device Device, policyFunc DevicePolicyFunc, deviceFunc DeviceFunc) (Device, *wgrpcd.PeerConfigInfo, error)
 	RekeyDevice(owner UserProfile, device Device, deviceFunc DeviceFunc) (Device, *wgrpcd.PeerConfigInfo, error)
 	Devices(owner UserProfile) ([]Device, error)
 	Device(owner UserProfile, deviceID int) (Device, error)
 	RemoveDevice(owner UserProfile, device Device, deleteFunc DeleteFunc) error
-	RegisterUser(authPlatformUserID, authPlatform string) (UserProfile, error)
+	RegisterUser(authPlatformUserID, authPlatform, authorizedBy, email string) (UserProfile, error)
 	GetUser(userID int) (UserProfile, error)
-	DeleteUser(userID int) error
+	FindUser(authPlatform, authPlatformUserID string) (UserProfile, error)
+	DeleteUser(userID int, deleteFunc DeviceDeleteFunc) error
+	SetAdmin(authPlatform, authPlatformUserID string, isAdmin bool) (UserProfile, error)
+	SetDeviceLifetime(authPlatform, authPlatformUserID string, lifetime time.Duration) (UserProfile, error)
+	SetDeviceLimit(authPlatform, authPlatformUserID string, limit int) (UserProfile, error)
+	Users() ([]UserProfile, error)
+	AllDevices() ([]Device, error)
+	FindDevice(deviceID int) (Device, error)
+	PublicKeyInUse(publicKey string) (bool, error)
+	SearchDevices(query string) ([]Device, error)
+	ExtendDevice(owner UserProfile, device Device, expiresAt *time.Time) (Device, error)
+	ExpiredDevices(now time.Time) ([]Device, error)
+	ExpiringDevices(now, before time.Time) ([]Device, error)
+	MarkExpiryWarningSent(device Device, sentAt time.Time) (Device, error)
+	StaleDevices(rotatedBefore time.Time) ([]Device, error)
+	DisableDevice(device Device, deleteFunc DeleteFunc) (Device, error)
+	CreateAPIToken(owner UserProfile, token APIToken) (APIToken, error)
+	APITokens(owner UserProfile) ([]APIToken, error)
+	RevokeAPIToken(owner UserProfile, tokenID int) error
+	AuthenticateAPIToken(tokenHash string) (APIToken, error)
+	RecordAuditEvent(event AuditEvent) error
+	AuditEvents(filter AuditFilter) ([]AuditEvent, error)
+	EnqueueWebhookDelivery(delivery WebhookDelivery) (WebhookDelivery, error)
+	DueWebhookDeliveries(now time.Time) ([]WebhookDelivery, error)
+	SaveWebhookDelivery(delivery WebhookDelivery) (WebhookDelivery, error)
+	WebhookDeliveries(limit int) ([]WebhookDelivery, error)
+	CreateConfigDownload(owner UserProfile, download ConfigDownload) (ConfigDownload, error)
+	ClaimConfigDownload(tokenHash string, now time.Time) (ConfigDownload, error)
+	PurgeConfigDownloads(now time.Time) (int64, error)
 	Close() error
 }
 
 // DeviceFunc creates a device on the Wireguard interface and returns an error on failure.
+// It is passed a host route for each address allocated to the device.
 // This allows us to take advantage of SQL transactions.
-type DeviceFunc func(IPAddress) (*wgrpcd.PeerConfigInfo, error)
+type DeviceFunc func(allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error)
+
+// DevicePolicyFunc applies the owner's device limit and lifetime to a new device.
+// CreateDevice calls it inside its transaction with the owner's current row, locked where the database supports it, so concurrent requests and changes made since the owner logged in are both accounted for.
+// It returns the most devices owner may have, 0 meaning no limit, and may set the device's ExpiresAt or reject it with an error.
+type DevicePolicyFunc func(owner UserProfile, device *Device) (int, error)
 
 // DeleteFunc deletes a device on the Wireguard interface.
 type DeleteFunc func() error
 
+// DeviceDeleteFunc deletes the given device on the Wireguard interface.
+// It is used when removing many devices at once, such as all of a user's devices.
+type DeviceDeleteFunc func(Device) error
+
 // RecordNotFoundError is our package specific not found error.
 // Database implementations should return this when they can't find a record, so the caller can handle this case without knowing about the underlying database.
 type RecordNotFoundError struct {
@@ -49,3 +98,12 @@ type DatabaseError struct {
 func (d *DatabaseError) Error() string {
 	return d.err.Error()
 }
+
+// DeviceLimitError is returned by CreateDevice when the owner already has as many devices as they're allowed.
+type DeviceLimitError struct {
+	Limit int
+}
+
+func (d *DeviceLimitError) Error() string {
+	return fmt.Sprintf("device limit of %v reached", d.Limit)
+}
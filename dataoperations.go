@@ -1,11 +1,14 @@
 package wireguardhttps
 
 import (
+	"fmt"
 	"net"
+	"time"
 
 	"github.com/jinzhu/gorm"
 	"github.com/joncooperworks/wgrpcd"
 	gormbulk "github.com/t-tiger/gorm-bulk-insert"
+	"google.golang.org/grpc/status"
 )
 
 type dataOperations struct {
@@ -20,11 +23,31 @@ func wrapPackageError(err error) error {
 	if gorm.IsRecordNotFoundError(err) {
 		return &RecordNotFoundError{err: err}
 	}
+
+	// Errors from outside the database, such as wgrpcd failures inside a transaction, keep their type so handlers can report them accurately.
+	switch err.(type) {
+	case *DeviceLimitError, *IPsExhaustedError, *NoIPv4SubnetError, *ValidationError:
+		return err
+	}
+
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
 	return &DatabaseError{err: err}
 }
 
 func (d *dataOperations) Initialize() error {
-	return wrapPackageError(d.db.AutoMigrate(&UserProfile{}, &Device{}, &IPAddress{}).Error)
+	err := d.db.AutoMigrate(&UserProfile{}, &Device{}, &IPAddress{}, &Subnet{}, &AddressPool{}, &AddressPoolMember{}, &APIToken{}, &RoutingProfile{}, &AuditEvent{}, &WebhookDelivery{}, &ConfigDownload{}).Error
+	if err != nil {
+		return wrapPackageError(err)
+	}
+
+	// Users used to be unique by user ID alone, which lets users of different providers with the same ID log in as each other.
+	// AutoMigrate adds the index on auth platform and user ID but never drops constraints, so the old one is dropped here.
+	if d.db.Dialect().GetName() == "postgres" {
+		err = d.db.Exec("ALTER TABLE user_profiles DROP CONSTRAINT IF EXISTS user_profiles_auth_platform_user_id_key").Error
+	}
+	return wrapPackageError(err)
 }
 
 func (d *dataOperations) Close() error {
@@ -42,8 +65,7 @@ func (d *dataOperations) Addresses() ([]IPAddress, error) {
 
 func (d *dataOperations) AllocateSubnet(addresses []net.IP) error {
 	var databaseInput []interface{}
-	// Don't allocate broadcast or network address.
-	for _, address := range addresses[1 : len(addresses)-1] {
+	for _, address := range addresses {
 		ipAddress := IPAddress{
 			Address: address.String(),
 		}
@@ -57,36 +79,329 @@ func (d *dataOperations) AllocateSubnet(addresses []net.IP) error {
 	return nil
 }
 
-func (d *dataOperations) createIPAddress() (IPAddress, error) {
+func (d *dataOperations) RegisterSubnet(network net.IPNet) error {
+	subnet := Subnet{Network: network.String()}
+	err := d.db.FirstOrCreate(&subnet, Subnet{Network: subnet.Network}).
+		Error
+	return wrapPackageError(err)
+}
+
+func (d *dataOperations) Subnets() ([]Subnet, error) {
+	var subnets []Subnet
+	err := d.db.
+		Find(&subnets).
+		Error
+
+	return subnets, wrapPackageError(err)
+}
+
+// SavePool creates the named pool or updates its settings and members, and registers its subnets for lazy allocation.
+// Devices already assigned addresses in the pool are left untouched.
+// Subnets overlapping another registered subnet or an allocated address are rejected, since the same address could otherwise be assigned twice.
+func (d *dataOperations) SavePool(pool AddressPool, networks []net.IPNet, members []AddressPoolMember) (AddressPool, error) {
+	err := d.db.Transaction(func(db *gorm.DB) error {
+		err := checkSubnetsAreFree(db, networks)
+		if err != nil {
+			return err
+		}
+
+		err = db.Where(AddressPool{Name: pool.Name}).
+			Assign(map[string]interface{}{"dns_servers": pool.DNSServers, "allowed_ips": pool.AllowedIPs, "device_lifetime": pool.DeviceLifetime}).
+			FirstOrCreate(&pool).
+			Error
+		if err != nil {
+			return err
+		}
+
+		err = db.Unscoped().
+			Where("address_pool_id = ?", pool.ID).
+			Delete(&AddressPoolMember{}).
+			Error
+		if err != nil {
+			return err
+		}
+
+		pool.Members = []AddressPoolMember{}
+		for _, member := range members {
+			member.AddressPoolID = pool.ID
+			err = db.Create(&member).
+				Error
+			if err != nil {
+				return err
+			}
+			pool.Members = append(pool.Members, member)
+		}
+
+		for _, network := range networks {
+			subnet := Subnet{Network: network.String(), AddressPoolID: &pool.ID}
+			err = db.FirstOrCreate(&subnet, Subnet{Network: subnet.Network}).
+				Error
+			if err != nil {
+				return err
+			}
+
+			if subnet.AddressPoolID == nil || *subnet.AddressPoolID != pool.ID {
+				return fmt.Errorf("subnet %v already belongs to another pool", subnet.Network)
+			}
+		}
+
+		return nil
+	})
+	return pool, wrapPackageError(err)
+}
+
+// checkSubnetsAreFree returns an error if any of networks overlaps a different registered subnet or an allocated address.
+// Registering the exact same subnet again is allowed; SavePool checks it belongs to the same pool.
+func checkSubnetsAreFree(db *gorm.DB, networks []net.IPNet) error {
+	var subnets []Subnet
+	err := db.Find(&subnets).
+		Error
+	if err != nil {
+		return err
+	}
+
+	var addresses []IPAddress
+	err = db.Select("address").
+		Find(&addresses).
+		Error
+	if err != nil {
+		return err
+	}
+
+	for _, network := range networks {
+		addressRange := &AddressRange{Network: network}
+		for _, subnet := range subnets {
+			existing, err := subnet.AddressRange()
+			if err != nil {
+				return err
+			}
+
+			if subnet.Network != network.String() && addressRange.Overlaps(existing.Network) {
+				return fmt.Errorf("subnet %v overlaps subnet %v", network.String(), subnet.Network)
+			}
+		}
+
+		for _, address := range addresses {
+			if network.Contains(net.ParseIP(address.Address)) {
+				return fmt.Errorf("subnet %v overlaps allocated address %v", network.String(), address.Address)
+			}
+		}
+	}
+	return nil
+}
+
+func (d *dataOperations) Pools(owner UserProfile) ([]AddressPool, error) {
+	var pools []AddressPool
+	err := d.db.Preload("Members").
+		Find(&pools).
+		Error
+	if err != nil {
+		return nil, wrapPackageError(err)
+	}
+
+	allowed := []AddressPool{}
+	for _, pool := range pools {
+		if pool.HasMember(owner) {
+			allowed = append(allowed, pool)
+		}
+	}
+	return allowed, nil
+}
+
+// AllPools returns every named pool regardless of membership, for operators rather than users.
+func (d *dataOperations) AllPools() ([]AddressPool, error) {
+	var pools []AddressPool
+	err := d.db.Find(&pools).
+		Error
+	return pools, wrapPackageError(err)
+}
+
+// Pool returns a RecordNotFoundError if the pool doesn't exist or owner isn't one of its members, so restricted pools aren't revealed to outsiders.
+func (d *dataOperations) Pool(owner UserProfile, name string) (AddressPool, error) {
+	var pool AddressPool
+	err := d.db.Preload("Members").
+		Where("name = ?", name).
+		First(&pool).
+		Error
+	if err != nil {
+		return pool, wrapPackageError(err)
+	}
+
+	if !pool.HasMember(owner) {
+		return AddressPool{}, &RecordNotFoundError{err: fmt.Errorf("pool %v not found", name)}
+	}
+	return pool, nil
+}
+
+func (d *dataOperations) SaveRoutingProfile(profile RoutingProfile) (RoutingProfile, error) {
+	err := d.db.Where(RoutingProfile{Name: profile.Name}).
+		Assign(RoutingProfile{AllowedIPs: profile.AllowedIPs}).
+		FirstOrCreate(&profile).
+		Error
+	return profile, wrapPackageError(err)
+}
+
+func (d *dataOperations) RoutingProfiles() ([]RoutingProfile, error) {
+	var profiles []RoutingProfile
+	err := d.db.
+		Find(&profiles).
+		Error
+	return profiles, wrapPackageError(err)
+}
+
+func (d *dataOperations) RoutingProfile(name string) (RoutingProfile, error) {
+	var profile RoutingProfile
+	err := d.db.Where("name = ?", name).
+		First(&profile).
+		Error
+	return profile, wrapPackageError(err)
+}
+
+// createIPAddress assigns an IPv4 address from the pool's registered IPv4 subnet if there is one, computing the next free address from the devices table.
+// Otherwise it falls back to the addresses preallocated in the `ip_addresses` table, which belong to the default pool.
+func (d *dataOperations) createIPAddress(db *gorm.DB, pool *AddressPool) (IPAddress, error) {
+	address, err := d.nextFreeAddress(db, pool, false, "ip_address")
+	if err != nil {
+		return IPAddress{}, err
+	}
+
+	if address != nil {
+		return IPAddress{Address: *address}, nil
+	}
+
+	if pool != nil {
+		return IPAddress{}, &NoIPv4SubnetError{Pool: pool.Name}
+	}
+
 	var ipAddress IPAddress
-	err := d.db.Raw("SELECT * FROM ip_addresses ip WHERE NOT EXISTS (SELECT d.ip_address FROM devices d WHERE  d.ip_address = ip.address) LIMIT 1").
+	err = db.Raw("SELECT * FROM ip_addresses ip WHERE NOT EXISTS (SELECT d.ip_address FROM devices d WHERE  d.ip_address = ip.address) LIMIT 1").
 		Scan(&ipAddress).
 		Error
+	if gorm.IsRecordNotFoundError(err) {
+		return ipAddress, &IPsExhaustedError{}
+	}
 	return ipAddress, err
 }
 
-func (d *dataOperations) CreateDevice(owner UserProfile, name, os string, deviceFunc DeviceFunc) (Device, *wgrpcd.PeerConfigInfo, error) {
-	var device Device
+// createIPv6Address picks the next free address in the pool's first registered IPv6 subnet.
+// It returns nil if the pool has no IPv6 subnet.
+func (d *dataOperations) createIPv6Address(db *gorm.DB, pool *AddressPool) (*string, error) {
+	return d.nextFreeAddress(db, pool, true, "ipv6_address")
+}
+
+// nextFreeAddress returns the lowest unassigned address in the pool's first registered subnet of the requested address family.
+// A nil pool means the default pool.
+// column is the `devices` column that stores addresses of that family, and the UNIQUE constraint on it stops two transactions claiming the same address.
+// It returns nil if the pool has no subnet of that family.
+func (d *dataOperations) nextFreeAddress(db *gorm.DB, pool *AddressPool, ipv6 bool, column string) (*string, error) {
+	query := db.Where("address_pool_id IS NULL")
+	if pool != nil {
+		query = db.Where("address_pool_id = ?", pool.ID)
+	}
+
+	var subnets []Subnet
+	err := query.Find(&subnets).
+		Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, subnet := range subnets {
+		addressRange, err := subnet.AddressRange()
+		if err != nil {
+			return nil, err
+		}
+
+		if addressRange.IsIPv6() != ipv6 {
+			continue
+		}
+
+		var assigned []string
+		err = db.Model(&Device{}).
+			Where(column+" IS NOT NULL").
+			Pluck(column, &assigned).
+			Error
+		if err != nil {
+			return nil, err
+		}
+
+		assignedAddresses := map[string]bool{}
+		for _, address := range assigned {
+			assignedAddresses[address] = true
+		}
+
+		ip, err := addressRange.NextFree(assignedAddresses)
+		if err != nil {
+			return nil, err
+		}
+
+		address := ip.String()
+		return &address, nil
+	}
+
+	return nil, nil
+}
+
+// CreateDevice assigns addresses to device and records it with its owner and pool.
+// Callers set the device's descriptive fields, such as Name and OS, and everything else is set here.
+// CreateDevice returns a DeviceLimitError if owner already has as many devices as policyFunc allows. A nil policyFunc means owner can have any number of devices.
+func (d *dataOperations) CreateDevice(owner UserProfile, pool *AddressPool, device Device, policyFunc DevicePolicyFunc, deviceFunc DeviceFunc) (Device, *wgrpcd.PeerConfigInfo, error) {
 	var credentials *wgrpcd.PeerConfigInfo
 	err := d.db.Transaction(func(db *gorm.DB) error {
-		ipAddress, err := d.createIPAddress()
+		if policyFunc != nil {
+			current, err := lockUser(db, owner.ID)
+			if err != nil {
+				return err
+			}
+
+			limit, err := policyFunc(current, &device)
+			if err != nil {
+				return err
+			}
+
+			if limit > 0 {
+				var count int
+				err = db.Model(&Device{}).
+					Where("owner_id = ?", owner.ID).
+					Count(&count).
+					Error
+				if err != nil {
+					return err
+				}
+
+				if count >= limit {
+					return &DeviceLimitError{Limit: limit}
+				}
+			}
+		}
+
+		ipAddress, err := d.createIPAddress(db, pool)
 		if err != nil {
 			return err
 		}
 
-		credentials, err = deviceFunc(ipAddress)
+		ipv6Address, err := d.createIPv6Address(db, pool)
 		if err != nil {
 			return err
 		}
 
-		device = Device{
-			Name:      name,
-			OS:        os,
-			PublicKey: credentials.PublicKey,
-			IPAddress: ipAddress.Address,
-			Owner:     owner,
+		device.IPAddress = ipAddress.Address
+		device.IPv6Address = ipv6Address
+		device.Owner = owner
+		device.AddressPool = pool
+		if pool != nil {
+			device.AddressPoolID = &pool.ID
 		}
-		err = d.db.Create(&device).
+
+		credentials, err = deviceFunc(device.AllowedIPs())
+		if err != nil {
+			return err
+		}
+
+		rotatedAt := time.Now()
+		device.PublicKey = credentials.PublicKey
+		device.KeyRotatedAt = &rotatedAt
+		err = db.Create(&device).
 			Error
 		if err != nil {
 			return err
@@ -97,23 +412,41 @@ func (d *dataOperations) CreateDevice(owner UserProfile, name, os string, device
 	return device, credentials, wrapPackageError(err)
 }
 
+// lockUser loads a user's current row inside transaction db.
+// On Postgres the row is locked until the transaction ends, so transactions checking the same user's devices run one at a time.
+// SQLite databases are limited to one connection, so their transactions already do.
+func lockUser(db *gorm.DB, userID uint) (UserProfile, error) {
+	if db.Dialect().GetName() == "postgres" {
+		db = db.Set("gorm:query_option", "FOR UPDATE")
+	}
+
+	var user UserProfile
+	err := db.First(&user, userID).
+		Error
+	return user, err
+}
+
+// RekeyDevice deletes the device's pending download links, since the configs in them hold the old key.
 func (d *dataOperations) RekeyDevice(owner UserProfile, device Device, rekeyFunc DeviceFunc) (Device, *wgrpcd.PeerConfigInfo, error) {
 	var credentials *wgrpcd.PeerConfigInfo
 	err := d.db.Transaction(func(db *gorm.DB) error {
 		var err error
-		credentials, err = rekeyFunc(device.IP)
+		credentials, err = rekeyFunc(device.AllowedIPs())
 		if err != nil {
 			return err
 		}
 
+		rotatedAt := time.Now()
 		device.PublicKey = credentials.PublicKey
+		device.KeyRotatedAt = &rotatedAt
+		device.DisabledAt = nil
 		err = db.Save(&device).
 			Error
 		if err != nil {
 			return err
 		}
 
-		return nil
+		return deleteConfigDownloads(db, device)
 	})
 	return device, credentials, wrapPackageError(err)
 }
@@ -122,6 +455,8 @@ func (d *dataOperations) Devices(owner UserProfile) ([]Device, error) {
 	var devices []Device
 	err := d.db.Preload("IP").
 		Preload("Owner").
+		Preload("AddressPool").
+		Preload("RoutingProfile").
 		Where("owner_id = ?", owner.ID).
 		Find(&devices).
 		Error
@@ -132,41 +467,456 @@ func (d *dataOperations) Device(owner UserProfile, deviceID int) (Device, error)
 	var device Device
 	err := d.db.Preload("IP").
 		Preload("Owner").
+		Preload("AddressPool").
+		Preload("RoutingProfile").
 		Where("owner_id = ?", owner.ID).
 		First(&device, deviceID).
 		Error
 	return device, wrapPackageError(err)
 }
 
+// RemoveDevice deletes the device's pending download links along with it.
 func (d *dataOperations) RemoveDevice(owner UserProfile, device Device, deleteFunc DeleteFunc) error {
 	err := deleteFunc()
 	if err != nil {
 		return err
 	}
 
-	err = d.db.Unscoped().
-		Where("owner_id = ?", owner.ID).
-		Delete(&device).Error
+	err = d.db.Transaction(func(db *gorm.DB) error {
+		err := db.Unscoped().
+			Where("owner_id = ?", owner.ID).
+			Delete(&device).Error
+		if err != nil {
+			return err
+		}
+
+		return deleteConfigDownloads(db, device)
+	})
 	return wrapPackageError(err)
 }
 
-func (d *dataOperations) RegisterUser(authPlatformUserID, authPlatform string) (UserProfile, error) {
-	user := UserProfile{
-		AuthPlatformUserID: authPlatformUserID,
-		AuthPlatform:       authPlatform,
+// deleteConfigDownloads deletes every download link for device, so a link can't hand out a config the device no longer uses.
+func deleteConfigDownloads(db *gorm.DB, device Device) error {
+	return db.Unscoped().
+		Where("device_id = ?", device.ID).
+		Delete(&ConfigDownload{}).
+		Error
+}
+
+// RegisterUser creates the user on first login, and records the claim that authorized the latest login.
+// RegisterUser keeps the user's last known email address if the auth platform doesn't return one.
+func (d *dataOperations) RegisterUser(authPlatformUserID, authPlatform, authorizedBy, email string) (UserProfile, error) {
+	updates := map[string]interface{}{"authorized_by": authorizedBy}
+	if email != "" {
+		updates["email"] = email
 	}
-	err := d.db.FirstOrCreate(&user, UserProfile{AuthPlatformUserID: authPlatformUserID}).
+
+	var user UserProfile
+	err := d.db.Where(UserProfile{AuthPlatform: authPlatform, AuthPlatformUserID: authPlatformUserID}).
+		Assign(updates).
+		FirstOrCreate(&user).
 		Error
 	return user, wrapPackageError(err)
 }
 
 func (d *dataOperations) GetUser(userID int) (UserProfile, error) {
 	var user UserProfile
-	err := d.db.First(user, userID).
+	err := d.db.First(&user, userID).
+		Error
+	return user, wrapPackageError(err)
+}
+
+func (d *dataOperations) FindUser(authPlatform, authPlatformUserID string) (UserProfile, error) {
+	var user UserProfile
+	err := d.db.Where("auth_platform = ? AND auth_platform_user_id = ?", authPlatform, authPlatformUserID).
+		First(&user).
+		Error
+	return user, wrapPackageError(err)
+}
+
+// DeleteUser removes each of the user's devices from the Wireguard interface with deleteFunc, then deletes the devices, pool memberships, API tokens, download links and user in one transaction.
+// Deleting the devices releases their IP addresses.
+func (d *dataOperations) DeleteUser(userID int, deleteFunc DeviceDeleteFunc) error {
+	err := d.db.Transaction(func(db *gorm.DB) error {
+		var user UserProfile
+		err := db.First(&user, userID).
+			Error
+		if err != nil {
+			return err
+		}
+
+		var devices []Device
+		err = db.Where("owner_id = ?", user.ID).
+			Find(&devices).
+			Error
+		if err != nil {
+			return err
+		}
+
+		for _, device := range devices {
+			err = deleteFunc(device)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = db.Unscoped().
+			Where("owner_id = ?", user.ID).
+			Delete(&Device{}).
+			Error
+		if err != nil {
+			return err
+		}
+
+		err = db.Unscoped().
+			Where("auth_platform = ? AND auth_platform_user_id = ?", user.AuthPlatform, user.AuthPlatformUserID).
+			Delete(&AddressPoolMember{}).
+			Error
+		if err != nil {
+			return err
+		}
+
+		err = db.Unscoped().
+			Where("owner_id = ?", user.ID).
+			Delete(&APIToken{}).
+			Error
+		if err != nil {
+			return err
+		}
+
+		err = db.Unscoped().
+			Where("owner_id = ?", user.ID).
+			Delete(&ConfigDownload{}).
+			Error
+		if err != nil {
+			return err
+		}
+
+		return db.Unscoped().
+			Delete(&user).
+			Error
+	})
+	return wrapPackageError(err)
+}
+
+func (d *dataOperations) SetAdmin(authPlatform, authPlatformUserID string, isAdmin bool) (UserProfile, error) {
+	user, err := d.FindUser(authPlatform, authPlatformUserID)
+	if err != nil {
+		return user, err
+	}
+
+	err = d.db.Model(&user).
+		Update("is_admin", isAdmin).
+		Error
+	return user, wrapPackageError(err)
+}
+
+func (d *dataOperations) SetDeviceLifetime(authPlatform, authPlatformUserID string, lifetime time.Duration) (UserProfile, error) {
+	user, err := d.FindUser(authPlatform, authPlatformUserID)
+	if err != nil {
+		return user, err
+	}
+
+	err = d.db.Model(&user).
+		Update("device_lifetime", lifetime).
 		Error
 	return user, wrapPackageError(err)
 }
 
-func (d *dataOperations) DeleteUser(userID int) error {
+func (d *dataOperations) SetDeviceLimit(authPlatform, authPlatformUserID string, limit int) (UserProfile, error) {
+	user, err := d.FindUser(authPlatform, authPlatformUserID)
+	if err != nil {
+		return user, err
+	}
+
+	err = d.db.Model(&user).
+		Update("device_limit", limit).
+		Error
+	return user, wrapPackageError(err)
+}
+
+func (d *dataOperations) Users() ([]UserProfile, error) {
+	var users []UserProfile
+	err := d.db.
+		Find(&users).
+		Error
+	return users, wrapPackageError(err)
+}
+
+func (d *dataOperations) AllDevices() ([]Device, error) {
+	var devices []Device
+	err := d.db.Preload("IP").
+		Preload("Owner").
+		Preload("AddressPool").
+		Preload("RoutingProfile").
+		Find(&devices).
+		Error
+	return devices, wrapPackageError(err)
+}
+
+func (d *dataOperations) FindDevice(deviceID int) (Device, error) {
+	var device Device
+	err := d.db.Preload("IP").
+		Preload("Owner").
+		Preload("AddressPool").
+		Preload("RoutingProfile").
+		First(&device, deviceID).
+		Error
+	return device, wrapPackageError(err)
+}
+
+// PublicKeyInUse reports whether any device, including soft deleted ones, has publicKey.
+func (d *dataOperations) PublicKeyInUse(publicKey string) (bool, error) {
+	var count int
+	err := d.db.Unscoped().
+		Model(&Device{}).
+		Where("public_key = ?", publicKey).
+		Count(&count).
+		Error
+	return count > 0, wrapPackageError(err)
+}
+
+// SearchDevices finds devices whose public key or IPv4 or IPv6 address exactly matches query.
+func (d *dataOperations) SearchDevices(query string) ([]Device, error) {
+	var devices []Device
+	err := d.db.Preload("IP").
+		Preload("Owner").
+		Preload("AddressPool").
+		Preload("RoutingProfile").
+		Where("public_key = ? OR ip_address = ? OR ipv6_address = ?", query, query, query).
+		Find(&devices).
+		Error
+	return devices, wrapPackageError(err)
+}
+
+// ExtendDevice clears any expiry warning already sent, so the owner is warned again before the new expiry.
+func (d *dataOperations) ExtendDevice(owner UserProfile, device Device, expiresAt *time.Time) (Device, error) {
+	err := d.db.Model(&device).
+		Where("owner_id = ?", owner.ID).
+		Updates(map[string]interface{}{"expires_at": expiresAt, "expiry_warning_sent_at": nil}).
+		Error
+	return device, wrapPackageError(err)
+}
+
+// ExpiredDevices returns devices whose expiry is at or before now.
+func (d *dataOperations) ExpiredDevices(now time.Time) ([]Device, error) {
+	var devices []Device
+	err := d.db.Preload("IP").
+		Preload("Owner").
+		Preload("AddressPool").
+		Preload("RoutingProfile").
+		Where("expires_at <= ?", now).
+		Find(&devices).
+		Error
+	return devices, wrapPackageError(err)
+}
+
+// ExpiringDevices returns devices expiring after now and at or before before whose owners haven't been warned yet.
+func (d *dataOperations) ExpiringDevices(now, before time.Time) ([]Device, error) {
+	var devices []Device
+	err := d.db.Preload("IP").
+		Preload("Owner").
+		Preload("AddressPool").
+		Preload("RoutingProfile").
+		Where("expires_at > ? AND expires_at <= ? AND expiry_warning_sent_at IS NULL", now, before).
+		Find(&devices).
+		Error
+	return devices, wrapPackageError(err)
+}
+
+func (d *dataOperations) MarkExpiryWarningSent(device Device, sentAt time.Time) (Device, error) {
+	err := d.db.Model(&device).
+		Update("expiry_warning_sent_at", sentAt).
+		Error
+	return device, wrapPackageError(err)
+}
+
+// StaleDevices returns enabled devices whose keys were last rotated before rotatedBefore.
+func (d *dataOperations) StaleDevices(rotatedBefore time.Time) ([]Device, error) {
+	var devices []Device
+	err := d.db.Preload("IP").
+		Preload("Owner").
+		Preload("AddressPool").
+		Preload("RoutingProfile").
+		Where("disabled_at IS NULL AND COALESCE(key_rotated_at, created_at) < ?", rotatedBefore).
+		Find(&devices).
+		Error
+	return devices, wrapPackageError(err)
+}
+
+// DisableDevice removes the device from the Wireguard interface with deleteFunc but keeps its record and addresses, so its owner can rekey it later.
+func (d *dataOperations) DisableDevice(device Device, deleteFunc DeleteFunc) (Device, error) {
+	err := deleteFunc()
+	if err != nil {
+		return device, err
+	}
+
+	err = d.db.Model(&device).
+		Update("disabled_at", time.Now()).
+		Error
+	return device, wrapPackageError(err)
+}
+
+func (d *dataOperations) CreateAPIToken(owner UserProfile, token APIToken) (APIToken, error) {
+	token.OwnerID = owner.ID
+	err := d.db.Create(&token).
+		Error
+	return token, wrapPackageError(err)
+}
+
+func (d *dataOperations) APITokens(owner UserProfile) ([]APIToken, error) {
+	var tokens []APIToken
+	err := d.db.Where("owner_id = ?", owner.ID).
+		Find(&tokens).
+		Error
+	return tokens, wrapPackageError(err)
+}
+
+func (d *dataOperations) RevokeAPIToken(owner UserProfile, tokenID int) error {
+	result := d.db.Unscoped().
+		Where("owner_id = ?", owner.ID).
+		Delete(&APIToken{}, tokenID)
+	if result.Error != nil {
+		return wrapPackageError(result.Error)
+	}
+
+	if result.RowsAffected == 0 {
+		return &RecordNotFoundError{err: fmt.Errorf("API token %v not found", tokenID)}
+	}
 	return nil
 }
+
+// AuthenticateAPIToken finds the unexpired token with the given hash and records that it was used.
+// Tokens whose owner no longer exists are treated as not found.
+func (d *dataOperations) AuthenticateAPIToken(tokenHash string) (APIToken, error) {
+	var token APIToken
+	now := time.Now()
+	err := d.db.Preload("Owner").
+		Select("api_tokens.*").
+		Joins("JOIN user_profiles ON user_profiles.id = api_tokens.owner_id AND user_profiles.deleted_at IS NULL").
+		Where("api_tokens.token_hash = ? AND api_tokens.expires_at > ?", tokenHash, now).
+		First(&token).
+		Error
+	if err != nil {
+		return token, wrapPackageError(err)
+	}
+
+	token.LastUsedAt = &now
+	err = d.db.Model(&token).
+		Update("last_used_at", now).
+		Error
+	return token, wrapPackageError(err)
+}
+
+func (d *dataOperations) RecordAuditEvent(event AuditEvent) error {
+	return wrapPackageError(d.db.Create(&event).Error)
+}
+
+// AuditEvents returns the events matching filter, newest first.
+func (d *dataOperations) AuditEvents(filter AuditFilter) ([]AuditEvent, error) {
+	query := d.db.Order("id DESC")
+	if filter.Actor != "" {
+		query = query.Where("actor = ? OR subject = ?", filter.Actor, filter.Actor)
+	}
+
+	if filter.Action != "" {
+		query = query.Where("action = ?", filter.Action)
+	}
+
+	if filter.DeviceID != nil {
+		query = query.Where("device_id = ?", *filter.DeviceID)
+	}
+
+	if filter.Since != nil {
+		query = query.Where("created_at >= ?", *filter.Since)
+	}
+
+	if filter.Until != nil {
+		query = query.Where("created_at < ?", *filter.Until)
+	}
+
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+
+	var events []AuditEvent
+	err := query.Find(&events).
+		Error
+	return events, wrapPackageError(err)
+}
+
+func (d *dataOperations) EnqueueWebhookDelivery(delivery WebhookDelivery) (WebhookDelivery, error) {
+	err := d.db.Create(&delivery).
+		Error
+	return delivery, wrapPackageError(err)
+}
+
+// DueWebhookDeliveries returns the deliveries still being attempted whose next attempt is due at now, oldest first.
+func (d *dataOperations) DueWebhookDeliveries(now time.Time) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	err := d.db.Where("delivered_at IS NULL AND failed_at IS NULL AND next_attempt_at <= ?", now).
+		Order("id").
+		Find(&deliveries).
+		Error
+	return deliveries, wrapPackageError(err)
+}
+
+func (d *dataOperations) SaveWebhookDelivery(delivery WebhookDelivery) (WebhookDelivery, error) {
+	err := d.db.Save(&delivery).
+		Error
+	return delivery, wrapPackageError(err)
+}
+
+// WebhookDeliveries returns the latest limit deliveries, newest first.
+func (d *dataOperations) WebhookDeliveries(limit int) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	err := d.db.Order("id DESC").
+		Limit(limit).
+		Find(&deliveries).
+		Error
+	return deliveries, wrapPackageError(err)
+}
+
+func (d *dataOperations) CreateConfigDownload(owner UserProfile, download ConfigDownload) (ConfigDownload, error) {
+	download.OwnerID = owner.ID
+	err := d.db.Create(&download).
+		Error
+	return download, wrapPackageError(err)
+}
+
+// ClaimConfigDownload returns the unclaimed, unexpired download with the given hash and clears its ciphertext, so it can only be claimed once.
+// The update is conditional on the download still being unclaimed, so concurrent claims can't both succeed.
+func (d *dataOperations) ClaimConfigDownload(tokenHash string, now time.Time) (ConfigDownload, error) {
+	var download ConfigDownload
+	err := d.db.Transaction(func(db *gorm.DB) error {
+		err := db.Preload("Owner").
+			Where("token_hash = ? AND claimed_at IS NULL AND expires_at > ?", tokenHash, now).
+			First(&download).
+			Error
+		if err != nil {
+			return err
+		}
+
+		result := db.Model(&ConfigDownload{}).
+			Where("id = ? AND claimed_at IS NULL", download.ID).
+			Updates(map[string]interface{}{"claimed_at": now, "ciphertext": nil})
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		download.ClaimedAt = &now
+		return nil
+	})
+	return download, wrapPackageError(err)
+}
+
+// PurgeConfigDownloads deletes every download that expired at or before now, claimed or not, and returns how many were deleted.
+func (d *dataOperations) PurgeConfigDownloads(now time.Time) (int64, error) {
+	result := d.db.Unscoped().
+		Where("expires_at <= ?", now).
+		Delete(&ConfigDownload{})
+	return result.RowsAffected, wrapPackageError(result.Error)
+}
@@ -0,0 +1,391 @@
+package wireguardhttps
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/joncooperworks/wgrpcd"
+)
+
+func testDatabase(t *testing.T) Database {
+	db, err := NewSQLiteDatabase(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func TestCreateDeviceAssignsIPv4AndIPv6Addresses(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	err := db.AllocateSubnet([]net.IP{net.ParseIP("10.0.0.2")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.RegisterSubnet(mustParseCIDR("fd00::/64"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var actualAllowedIPs []net.IPNet
+	deviceFunc := func(allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
+		actualAllowedIPs = allowedIPs
+		return &wgrpcd.PeerConfigInfo{PublicKey: testPublicKey, AllowedIPs: allowedIPs}, nil
+	}
+
+	device, _, err := db.CreateDevice(UserProfile{}, nil, Device{Name: "Macbook Pro", OS: "macOS"}, nil, deviceFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if device.IPAddress != "10.0.0.2" {
+		t.Fatalf("Expected 10.0.0.2, got %v", device.IPAddress)
+	}
+
+	if device.IPv6Address == nil || *device.IPv6Address != "fd00::2" {
+		t.Fatalf("Expected fd00::2, got %v", device.IPv6Address)
+	}
+
+	expectedAllowedIPs := []string{"10.0.0.2/32", "fd00::2/128"}
+	if len(actualAllowedIPs) != len(expectedAllowedIPs) {
+		t.Fatalf("Expected %v, got %v", expectedAllowedIPs, actualAllowedIPs)
+	}
+
+	for index, allowedIP := range actualAllowedIPs {
+		if allowedIP.String() != expectedAllowedIPs[index] {
+			t.Fatalf("Expected %v, got %v", expectedAllowedIPs, actualAllowedIPs)
+		}
+	}
+}
+
+func TestLazyAllocationAssignsLowestFreeAddress(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	err := db.RegisterSubnet(mustParseCIDR("10.0.0.0/29"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addresses, err := db.Addresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(addresses) != 0 {
+		t.Fatalf("Expected no preallocated addresses, got %v", addresses)
+	}
+
+	keys := []string{"first", "second", "third"}
+	devices := []Device{}
+	for _, key := range keys {
+		deviceFunc := func(allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
+			return &wgrpcd.PeerConfigInfo{PublicKey: key, AllowedIPs: allowedIPs}, nil
+		}
+
+		device, _, err := db.CreateDevice(UserProfile{}, nil, Device{Name: key, OS: "Linux"}, nil, deviceFunc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		devices = append(devices, device)
+	}
+
+	expectedAddresses := []string{"10.0.0.2", "10.0.0.3", "10.0.0.4"}
+	for index, device := range devices {
+		if device.IPAddress != expectedAddresses[index] {
+			t.Fatalf("Expected %v, got %v", expectedAddresses[index], device.IPAddress)
+		}
+	}
+
+	err = db.RemoveDevice(UserProfile{}, devices[0], func() error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deviceFunc := func(allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
+		return &wgrpcd.PeerConfigInfo{PublicKey: "fourth", AllowedIPs: allowedIPs}, nil
+	}
+	device, _, err := db.CreateDevice(UserProfile{}, nil, Device{Name: "fourth", OS: "Linux"}, nil, deviceFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if device.IPAddress != "10.0.0.2" {
+		t.Fatalf("Expected released address 10.0.0.2 to be reused, got %v", device.IPAddress)
+	}
+}
+
+func TestPoolsAreRestrictedToMembers(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	member := UserProfile{AuthPlatform: "okta", AuthPlatformUserID: "engineer@example.com"}
+	outsider := UserProfile{AuthPlatform: "okta", AuthPlatformUserID: "contractor@example.com"}
+	pool := AddressPool{Name: "engineering", DNSServers: "10.1.0.53", AllowedIPs: "10.1.0.0/16"}
+	_, err := db.SavePool(pool, []net.IPNet{mustParseCIDR("10.1.0.0/24")}, []AddressPoolMember{{AuthPlatform: member.AuthPlatform, AuthPlatformUserID: member.AuthPlatformUserID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Pool(outsider, "engineering")
+	if _, ok := err.(*RecordNotFoundError); !ok {
+		t.Fatalf("Expected RecordNotFoundError, got %v", err)
+	}
+
+	pools, err := db.Pools(outsider)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pools) != 0 {
+		t.Fatalf("Expected no pools for %v, got %v", outsider.AuthPlatformUserID, pools)
+	}
+
+	pool, err = db.Pool(member, "engineering")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deviceFunc := func(allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
+		return &wgrpcd.PeerConfigInfo{PublicKey: testPublicKey, AllowedIPs: allowedIPs}, nil
+	}
+	device, _, err := db.CreateDevice(member, &pool, Device{Name: "Thinkpad", OS: "Linux"}, nil, deviceFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if device.IPAddress != "10.1.0.2" {
+		t.Fatalf("Expected 10.1.0.2, got %v", device.IPAddress)
+	}
+
+	// Saving the pool again updates its settings without touching assigned devices.
+	pool.DNSServers = "10.1.0.54"
+	_, err = db.SavePool(pool, []net.IPNet{mustParseCIDR("10.1.0.0/24")}, []AddressPoolMember{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool, err = db.Pool(outsider, "engineering")
+	if err != nil {
+		t.Fatalf("Expected pool without members to be open to everyone, got %v", err)
+	}
+
+	if pool.DNSServers != "10.1.0.54" {
+		t.Fatalf("Expected 10.1.0.54, got %v", pool.DNSServers)
+	}
+
+	devices, err := db.Devices(device.Owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(devices) != 1 || devices[0].IPAddress != device.IPAddress || devices[0].AddressPool == nil {
+		t.Fatalf("Expected %v to be unchanged, got %v", device, devices)
+	}
+}
+
+func TestDeleteUserRemovesDevicesAndReleasesAddresses(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	err := db.RegisterSubnet(mustParseCIDR("10.0.0.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.RegisterUser("leaver@example.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"laptop", "phone"} {
+		deviceFunc := func(allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
+			return &wgrpcd.PeerConfigInfo{PublicKey: key, AllowedIPs: allowedIPs}, nil
+		}
+		_, _, err = db.CreateDevice(user, nil, Device{Name: key, OS: "Linux"}, nil, deviceFunc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	failingDeleteFunc := func(device Device) error {
+		return fmt.Errorf("wgrpcd unreachable")
+	}
+	err = db.DeleteUser(int(user.ID), failingDeleteFunc)
+	if err == nil {
+		t.Fatalf("Expected error when devices can't be removed from the interface")
+	}
+
+	removed := []string{}
+	deleteFunc := func(device Device) error {
+		removed = append(removed, device.PublicKey)
+		return nil
+	}
+	err = db.DeleteUser(int(user.ID), deleteFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(removed) != 2 {
+		t.Fatalf("Expected 2 devices removed from the interface, got %v", removed)
+	}
+
+	_, err = db.GetUser(int(user.ID))
+	if _, ok := err.(*RecordNotFoundError); !ok {
+		t.Fatalf("Expected RecordNotFoundError, got %v", err)
+	}
+
+	devices, err := db.AllDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(devices) != 0 {
+		t.Fatalf("Expected all devices deleted, got %v", devices)
+	}
+}
+
+func TestCreateDeviceAppliesPolicyToOwnersCurrentRow(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	err := db.RegisterSubnet(mustParseCIDR("10.0.0.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	staleUser, err := db.RegisterUser("capped@example.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.SetDeviceLimit(staleUser.AuthPlatform, staleUser.AuthPlatformUserID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policyFunc := func(owner UserProfile, device *Device) (int, error) {
+		return owner.DeviceLimit, nil
+	}
+	for index, key := range []string{"laptop", "phone"} {
+		deviceFunc := func(allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
+			return &wgrpcd.PeerConfigInfo{PublicKey: key, AllowedIPs: allowedIPs}, nil
+		}
+		_, _, err = db.CreateDevice(staleUser, nil, Device{Name: key, OS: "Linux"}, policyFunc, deviceFunc)
+		if index == 0 && err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, ok := err.(*DeviceLimitError); !ok {
+		t.Fatalf("Expected the limit set after the owner was loaded to apply, got %v", err)
+	}
+}
+
+func TestSavePoolRejectsOverlappingSubnets(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	err := db.AllocateSubnet([]net.IP{net.ParseIP("10.0.0.2")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.RegisterSubnet(mustParseCIDR("fd00::/64"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := AddressPool{Name: "engineering"}
+	for _, network := range []string{"10.0.0.0/24", "10.0.0.0/16", "fd00::/48", "fd00::/96"} {
+		_, err = db.SavePool(pool, []net.IPNet{mustParseCIDR(network)}, []AddressPoolMember{})
+		if err == nil {
+			t.Fatalf("Expected %v to be rejected for overlapping the default pool", network)
+		}
+	}
+
+	_, err = db.SavePool(pool, []net.IPNet{mustParseCIDR("10.1.0.0/24")}, []AddressPoolMember{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.SavePool(pool, []net.IPNet{mustParseCIDR("10.1.0.0/24")}, []AddressPoolMember{})
+	if err != nil {
+		t.Fatalf("Expected the pool's own subnet to be saved again, got %v", err)
+	}
+
+	_, err = db.SavePool(AddressPool{Name: "sales"}, []net.IPNet{mustParseCIDR("10.1.0.128/25")}, []AddressPoolMember{})
+	if err == nil {
+		t.Fatalf("Expected a subnet inside another pool's subnet to be rejected")
+	}
+}
+
+func TestUsersAreKeyedOnProviderAndUserID(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	oktaUser, err := db.RegisterUser("00u1abcd", "okta", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oktaUser, err = db.SetAdmin(oktaUser.AuthPlatform, oktaUser.AuthPlatformUserID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	googleUser, err := db.RegisterUser("00u1abcd", "google", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if googleUser.ID == oktaUser.ID || googleUser.IsAdmin {
+		t.Fatalf("Expected a user from another provider with the same ID to be a new user, got %v", googleUser)
+	}
+
+	found, err := db.FindUser("google", "00u1abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if found.ID != googleUser.ID {
+		t.Fatalf("Expected to find %v, got %v", googleUser, found)
+	}
+
+	pool := AddressPool{Name: "engineering"}
+	pool, err = db.SavePool(pool, []net.IPNet{mustParseCIDR("10.1.0.0/24")}, []AddressPoolMember{{AuthPlatform: "okta", AuthPlatformUserID: "00u1abcd"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !pool.HasMember(oktaUser) || pool.HasMember(googleUser) {
+		t.Fatalf("Expected only the okta user to be a member of %v", pool.Name)
+	}
+}
+
+func TestParseQualifiedUserID(t *testing.T) {
+	authPlatform, authPlatformUserID, err := ParseQualifiedUserID("auth0:google-oauth2|1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if authPlatform != "auth0" || authPlatformUserID != "google-oauth2|1234" {
+		t.Fatalf("Expected auth0 and google-oauth2|1234, got %v and %v", authPlatform, authPlatformUserID)
+	}
+
+	for _, qualifiedID := range []string{"00u1abcd", ":00u1abcd", "okta:"} {
+		_, _, err = ParseQualifiedUserID(qualifiedID)
+		if err == nil {
+			t.Fatalf("Expected %v to be rejected", qualifiedID)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package wireguardhttps
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Error codes identify why an API request failed.
+// Clients should switch on these rather than on error messages, so a code must never change meaning once released.
+const (
+	ErrorCodeBadRequest           = "bad_request"
+	ErrorCodeValidationFailed     = "validation_failed"
+	ErrorCodeUnauthorized         = "unauthorized"
+	ErrorCodeForbidden            = "forbidden"
+	ErrorCodeLoginDenied          = "login_denied"
+	ErrorCodeNotFound             = "not_found"
+	ErrorCodeDeviceLimitReached   = "device_limit_reached"
+	ErrorCodeIPsExhausted         = "ips_exhausted"
+	ErrorCodeNoIPv4Subnet         = "no_ipv4_subnet"
+	ErrorCodeNotImplemented       = "not_implemented"
+	ErrorCodeWireguardUnavailable = "wireguard_unavailable"
+	ErrorCodeWireguardError       = "wireguard_error"
+	ErrorCodeDatabaseError        = "database_error"
+	ErrorCodeInternalError        = "internal_error"
+)
+
+// errPeerConfigTemplateMissing is returned when the server was started without the peer_config template.
+var errPeerConfigTemplateMissing = errors.New("peer_config template is not loaded")
+
+// BatchError is returned by jobs that act on many devices, such as revoking expired devices, when some of them failed.
+// The jobs log each failure and carry on, so one bad device doesn't hold up the rest.
+type BatchError struct {
+	Errors []error
+}
+
+func (b *BatchError) Error() string {
+	messages := []string{}
+	for _, err := range b.Errors {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Sprintf("%v errors: %v", len(b.Errors), strings.Join(messages, "; "))
+}
+
+// batchError returns a *BatchError holding errs, or nil if there are none.
+func batchError(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return &BatchError{Errors: errs}
+}
+
+// APIError is the JSON body of every failed API request.
+// Field is set for validation failures to name the offending request field.
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"error"`
+	Field   string `json:"field,omitempty"`
+}
+
+func (a *APIError) Error() string {
+	return a.Message
+}
+
+// abortWithError responds with status and an APIError built from code and message.
+func abortWithError(c *gin.Context, status int, code, message string) {
+	c.AbortWithStatusJSON(status, &APIError{Code: code, Message: message})
+}
+
+// errorResponse maps err to the status and APIError clients see.
+// Database, wgrpcd and unexpected errors get generic messages so internals aren't leaked to clients; callers should log the original error.
+func errorResponse(err error) (int, *APIError) {
+	switch err := err.(type) {
+	case *ValidationError:
+		return http.StatusBadRequest, &APIError{Code: ErrorCodeValidationFailed, Message: err.Message, Field: err.Field}
+	case *RecordNotFoundError:
+		return http.StatusNotFound, &APIError{Code: ErrorCodeNotFound, Message: "not found"}
+	case *LoginDeniedError:
+		return http.StatusForbidden, &APIError{Code: ErrorCodeLoginDenied, Message: err.Error()}
+	case *DeviceLimitError:
+		return http.StatusForbidden, &APIError{Code: ErrorCodeDeviceLimitReached, Message: err.Error()}
+	case *IPsExhaustedError:
+		return http.StatusConflict, &APIError{Code: ErrorCodeIPsExhausted, Message: "no IP addresses are left in the pool"}
+	case *NoIPv4SubnetError:
+		return http.StatusConflict, &APIError{Code: ErrorCodeNoIPv4Subnet, Message: err.Error()}
+	case *DatabaseError:
+		return http.StatusInternalServerError, &APIError{Code: ErrorCodeDatabaseError, Message: "database error"}
+	}
+
+	if grpcStatus, ok := status.FromError(err); ok {
+		switch grpcStatus.Code() {
+		case codes.Unavailable, codes.DeadlineExceeded:
+			return http.StatusServiceUnavailable, &APIError{Code: ErrorCodeWireguardUnavailable, Message: "wgrpcd is unreachable"}
+		case codes.Unimplemented:
+			return http.StatusNotImplemented, &APIError{Code: ErrorCodeNotImplemented, Message: "not supported by wgrpcd"}
+		default:
+			return http.StatusBadGateway, &APIError{Code: ErrorCodeWireguardError, Message: "wgrpcd error"}
+		}
+	}
+	return http.StatusInternalServerError, &APIError{Code: ErrorCodeInternalError, Message: "internal error"}
+}
@@ -0,0 +1,111 @@
+package wireguardhttps
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/joncooperworks/wgrpcd"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestErrorResponseMapsErrorsToStableCodes(t *testing.T) {
+	tests := []struct {
+		err        error
+		statusCode int
+		code       string
+	}{
+		{&ValidationError{Field: "name", Message: "must not be empty"}, http.StatusBadRequest, ErrorCodeValidationFailed},
+		{&RecordNotFoundError{err: errors.New("record not found")}, http.StatusNotFound, ErrorCodeNotFound},
+		{&LoginDeniedError{Provider: "okta", UserID: "jontom"}, http.StatusForbidden, ErrorCodeLoginDenied},
+		{&DeviceLimitError{Limit: 3}, http.StatusForbidden, ErrorCodeDeviceLimitReached},
+		{&IPsExhaustedError{}, http.StatusConflict, ErrorCodeIPsExhausted},
+		{&NoIPv4SubnetError{Pool: "ipv6-only"}, http.StatusConflict, ErrorCodeNoIPv4Subnet},
+		{&DatabaseError{err: errors.New("connection refused")}, http.StatusInternalServerError, ErrorCodeDatabaseError},
+		{status.Error(codes.Unavailable, "connection refused"), http.StatusServiceUnavailable, ErrorCodeWireguardUnavailable},
+		{status.Error(codes.Internal, "error creating peer"), http.StatusBadGateway, ErrorCodeWireguardError},
+		{errors.New("something else"), http.StatusInternalServerError, ErrorCodeInternalError},
+	}
+
+	for _, test := range tests {
+		statusCode, apiError := errorResponse(test.err)
+		if statusCode != test.statusCode || apiError.Code != test.code {
+			t.Fatalf("Expected %v to map to %v %v, got %v %v", test.err, test.statusCode, test.code, statusCode, apiError.Code)
+		}
+	}
+}
+
+func TestErrorResponseHidesWireguardErrorDetails(t *testing.T) {
+	for _, err := range []error{
+		status.Error(codes.Internal, "failed to configure peer on /dev/wg0: permission denied"),
+		status.Error(codes.Unimplemented, "unknown method ImportPeer for service wgrpcd.WireguardRPC"),
+	} {
+		_, apiError := errorResponse(err)
+		if strings.Contains(apiError.Message, "/dev/wg0") || strings.Contains(apiError.Message, "wgrpcd.WireguardRPC") {
+			t.Fatalf("Expected wgrpcd's error message not to be shown to clients, got %v", apiError.Message)
+		}
+	}
+}
+
+func TestCreateDeviceKeepsExhaustedAndWireguardErrors(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	err := db.AllocateSubnet([]net.IP{net.ParseIP("10.0.0.2")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.RegisterUser("jontom@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unavailable := func(allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
+		return nil, status.Error(codes.Unavailable, "connection refused")
+	}
+	_, _, err = db.CreateDevice(user, nil, Device{Name: "Laptop", OS: "Linux"}, nil, unavailable)
+	if grpcStatus, ok := status.FromError(err); !ok || grpcStatus.Code() != codes.Unavailable {
+		t.Fatalf("Expected wgrpcd error to be returned unwrapped, got %#v", err)
+	}
+
+	publicKey := mustGenerateKey(t)
+	deviceFunc := func(allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
+		return &wgrpcd.PeerConfigInfo{PublicKey: publicKey, AllowedIPs: allowedIPs}, nil
+	}
+	_, _, err = db.CreateDevice(user, nil, Device{Name: "Laptop", OS: "Linux"}, nil, deviceFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = db.CreateDevice(user, nil, Device{Name: "Phone", OS: "Android"}, nil, deviceFunc)
+	if _, ok := err.(*IPsExhaustedError); !ok {
+		t.Fatalf("Expected IPsExhaustedError, got %#v", err)
+	}
+}
+
+func TestCreateDeviceInIPv6OnlyPoolReturnsNoIPv4SubnetError(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	user, err := db.RegisterUser("jontom@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool, err := db.SavePool(AddressPool{Name: "ipv6-only"}, []net.IPNet{mustParseCIDR("fd00::/64")}, []AddressPoolMember{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deviceFunc := func(allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
+		return &wgrpcd.PeerConfigInfo{PublicKey: mustGenerateKey(t), AllowedIPs: allowedIPs}, nil
+	}
+	_, _, err = db.CreateDevice(user, &pool, Device{Name: "Laptop", OS: "Linux"}, nil, deviceFunc)
+	if _, ok := err.(*NoIPv4SubnetError); !ok {
+		t.Fatalf("Expected NoIPv4SubnetError, got %#v", err)
+	}
+}
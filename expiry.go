@@ -0,0 +1,110 @@
+package wireguardhttps
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// DeviceLifetime returns how long a device owned by user in pool may stay on the VPN.
+// The user's lifetime takes precedence over the pool's, which takes precedence over defaultLifetime.
+// Zero means devices never expire.
+func DeviceLifetime(defaultLifetime time.Duration, user UserProfile, pool *AddressPool) time.Duration {
+	if user.DeviceLifetime > 0 {
+		return user.DeviceLifetime
+	}
+
+	if pool != nil && pool.DeviceLifetime > 0 {
+		return pool.DeviceLifetime
+	}
+	return defaultLifetime
+}
+
+// ExpiryScheduler revokes devices whose expiry has passed, removing them from both the Wireguard interface and the Database.
+// If Mailer is set, owners are emailed ExpiryWarning before their devices expire and again when they're revoked.
+// Revocations are sent to WebhookDispatcher's webhooks.
+type ExpiryScheduler struct {
+	Database            Database
+	WireguardClient     WireguardClient
+	WireguardDeviceName string
+	Mailer              *Mailer
+	ExpiryWarning       time.Duration
+	WebhookDispatcher   *WebhookDispatcher
+}
+
+// RevokeExpired removes every device that expired at or before now and returns them.
+// Devices that can't be removed are skipped and their errors returned together in a *BatchError.
+func (e *ExpiryScheduler) RevokeExpired(now time.Time) ([]Device, error) {
+	devices, err := e.Database.ExpiredDevices(now)
+	if err != nil {
+		return nil, err
+	}
+
+	removePeer := RemovePeer(e.WireguardClient, e.WireguardDeviceName)
+	revoked := []Device{}
+	errs := []error{}
+	for _, device := range devices {
+		device := device
+		err = e.Database.RemoveDevice(device.Owner, device, func() error { return removePeer(device) })
+		if err != nil {
+			log.Printf("Failed to revoke expired device %v: %v", device.ID, err)
+			errs = append(errs, err)
+			continue
+		}
+		PublishAuditEvent(e.Database, e.WebhookDispatcher, AuditEvent{Action: AuditActionDeviceExpire, Actor: SystemActor, Subject: device.Owner.AuthPlatformUserID, DeviceID: &device.ID, Details: device.Name})
+		e.Mailer.Notify(EmailDeviceDeleted, DeviceEmail{Owner: device.Owner, Device: device, Time: now})
+		log.Printf("Revoked expired device %v for user %v", device.ID, device.Owner.AuthPlatformUserID)
+		revoked = append(revoked, device)
+	}
+	return revoked, batchError(errs)
+}
+
+// WarnExpiring emails the owners of devices expiring within ExpiryWarning of now, once per device, and returns the devices.
+func (e *ExpiryScheduler) WarnExpiring(now time.Time) ([]Device, error) {
+	if e.Mailer == nil || e.ExpiryWarning <= 0 {
+		return nil, nil
+	}
+
+	devices, err := e.Database.ExpiringDevices(now, now.Add(e.ExpiryWarning))
+	if err != nil {
+		return nil, err
+	}
+
+	warned := []Device{}
+	errs := []error{}
+	for _, device := range devices {
+		warnedDevice, err := e.Database.MarkExpiryWarningSent(device, now)
+		if err != nil {
+			log.Printf("Failed to mark expiry warning sent for device %v: %v", device.ID, err)
+			errs = append(errs, err)
+			continue
+		}
+		device = warnedDevice
+		e.Mailer.Notify(EmailDeviceExpiring, DeviceEmail{Owner: device.Owner, Device: device, Time: now})
+		warned = append(warned, device)
+	}
+	return warned, batchError(errs)
+}
+
+// Run revokes expired devices and warns owners of expiring ones every interval until ctx is cancelled.
+func (e *ExpiryScheduler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			_, err := e.RevokeExpired(now)
+			if err != nil {
+				log.Println(err)
+			}
+
+			_, err = e.WarnExpiring(now)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package wireguardhttps
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/joncooperworks/wgrpcd"
+)
+
+func TestDeviceLifetimePrecedence(t *testing.T) {
+	defaultLifetime := 24 * time.Hour
+	pool := &AddressPool{DeviceLifetime: 48 * time.Hour}
+	user := UserProfile{DeviceLifetime: time.Hour}
+
+	if lifetime := DeviceLifetime(defaultLifetime, UserProfile{}, nil); lifetime != defaultLifetime {
+		t.Fatalf("Expected default lifetime %v, got %v", defaultLifetime, lifetime)
+	}
+
+	if lifetime := DeviceLifetime(defaultLifetime, UserProfile{}, pool); lifetime != pool.DeviceLifetime {
+		t.Fatalf("Expected pool lifetime %v, got %v", pool.DeviceLifetime, lifetime)
+	}
+
+	if lifetime := DeviceLifetime(defaultLifetime, user, pool); lifetime != user.DeviceLifetime {
+		t.Fatalf("Expected user lifetime %v, got %v", user.DeviceLifetime, lifetime)
+	}
+}
+
+func TestExpirySchedulerRevokesExpiredDevices(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	err := db.RegisterSubnet(mustParseCIDR("10.0.0.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.RegisterUser("contractor@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	expired := now.Add(-time.Minute)
+	unexpired := now.Add(time.Hour)
+	expiredKey := mustGenerateKey(t)
+	for key, expiresAt := range map[string]*time.Time{expiredKey: &expired, mustGenerateKey(t): &unexpired, mustGenerateKey(t): nil} {
+		key := key
+		deviceFunc := func(allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
+			return &wgrpcd.PeerConfigInfo{PublicKey: key, AllowedIPs: allowedIPs}, nil
+		}
+		_, _, err = db.CreateDevice(user, nil, Device{Name: key, OS: "Windows", ExpiresAt: expiresAt}, nil, deviceFunc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client := &testwgrpcdClient{}
+	scheduler := &ExpiryScheduler{
+		Database:            db,
+		WireguardClient:     client,
+		WireguardDeviceName: "wg0",
+	}
+
+	revoked, err := scheduler.RevokeExpired(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(revoked) != 1 || revoked[0].PublicKey != expiredKey {
+		t.Fatalf("Expected only %v to be revoked, got %v", expiredKey, revoked)
+	}
+
+	if len(client.removedPeers) != 1 || client.removedPeers[0] != expiredKey {
+		t.Fatalf("Expected %v to be removed from the interface, got %v", expiredKey, client.removedPeers)
+	}
+
+	devices, err := db.Devices(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(devices) != 2 {
+		t.Fatalf("Expected 2 devices to remain, got %v", len(devices))
+	}
+}
+
+func TestExpirySchedulerCarriesOnPastDevicesItCantRevoke(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	err := db.RegisterSubnet(mustParseCIDR("10.0.0.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.RegisterUser("contractor@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	expired := now.Add(-time.Minute)
+	revocableKey := mustGenerateKey(t)
+	for _, key := range []string{"not a wireguard key", revocableKey} {
+		key := key
+		deviceFunc := func(allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
+			return &wgrpcd.PeerConfigInfo{PublicKey: key, AllowedIPs: allowedIPs}, nil
+		}
+		_, _, err = db.CreateDevice(user, nil, Device{Name: key, OS: "Windows", ExpiresAt: &expired}, nil, deviceFunc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client := &testwgrpcdClient{}
+	scheduler := &ExpiryScheduler{
+		Database:            db,
+		WireguardClient:     client,
+		WireguardDeviceName: "wg0",
+	}
+
+	revoked, err := scheduler.RevokeExpired(now)
+	if batchErr, ok := err.(*BatchError); !ok || len(batchErr.Errors) != 1 {
+		t.Fatalf("Expected a BatchError for the broken device, got %v", err)
+	}
+
+	if len(revoked) != 1 || revoked[0].PublicKey != revocableKey {
+		t.Fatalf("Expected %v to be revoked despite the earlier failure, got %v", revocableKey, revoked)
+	}
+}
+
+func TestDevicesExpireWithinPolicyAndCanBeExtended(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	err := db.RegisterSubnet(mustParseCIDR("10.0.0.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.RegisterUser("contractor@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lifetime := 7 * 24 * time.Hour
+	config := testServerConfig(t, db)
+	config.DeviceLifetime = lifetime
+
+	writer := serveAsUser(t, config, &user, "POST", "/api/devices", DeviceRequest{Name: "Laptop", OS: "Windows", PublicKey: mustGenerateKey(t), ExpiresInDays: 30})
+	if writer.Code != 400 {
+		t.Fatalf("Expected status code 400 for expiry beyond policy, got %v", writer.Code)
+	}
+
+	writer = serveAsUser(t, config, &user, "POST", "/api/devices", DeviceRequest{Name: "Laptop", OS: "Windows", PublicKey: mustGenerateKey(t), ExpiresInDays: 1})
+	if writer.Code != 200 {
+		t.Fatalf("Expected status code 200 for /devices, got %v", writer.Code)
+	}
+
+	devices, err := db.Devices(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(devices) != 1 || devices[0].ExpiresAt == nil || devices[0].ExpiresAt.After(time.Now().Add(24*time.Hour)) {
+		t.Fatalf("Expected device to expire within a day, got %v", devices)
+	}
+
+	writer = serveAsUser(t, config, &user, "POST", fmt.Sprintf("/api/devices/%v/extend", devices[0].ID), nil)
+	if writer.Code != 200 {
+		t.Fatalf("Expected status code 200 for extend, got %v", writer.Code)
+	}
+
+	var response DeviceResponse
+	err = json.NewDecoder(writer.Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.ExpiresIn == nil || *response.ExpiresIn <= int64((lifetime-time.Minute).Seconds()) {
+		t.Fatalf("Expected device to be extended to %v, got expires_in %v", lifetime, response.ExpiresIn)
+	}
+}
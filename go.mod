@@ -11,14 +11,18 @@ require (
 	github.com/gorilla/sessions v1.1.1
 	github.com/gwatts/gin-adapter v0.0.0-20170508204228-c44433c485ad
 	github.com/jinzhu/gorm v1.9.12
-	github.com/markbates/goth v1.64.0
 	github.com/joncooperworks/grpcauth v0.0.0-20201207192531-3de69fa0885f
 	github.com/joncooperworks/wgrpcd v0.0.0-20201208043129-ec801b5b5613
+	github.com/markbates/goth v1.64.0
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/modern-go/reflect2 v1.0.1 // indirect
+	github.com/prometheus/client_golang v1.11.1
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/t-tiger/gorm-bulk-insert v1.3.0
 	github.com/urfave/cli/v2 v2.2.0
-	golang.org/x/crypto v0.0.0-20200204104054-c9f3fb736b72
+	go.mozilla.org/pkcs7 v0.0.0-20200128120323-432b2356ecb1
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	golang.zx2c4.com/wireguard/wgctrl v0.0.0-20200609130330-bd2cb7843e1b
 	google.golang.org/grpc v1.35.0-dev
+	howett.net/plist v1.0.0
 )
@@ -1,38 +1,216 @@
 package wireguardhttps
 
 import (
-	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"text/template"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/csrf"
 	"github.com/joncooperworks/wgrpcd"
+	"github.com/markbates/goth"
 	"github.com/markbates/goth/gothic"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 type WireguardHandlers struct {
 	*ServerConfig
+	peerStatus *PeerStatusCache
 }
 
+// respondToError logs err and responds with its APIError.
 func (wh *WireguardHandlers) respondToError(c *gin.Context, err error) {
 	log.Println(err)
-	if _, ok := err.(*RecordNotFoundError); ok {
-		c.AbortWithStatus(http.StatusNotFound)
-		return
+	status, apiError := errorResponse(err)
+	c.AbortWithStatusJSON(status, apiError)
+}
+
+// ClientPrivateKeyPlaceholder stands in for the private key in configs for devices that generated their own keys.
+const ClientPrivateKeyPlaceholder = "<your private key>"
+
+// peerConfigINI builds the client config for credentials, using the device's pool DNS servers and routes if it sets them.
+// The device's routing profile takes precedence over the pool's routes.
+func (wh *WireguardHandlers) peerConfigINI(credentials *wgrpcd.PeerConfigInfo, device Device) *PeerConfigINI {
+	peerConfigINI := &PeerConfigINI{
+		PublicKey:  credentials.ServerPublicKey,
+		PrivateKey: credentials.PrivateKey,
+		AllowedIPs: []string{"0.0.0.0/0", "::/0"},
+		Addresses:  wgrpcd.IPNetsToStrings(credentials.AllowedIPs),
+		ServerName: wh.Endpoint.String(),
+		DNSServers: wgrpcd.IPsToStrings(wh.DNSServers),
+	}
+
+	if pool := device.AddressPool; pool != nil {
+		if dnsServers := pool.DNSServerList(); len(dnsServers) > 0 {
+			peerConfigINI.DNSServers = dnsServers
+		}
+
+		if allowedIPs := pool.AllowedIPList(); len(allowedIPs) > 0 {
+			peerConfigINI.AllowedIPs = allowedIPs
+		}
 	}
-	c.AbortWithStatus(http.StatusInternalServerError)
+
+	if profile := device.RoutingProfile; profile != nil {
+		if allowedIPs := profile.AllowedIPList(); len(allowedIPs) > 0 {
+			peerConfigINI.AllowedIPs = allowedIPs
+		}
+	}
+	return peerConfigINI
+}
+
+// requestedConfigFormat returns how the request wants its device config returned: the QR code format, the client config format from the config query parameter and that format's template.
+// The config format defaults to wg-quick, the only format that can be returned as a QR code.
+func (wh *WireguardHandlers) requestedConfigFormat(c *gin.Context) (string, string, *template.Template, error) {
+	configFormat := c.DefaultQuery("config", ConfigFormatWGQuick)
+	tmpl, ok := configTemplate(wh.Templates, configFormat)
+	if !ok {
+		if configFormat == ConfigFormatWGQuick {
+			return "", "", nil, errPeerConfigTemplateMissing
+		}
+		return "", "", nil, &ValidationError{Field: "config", Message: "must be one of the formats listed at /api/config-formats"}
+	}
+
+	format, ok := peerConfigFormat(c)
+	if !ok {
+		return "", "", nil, &ValidationError{Field: "format", Message: "must be text, png or svg"}
+	}
+
+	if configFormat != ConfigFormatWGQuick {
+		if query := c.Query("format"); query != "" && query != peerConfigFormatText {
+			return "", "", nil, &ValidationError{Field: "format", Message: "QR codes are only available for wg-quick configs"}
+		}
+		format = peerConfigFormatText
+	}
+	return format, configFormat, tmpl, nil
+}
+
+// removePeerFunc removes device's peer from the Wireguard interface.
+func (wh *WireguardHandlers) removePeerFunc(device Device) DeleteFunc {
+	return func() error {
+		return RemovePeer(wh.WireguardClient, wh.WireguardDeviceName)(device)
+	}
+}
+
+// newPresharedKey generates a preshared key for a device if requested is set, and returns nil otherwise.
+// The key is only ever returned in the rendered config and is never passed to the Database.
+func newPresharedKey(requested bool) (*wgtypes.Key, error) {
+	if !requested {
+		return nil, nil
+	}
+
+	key, err := wgtypes.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// createPeerFunc returns a DeviceFunc that adds a peer with a server generated key to the Wireguard interface, with presharedKey if it isn't nil.
+// It returns false if a preshared key is needed and wgrpcd can't set one.
+func (wh *WireguardHandlers) createPeerFunc(presharedKey *wgtypes.Key) (DeviceFunc, bool) {
+	if presharedKey == nil {
+		return func(allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
+			return wh.WireguardClient.CreatePeer(context.Background(), wh.WireguardDeviceName, allowedIPs)
+		}, true
+	}
+
+	configurer, ok := wh.WireguardClient.(PresharedKeyConfigurer)
+	if !ok {
+		return nil, false
+	}
+
+	return func(allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
+		return configurer.CreatePeerWithPresharedKey(context.Background(), wh.WireguardDeviceName, *presharedKey, allowedIPs)
+	}, true
+}
+
+// rekeyPeerFunc returns a DeviceFunc that replaces oldPublicKey's peer with one with a new server generated key, with presharedKey if it isn't nil.
+// It returns false if a preshared key is needed and wgrpcd can't set one.
+func (wh *WireguardHandlers) rekeyPeerFunc(oldPublicKey wgtypes.Key, presharedKey *wgtypes.Key) (DeviceFunc, bool) {
+	if presharedKey == nil {
+		return func(allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
+			return wh.WireguardClient.RekeyPeer(context.Background(), wh.WireguardDeviceName, oldPublicKey, allowedIPs)
+		}, true
+	}
+
+	configurer, ok := wh.WireguardClient.(PresharedKeyConfigurer)
+	if !ok {
+		return nil, false
+	}
+
+	return func(allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
+		return configurer.RekeyPeerWithPresharedKey(context.Background(), wh.WireguardDeviceName, oldPublicKey, *presharedKey, allowedIPs)
+	}, true
+}
+
+// importPeerFunc returns a DeviceFunc that adds publicKey, generated by the client, to the Wireguard interface, with presharedKey if it isn't nil.
+// If replacing is set, that peer is removed only after the new one has been added, so a failed import leaves the device working.
+// It returns false if wgrpcd can't import client generated keys.
+func (wh *WireguardHandlers) importPeerFunc(publicKey wgtypes.Key, presharedKey *wgtypes.Key, replacing *wgtypes.Key) (DeviceFunc, bool) {
+	importer, ok := wh.WireguardClient.(PeerImporter)
+	if !ok {
+		return nil, false
+	}
+
+	return func(allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
+		credentials, err := importer.ImportPeer(context.Background(), wh.WireguardDeviceName, publicKey, presharedKey, allowedIPs)
+		if err != nil {
+			return nil, err
+		}
+
+		// The new peer has taken over the device's addresses, so failing here would leave the Database with a key that no longer routes.
+		// A peer left behind is reported as an orphan by the Reconciler instead.
+		if replacing != nil {
+			_, err = wh.WireguardClient.RemovePeer(context.Background(), wh.WireguardDeviceName, *replacing)
+			if err != nil {
+				log.Printf("Failed to remove replaced peer %v: %v", replacing, err)
+			}
+		}
+
+		// The client keeps its private key, so the config has a placeholder for it.
+		credentials.PrivateKey = ClientPrivateKeyPlaceholder
+		return credentials, nil
+	}, true
+}
+
+// checkPublicKeyUnused returns a ValidationError if another device already has the client generated publicKey.
+// It must run before the key is imported, since importing a key that's in use reconfigures the other device's peer.
+func (wh *WireguardHandlers) checkPublicKeyUnused(publicKey wgtypes.Key) error {
+	inUse, err := wh.Database.PublicKeyInUse(publicKey.String())
+	if err != nil {
+		return err
+	}
+
+	if inUse {
+		return &ValidationError{Field: "public_key", Message: "is already used by another device"}
+	}
+	return nil
+}
+
+// audit records event in the audit log along with the request's source IP and user agent.
+func (wh *WireguardHandlers) audit(c *gin.Context, event AuditEvent) {
+	event.SourceIP = c.ClientIP()
+	event.UserAgent = c.Request.UserAgent()
+	PublishAuditEvent(wh.Database, wh.WebhookDispatcher, event)
+}
+
+// notifyOwner emails owner about a change to device made in the request.
+func (wh *WireguardHandlers) notifyOwner(c *gin.Context, email string, owner UserProfile, device Device) {
+	wh.Mailer.Notify(email, DeviceEmail{Owner: owner, Device: device, SourceIP: c.ClientIP()})
 }
 
 func (wh *WireguardHandlers) user(c *gin.Context) UserProfile {
 	user, ok := c.Get("user")
 	if !ok {
-		c.AbortWithStatus(http.StatusUnauthorized)
+		abortWithError(c, http.StatusUnauthorized, ErrorCodeUnauthorized, "not logged in")
 	}
 
 	return *user.(*UserProfile)
@@ -48,31 +226,56 @@ func (wh *WireguardHandlers) storeUserInSession(c *gin.Context, user UserProfile
 	return session.Save(c.Request, c.Writer)
 }
 
+// authorizeLogin applies the provider's LoginPolicy, responding with 403 if the user isn't allowed in.
+// It returns the claim that allowed the user in.
+func (wh *WireguardHandlers) authorizeLogin(c *gin.Context, gothUser goth.User) (string, bool) {
+	policy, ok := wh.LoginPolicies[gothUser.Provider]
+	if !ok {
+		policy = &LoginPolicy{}
+	}
+
+	authorizedBy, err := policy.Authorize(gothUser)
+	if err != nil {
+		wh.audit(c, AuditEvent{Action: AuditActionLoginDenied, Actor: gothUser.UserID, Details: gothUser.Provider})
+		wh.Metrics.ObserveLogin(gothUser.Provider, LoginResultDenied)
+		wh.respondToError(c, err)
+		return "", false
+	}
+	return authorizedBy, true
+}
+
 func (wh *WireguardHandlers) OAuthCallbackHandler(c *gin.Context) {
 	gothUser, err := gothic.CompleteUserAuth(c.Writer, c.Request)
 	if err != nil {
 		log.Println(err)
-		c.AbortWithStatus(http.StatusUnauthorized)
+		wh.Metrics.ObserveLogin(c.Query("provider"), LoginResultFailed)
+		abortWithError(c, http.StatusUnauthorized, ErrorCodeUnauthorized, "login failed")
+		return
+	}
+
+	authorizedBy, ok := wh.authorizeLogin(c, gothUser)
+	if !ok {
 		return
 	}
 
 	user, err := wh.Database.RegisterUser(
 		gothUser.UserID,
 		gothUser.Provider,
+		authorizedBy,
+		gothUser.Email,
 	)
-
 	if err != nil {
-		log.Println(err)
-		c.AbortWithStatus(http.StatusInternalServerError)
+		wh.respondToError(c, err)
 		return
 	}
 
 	err = wh.storeUserInSession(c, user)
 	if err != nil {
-		log.Println(err)
-		c.AbortWithStatus(http.StatusInternalServerError)
+		wh.respondToError(c, err)
 		return
 	}
+	wh.audit(c, AuditEvent{Action: AuditActionLogin, Actor: user.AuthPlatformUserID, Details: authorizedBy})
+	wh.Metrics.ObserveLogin(gothUser.Provider, LoginResultSuccess)
 
 	c.SetCookie(
 		"isLoggedIn",
@@ -92,101 +295,291 @@ func (wh *WireguardHandlers) AuthenticateHandler(c *gin.Context) {
 	gothUser, err := gothic.CompleteUserAuth(c.Writer, c.Request)
 	if err != nil {
 		gothic.BeginAuthHandler(c.Writer, c.Request)
+		return
+	}
+
+	authorizedBy, ok := wh.authorizeLogin(c, gothUser)
+	if !ok {
+		return
 	}
 
 	user, err := wh.Database.RegisterUser(
 		gothUser.UserID,
 		gothUser.Provider,
+		authorizedBy,
+		gothUser.Email,
 	)
 	if err != nil {
-		log.Println(err)
-		c.AbortWithStatus(http.StatusInternalServerError)
+		wh.respondToError(c, err)
 		return
 	}
 
 	err = wh.storeUserInSession(c, user)
 	if err != nil {
-		log.Println(err)
-		c.AbortWithStatus(http.StatusInternalServerError)
+		wh.respondToError(c, err)
 		return
 	}
+	wh.audit(c, AuditEvent{Action: AuditActionLogin, Actor: user.AuthPlatformUserID, Details: authorizedBy})
+	wh.Metrics.ObserveLogin(gothUser.Provider, LoginResultSuccess)
 	c.JSON(http.StatusOK, user)
 }
 
 func (wh *WireguardHandlers) LogoutHandler(c *gin.Context) {
 	err := gothic.Logout(c.Writer, c.Request)
 	if err != nil {
-		log.Println(err)
-		c.AbortWithStatus(http.StatusInternalServerError)
+		wh.respondToError(c, err)
 		return
 	}
+
+	session, err := wh.SessionStore.Get(c.Request, wh.SessionName)
+	if err == nil {
+		if user, ok := session.Values["user"].(*UserProfile); ok {
+			wh.audit(c, AuditEvent{Action: AuditActionLogout, Actor: user.AuthPlatformUserID})
+		}
+	}
 	c.Redirect(http.StatusTemporaryRedirect, "/")
 }
 
 func (wh *WireguardHandlers) NewDeviceHandler(c *gin.Context) {
 	var deviceRequest DeviceRequest
-	err := c.BindJSON(&deviceRequest)
+	err := c.ShouldBindJSON(&deviceRequest)
 	if err != nil {
 		log.Println(err)
-		c.AbortWithStatus(http.StatusBadRequest)
+		abortWithError(c, http.StatusBadRequest, ErrorCodeBadRequest, "request body must be valid JSON")
+		return
+	}
+
+	err = deviceRequest.Validate()
+	if err != nil {
+		wh.respondToError(c, err)
+		return
+	}
+
+	format, configFormat, tmpl, err := wh.requestedConfigFormat(c)
+	if err != nil {
+		wh.respondToError(c, err)
+		return
+	}
+
+	presharedKey, err := newPresharedKey(deviceRequest.PresharedKey)
+	if err != nil {
+		wh.respondToError(c, err)
 		return
 	}
 
-	deviceFunc := func(ipAddress IPAddress) (*wgrpcd.PeerConfigInfo, error) {
-		_, network, err := net.ParseCIDR(fmt.Sprintf("%v/32", ipAddress.Address))
+	var deviceFunc DeviceFunc
+	if deviceRequest.PublicKey != "" {
+		publicKey, err := wgtypes.ParseKey(deviceRequest.PublicKey)
 		if err != nil {
-			return nil, err
+			wh.respondToError(c, &ValidationError{Field: "public_key", Message: "must be a base64 encoded Wireguard public key"})
+			return
 		}
 
-		credentials, err := wh.WireguardClient.CreatePeer(context.Background(), wh.WireguardDeviceName, []net.IPNet{*network})
+		err = wh.checkPublicKeyUnused(publicKey)
 		if err != nil {
-			return nil, err
+			wh.respondToError(c, err)
+			return
 		}
 
-		return credentials, nil
+		var ok bool
+		deviceFunc, ok = wh.importPeerFunc(publicKey, presharedKey, nil)
+		if !ok {
+			abortWithError(c, http.StatusNotImplemented, ErrorCodeNotImplemented, "wgrpcd can't import client generated public keys")
+			return
+		}
+	} else {
+		var ok bool
+		deviceFunc, ok = wh.createPeerFunc(presharedKey)
+		if !ok {
+			abortWithError(c, http.StatusNotImplemented, ErrorCodeNotImplemented, "wgrpcd can't set preshared keys")
+			return
+		}
 	}
 
 	user := wh.user(c)
-	device, credentials, err := wh.Database.CreateDevice(user, deviceRequest.Name, deviceRequest.OS, deviceFunc)
-	if err != nil {
-		log.Println(err)
-		c.AbortWithStatus(http.StatusInternalServerError)
+	var pool *AddressPool
+	if deviceRequest.Pool != "" {
+		namedPool, err := wh.Database.Pool(user, deviceRequest.Pool)
+		if err != nil {
+			wh.respondToError(c, err)
+			return
+		}
+		pool = &namedPool
+	}
+
+	requestedLifetime := time.Duration(deviceRequest.ExpiresInDays) * 24 * time.Hour
+	if requestedLifetime < 0 {
+		wh.respondToError(c, &ValidationError{Field: "expires_in_days", Message: "must not be negative"})
 		return
 	}
 
-	tmpl, ok := wh.Templates["peer_config"]
-	if !ok {
-		c.AbortWithStatus(http.StatusInternalServerError)
+	device := Device{Name: deviceRequest.Name, OS: deviceRequest.OS, HasPresharedKey: deviceRequest.PresharedKey, ClientGeneratedKey: deviceRequest.PublicKey != ""}
+	if deviceRequest.RoutingProfile != "" {
+		profile, err := wh.Database.RoutingProfile(deviceRequest.RoutingProfile)
+		if err != nil {
+			wh.respondToError(c, err)
+			return
+		}
+		device.RoutingProfile = &profile
+		device.RoutingProfileID = &profile.ID
+	}
+
+	policyFunc := func(owner UserProfile, device *Device) (int, error) {
+		lifetime := DeviceLifetime(wh.ServerConfig.DeviceLifetime, owner, pool)
+		if lifetime > 0 && requestedLifetime > lifetime {
+			return 0, &ValidationError{Field: "expires_in_days", Message: fmt.Sprintf("must be at most %v", lifetime)}
+		}
+
+		if requestedLifetime > 0 {
+			lifetime = requestedLifetime
+		}
+
+		if lifetime > 0 {
+			expiresAt := time.Now().Add(lifetime)
+			device.ExpiresAt = &expiresAt
+		}
+		return DeviceLimit(wh.ServerConfig.DeviceLimit, wh.AdminDeviceLimit, owner), nil
+	}
+
+	device, credentials, err := wh.Database.CreateDevice(user, pool, device, policyFunc, deviceFunc)
+	if err != nil {
+		wh.respondToError(c, err)
 		return
 	}
 
-	peerConfigINI := &PeerConfigINI{
-		PublicKey:  credentials.ServerPublicKey,
-		PrivateKey: credentials.PrivateKey,
-		AllowedIPs: wgrpcd.IPNetsToStrings(credentials.AllowedIPs),
-		Addresses:  wgrpcd.IPNetsToStrings(credentials.AllowedIPs),
-		ServerName: wh.Endpoint.String(),
-		DNSServers: wgrpcd.IPsToStrings(wh.DNSServers),
+	peerConfigINI := wh.peerConfigINI(credentials, device)
+	if presharedKey != nil {
+		peerConfigINI.PresharedKey = presharedKey.String()
 	}
-	buffer := &bytes.Buffer{}
-	err = tmpl.Execute(buffer, peerConfigINI)
+	files, err := wh.renderDeviceConfig(configFormat, tmpl, peerConfigINI, device)
 	if err != nil {
-		log.Println(err)
-		c.AbortWithStatus(http.StatusInternalServerError)
+		wh.respondToError(c, err)
 		return
 	}
 
+	wh.audit(c, AuditEvent{Action: AuditActionDeviceCreate, Actor: user.AuthPlatformUserID, DeviceID: &device.ID, Details: device.Name})
+	wh.notifyOwner(c, EmailDeviceCreated, user, device)
 	log.Printf("Successfully added device %v for user %v", device, user)
+	if deviceRequest.DownloadLink {
+		err = wh.writeConfigDownloadLink(c, user, device, configFormat, files)
+	} else {
+		err = writeDeviceConfig(c, format, configFormat, files)
+	}
+	if err != nil {
+		wh.respondToError(c, err)
+	}
+}
+
+// writeConfigDownloadLink stores files encrypted behind a one-time download link and responds with the link.
+func (wh *WireguardHandlers) writeConfigDownloadLink(c *gin.Context, user UserProfile, device Device, configFormat string, files map[string][]byte) error {
+	token, err := GenerateConfigDownloadToken()
+	if err != nil {
+		return err
+	}
+
+	ciphertext, err := SealConfigDownload(token, files)
+	if err != nil {
+		return err
+	}
+
+	ttl := wh.ConfigDownloadTTL
+	if ttl <= 0 {
+		ttl = DefaultConfigDownloadTTL
+	}
+
+	download := ConfigDownload{
+		DeviceID:     device.ID,
+		TokenHash:    HashAPIToken(token),
+		ConfigFormat: configFormat,
+		Ciphertext:   ciphertext,
+		ExpiresAt:    time.Now().Add(ttl),
+	}
+	download, err = wh.Database.CreateConfigDownload(user, download)
+	if err != nil {
+		return err
+	}
+
 	c.Header("Cache-Control", "no-store")
-	c.Data(http.StatusOK, "text/plain", buffer.Bytes())
-	buffer.Reset()
+	c.JSON(http.StatusOK, ConfigDownloadResponse{
+		URL:       configDownloadURL(wh.HTTPHost, token),
+		ExpiresAt: download.ExpiresAt,
+		DeviceID:  device.ID,
+	})
+	return nil
+}
+
+// ConfigDownloadPageHandler serves the page a one-time download link opens to, without claiming the link.
+func (wh *WireguardHandlers) ConfigDownloadPageHandler(c *gin.Context) {
+	_, ok := peerConfigFormat(c)
+	if !ok {
+		wh.respondToError(c, &ValidationError{Field: "format", Message: "must be text, png or svg"})
+		return
+	}
+
+	c.Header("Referrer-Policy", "no-referrer")
+	c.Header("Cache-Control", "no-store")
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(http.StatusOK)
+	err := configDownloadPage.Execute(c.Writer, nil)
+	if err != nil {
+		log.Printf("Failed to render download page: %v", err)
+	}
+}
+
+// ClaimConfigDownloadHandler serves the config behind a one-time download link and invalidates the link.
+// The token authenticates the request, so it's served without a session and is unusable once claimed or expired.
+func (wh *WireguardHandlers) ClaimConfigDownloadHandler(c *gin.Context) {
+	// The format is checked before the link is claimed, so a bad request doesn't use it up.
+	format, ok := peerConfigFormat(c)
+	if !ok {
+		wh.respondToError(c, &ValidationError{Field: "format", Message: "must be text, png or svg"})
+		return
+	}
+
+	token := c.Param("token")
+	download, err := wh.Database.ClaimConfigDownload(HashAPIToken(token), time.Now())
+	if err != nil {
+		wh.respondToError(c, err)
+		return
+	}
+
+	files, err := OpenConfigDownload(token, download.Ciphertext)
+	if err != nil {
+		wh.respondToError(c, err)
+		return
+	}
+
+	if download.ConfigFormat != ConfigFormatWGQuick {
+		format = peerConfigFormatText
+	}
+
+	wh.audit(c, AuditEvent{Action: AuditActionDeviceDownload, Actor: download.Owner.AuthPlatformUserID, DeviceID: &download.DeviceID, Details: download.ConfigFormat})
+	c.Header("Referrer-Policy", "no-referrer")
+	err = writeDeviceConfig(c, format, download.ConfigFormat, files)
+	if err != nil {
+		wh.respondToError(c, err)
+	}
 }
 
 func (wh *WireguardHandlers) RekeyDeviceHandler(c *gin.Context) {
 	user := wh.user(c)
 	deviceID, err := strconv.Atoi(c.Param("device_id"))
 	if err != nil {
-		c.AbortWithStatus(http.StatusBadRequest)
+		wh.respondToError(c, &ValidationError{Field: "device_id", Message: "must be an integer"})
+		return
+	}
+
+	format, configFormat, tmpl, err := wh.requestedConfigFormat(c)
+	if err != nil {
+		wh.respondToError(c, err)
+		return
+	}
+
+	var rekeyRequest RekeyRequest
+	err = c.ShouldBindJSON(&rekeyRequest)
+	if err != nil && err != io.EOF {
+		log.Println(err)
+		abortWithError(c, http.StatusBadRequest, ErrorCodeBadRequest, "request body must be valid JSON")
 		return
 	}
 
@@ -196,56 +589,115 @@ func (wh *WireguardHandlers) RekeyDeviceHandler(c *gin.Context) {
 		return
 	}
 
-	rekeyFunc := func(ipAddress IPAddress) (*wgrpcd.PeerConfigInfo, error) {
-		_, network, err := net.ParseCIDR(fmt.Sprintf("%v/32", ipAddress.Address))
-		if err != nil {
-			return nil, err
-		}
+	if device.ClientGeneratedKey && rekeyRequest.PublicKey == "" {
+		wh.respondToError(c, &ValidationError{Field: "public_key", Message: "is required to rekey a device that generated its own key"})
+		return
+	}
 
+	presharedKey, err := newPresharedKey(device.HasPresharedKey)
+	if err != nil {
+		wh.respondToError(c, err)
+		return
+	}
+
+	var oldPublicKey *wgtypes.Key
+	// Disabled devices were removed from the interface, so they get a new peer instead.
+	if device.DisabledAt == nil {
 		publicKey, err := wgtypes.ParseKey(device.PublicKey)
 		if err != nil {
-			return nil, err
+			wh.respondToError(c, err)
+			return
+		}
+		oldPublicKey = &publicKey
+	}
+
+	var rekeyFunc DeviceFunc
+	var ok bool
+	switch {
+	case rekeyRequest.PublicKey != "":
+		publicKey, err := wgtypes.ParseKey(rekeyRequest.PublicKey)
+		if err != nil || publicKey.String() == device.PublicKey {
+			wh.respondToError(c, &ValidationError{Field: "public_key", Message: "must be a new base64 encoded Wireguard public key"})
+			return
 		}
-		credentials, err := wh.WireguardClient.RekeyPeer(context.Background(), wh.WireguardDeviceName, publicKey, []net.IPNet{*network})
+
+		err = wh.checkPublicKeyUnused(publicKey)
 		if err != nil {
-			return nil, err
+			wh.respondToError(c, err)
+			return
 		}
 
-		return credentials, nil
+		rekeyFunc, ok = wh.importPeerFunc(publicKey, presharedKey, oldPublicKey)
+		if !ok {
+			abortWithError(c, http.StatusNotImplemented, ErrorCodeNotImplemented, "wgrpcd can't import client generated public keys")
+			return
+		}
+		device.ClientGeneratedKey = true
+
+	case oldPublicKey == nil:
+		rekeyFunc, ok = wh.createPeerFunc(presharedKey)
+
+	default:
+		rekeyFunc, ok = wh.rekeyPeerFunc(*oldPublicKey, presharedKey)
 	}
+
+	if !ok {
+		abortWithError(c, http.StatusNotImplemented, ErrorCodeNotImplemented, "wgrpcd can't set preshared keys")
+		return
+	}
+
 	device, credentials, err := wh.Database.RekeyDevice(wh.user(c), device, rekeyFunc)
 	if err != nil {
-		log.Println(err)
-		c.AbortWithStatus(http.StatusInternalServerError)
+		wh.respondToError(c, err)
 		return
 	}
 
-	tmpl, ok := wh.Templates["peer_config"]
-	if !ok {
-		c.AbortWithStatus(http.StatusInternalServerError)
+	peerConfigINI := wh.peerConfigINI(credentials, device)
+	if presharedKey != nil {
+		peerConfigINI.PresharedKey = presharedKey.String()
+	}
+	files, err := wh.renderDeviceConfig(configFormat, tmpl, peerConfigINI, device)
+	if err != nil {
+		wh.respondToError(c, err)
 		return
 	}
 
-	peerConfigINI := &PeerConfigINI{
-		PublicKey:  credentials.ServerPublicKey,
-		PrivateKey: credentials.PrivateKey,
-		AllowedIPs: wgrpcd.IPNetsToStrings(credentials.AllowedIPs),
-		Addresses:  wgrpcd.IPNetsToStrings(credentials.AllowedIPs),
-		ServerName: wh.Endpoint.String(),
-		DNSServers: wgrpcd.IPsToStrings(wh.DNSServers),
+	wh.audit(c, AuditEvent{Action: AuditActionDeviceRekey, Actor: user.AuthPlatformUserID, DeviceID: &device.ID, Details: device.Name})
+	wh.notifyOwner(c, EmailDeviceRekeyed, device.Owner, device)
+	log.Printf("Successfully rekeyed device %v for user %v", device, user)
+	err = writeDeviceConfig(c, format, configFormat, files)
+	if err != nil {
+		wh.respondToError(c, err)
 	}
-	buffer := &bytes.Buffer{}
-	err = tmpl.Execute(buffer, peerConfigINI)
+}
+
+// deviceResponse merges device with its status on the Wireguard interface.
+// A wgrpcd failure is logged rather than failing the request, since the database fields are still useful.
+func (wh *WireguardHandlers) deviceResponse(device Device) DeviceResponse {
+	status, err := wh.peerStatus.Status(device)
 	if err != nil {
 		log.Println(err)
-		c.AbortWithStatus(http.StatusInternalServerError)
-		return
 	}
 
-	log.Printf("Successfully rekeyed device %v for user %v", device, user)
-	c.Header("Cache-Control", "no-store")
-	c.Data(http.StatusOK, "text/plain", buffer.Bytes())
-	buffer.Reset()
+	response := DeviceResponse{Device: device, Status: status}
+	if device.ExpiresAt != nil {
+		expiresIn := int64(time.Until(*device.ExpiresAt).Seconds())
+		if expiresIn < 0 {
+			expiresIn = 0
+		}
+		response.ExpiresIn = &expiresIn
+	}
+
+	if wh.MaxKeyAge > 0 {
+		rotationDue := time.Until(device.KeyRotatedTime().Add(wh.MaxKeyAge))
+		rotationDueIn := int64(rotationDue.Seconds())
+		if rotationDueIn < 0 {
+			rotationDueIn = 0
+		}
+		response.KeyRotationDueIn = &rotationDueIn
+		response.KeyRotationWarning = rotationDue <= wh.KeyRotationWarning
+	}
+	return response
 }
 
 func (wh *WireguardHandlers) ListUserDevicesHandler(c *gin.Context) {
@@ -255,7 +707,85 @@ func (wh *WireguardHandlers) ListUserDevicesHandler(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, devices)
+	responses := []DeviceResponse{}
+	for _, device := range devices {
+		responses = append(responses, wh.deviceResponse(device))
+	}
+	c.JSON(http.StatusOK, responses)
+}
+
+func (wh *WireguardHandlers) DeviceHandler(c *gin.Context) {
+	deviceID, err := strconv.Atoi(c.Param("device_id"))
+	if err != nil {
+		wh.respondToError(c, &ValidationError{Field: "device_id", Message: "must be an integer"})
+		return
+	}
+
+	device, err := wh.Database.Device(wh.user(c), deviceID)
+	if err != nil {
+		wh.respondToError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, wh.deviceResponse(device))
+}
+
+// ExtendDeviceHandler pushes a device's expiry back to the full lifetime its owner's policy allows.
+// If the policy no longer has a lifetime, the device stops expiring.
+func (wh *WireguardHandlers) ExtendDeviceHandler(c *gin.Context) {
+	user := wh.user(c)
+	deviceID, err := strconv.Atoi(c.Param("device_id"))
+	if err != nil {
+		wh.respondToError(c, &ValidationError{Field: "device_id", Message: "must be an integer"})
+		return
+	}
+
+	device, err := wh.Database.Device(user, deviceID)
+	if err != nil {
+		wh.respondToError(c, err)
+		return
+	}
+
+	lifetime := DeviceLifetime(wh.ServerConfig.DeviceLifetime, device.Owner, device.AddressPool)
+	var expiresAt *time.Time
+	if lifetime > 0 {
+		extendedExpiry := time.Now().Add(lifetime)
+		expiresAt = &extendedExpiry
+	}
+
+	device, err = wh.Database.ExtendDevice(user, device, expiresAt)
+	if err != nil {
+		wh.respondToError(c, err)
+		return
+	}
+	wh.audit(c, AuditEvent{Action: AuditActionDeviceExtend, Actor: user.AuthPlatformUserID, DeviceID: &device.ID, Details: device.Name})
+
+	c.JSON(http.StatusOK, wh.deviceResponse(device))
+}
+
+func (wh *WireguardHandlers) ListUserPoolsHandler(c *gin.Context) {
+	pools, err := wh.Database.Pools(wh.user(c))
+	if err != nil {
+		wh.respondToError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, pools)
+}
+
+func (wh *WireguardHandlers) ListRoutingProfilesHandler(c *gin.Context) {
+	profiles, err := wh.Database.RoutingProfiles()
+	if err != nil {
+		wh.respondToError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, profiles)
+}
+
+// ListConfigFormatsHandler lists the client config formats devices can be downloaded in with the config query parameter.
+func (wh *WireguardHandlers) ListConfigFormatsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, ConfigFormats(wh.Templates))
 }
 
 func (wh *WireguardHandlers) UserProfileInfoHandler(c *gin.Context) {
@@ -268,7 +798,7 @@ func (wh *WireguardHandlers) DeleteDeviceHandler(c *gin.Context) {
 	user := wh.user(c)
 	deviceID, err := strconv.Atoi(c.Param("device_id"))
 	if err != nil {
-		c.AbortWithStatus(http.StatusBadRequest)
+		wh.respondToError(c, &ValidationError{Field: "device_id", Message: "must be an integer"})
 		return
 	}
 
@@ -278,24 +808,319 @@ func (wh *WireguardHandlers) DeleteDeviceHandler(c *gin.Context) {
 		return
 	}
 
-	deleteFunc := func() error {
-		publicKey, err := wgtypes.ParseKey(device.PublicKey)
+	err = wh.Database.RemoveDevice(wh.user(c), device, wh.removePeerFunc(device))
+	if err != nil {
+		wh.respondToError(c, err)
+		return
+	}
+
+	wh.audit(c, AuditEvent{Action: AuditActionDeviceDelete, Actor: user.AuthPlatformUserID, DeviceID: &device.ID, Details: device.Name})
+	wh.notifyOwner(c, EmailDeviceDeleted, device.Owner, device)
+	log.Printf("Deleted device %v for user %v", device, user)
+	c.AbortWithStatus(http.StatusNoContent)
+}
+
+func (wh *WireguardHandlers) AdminListUsersHandler(c *gin.Context) {
+	users, err := wh.Database.Users()
+	if err != nil {
+		wh.respondToError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, users)
+}
+
+// AdminSaveRoutingProfileHandler creates or replaces the routing profile named in the URL.
+// Existing devices using the profile get the new routes the next time they're rekeyed.
+func (wh *WireguardHandlers) AdminSaveRoutingProfileHandler(c *gin.Context) {
+	var profileRequest RoutingProfileRequest
+	err := c.ShouldBindJSON(&profileRequest)
+	if err != nil {
+		log.Println(err)
+		abortWithError(c, http.StatusBadRequest, ErrorCodeBadRequest, "request body must be valid JSON")
+		return
+	}
+
+	if len(profileRequest.AllowedIPs) == 0 {
+		wh.respondToError(c, &ValidationError{Field: "allowed_ips", Message: "must not be empty"})
+		return
+	}
+
+	for _, allowedIP := range profileRequest.AllowedIPs {
+		_, _, err := net.ParseCIDR(allowedIP)
 		if err != nil {
-			return err
+			wh.respondToError(c, &ValidationError{Field: "allowed_ips", Message: fmt.Sprintf("%v is not in CIDR notation", allowedIP)})
+			return
 		}
-		_, err = wh.WireguardClient.RemovePeer(context.Background(), wh.WireguardDeviceName, publicKey)
+	}
+
+	profile, err := wh.Database.SaveRoutingProfile(RoutingProfile{
+		Name:       c.Param("name"),
+		AllowedIPs: strings.Join(profileRequest.AllowedIPs, ","),
+	})
+	if err != nil {
+		wh.respondToError(c, err)
+		return
+	}
+
+	wh.audit(c, AuditEvent{Action: AuditActionAdminRoutingProfile, Actor: wh.user(c).AuthPlatformUserID, Details: fmt.Sprintf("%v: %v", profile.Name, profile.AllowedIPs)})
+	c.JSON(http.StatusOK, profile)
+}
+
+// AdminListDevicesHandler lists every user's devices.
+// The search query parameter restricts the list to devices with a matching public key or IP address.
+func (wh *WireguardHandlers) AdminListDevicesHandler(c *gin.Context) {
+	var devices []Device
+	var err error
+	if query := c.Query("search"); query != "" {
+		devices, err = wh.Database.SearchDevices(query)
+	} else {
+		devices, err = wh.Database.AllDevices()
+	}
+
+	if err != nil {
+		wh.respondToError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, devices)
+}
+
+func (wh *WireguardHandlers) AdminDeleteDeviceHandler(c *gin.Context) {
+	admin := wh.user(c)
+	deviceID, err := strconv.Atoi(c.Param("device_id"))
+	if err != nil {
+		wh.respondToError(c, &ValidationError{Field: "device_id", Message: "must be an integer"})
+		return
+	}
+
+	device, err := wh.Database.FindDevice(deviceID)
+	if err != nil {
+		wh.respondToError(c, err)
+		return
+	}
+
+	err = wh.Database.RemoveDevice(device.Owner, device, wh.removePeerFunc(device))
+	if err != nil {
+		wh.respondToError(c, err)
+		return
+	}
+
+	wh.audit(c, AuditEvent{Action: AuditActionAdminDeviceDelete, Actor: admin.AuthPlatformUserID, Subject: device.Owner.AuthPlatformUserID, DeviceID: &device.ID, Details: device.Name})
+	wh.notifyOwner(c, EmailDeviceDeleted, device.Owner, device)
+	log.Printf("Admin %v revoked device %v for user %v", admin, device, device.Owner)
+	c.AbortWithStatus(http.StatusNoContent)
+}
+
+func (wh *WireguardHandlers) AdminDeleteUserHandler(c *gin.Context) {
+	admin := wh.user(c)
+	userID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		wh.respondToError(c, &ValidationError{Field: "user_id", Message: "must be an integer"})
+		return
+	}
+
+	// Admins can't lock themselves out.
+	if uint(userID) == admin.ID {
+		abortWithError(c, http.StatusBadRequest, ErrorCodeBadRequest, "admins can't delete themselves")
+		return
+	}
+
+	user, err := wh.Database.GetUser(userID)
+	if err != nil {
+		wh.respondToError(c, err)
+		return
+	}
+
+	event := AuditEvent{Action: AuditActionAdminUserDelete, Actor: admin.AuthPlatformUserID, Subject: user.AuthPlatformUserID, SourceIP: c.ClientIP(), UserAgent: c.Request.UserAgent()}
+	err = DeleteUserAndDevices(wh.Database, wh.WebhookDispatcher, user, RemovePeer(wh.WireguardClient, wh.WireguardDeviceName), event)
+	if err != nil {
+		wh.respondToError(c, err)
+		return
+	}
+	log.Printf("Admin %v deleted user %v", admin, userID)
+	c.AbortWithStatus(http.StatusNoContent)
+}
+
+// timeQuery parses the RFC 3339 time in the field query parameter, returning nil if it isn't set.
+func timeQuery(c *gin.Context, field string) (*time.Time, error) {
+	value := c.Query(field)
+	if value == "" {
+		return nil, nil
+	}
+
+	parsedTime, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, &ValidationError{Field: field, Message: "must be an RFC 3339 time"}
+	}
+	return &parsedTime, nil
+}
+
+// AdminAuditLogHandler lists audit events, newest first.
+// The actor, action, device_id, since, until and limit query parameters filter the events, with times in RFC 3339 format.
+// format=jsonl exports every matching event as JSON lines instead of returning the latest defaultAuditEventLimit as a JSON array.
+func (wh *WireguardHandlers) AdminAuditLogHandler(c *gin.Context) {
+	export := c.Query("format") == "jsonl"
+	filter := AuditFilter{Actor: c.Query("actor"), Action: c.Query("action")}
+	if !export {
+		filter.Limit = defaultAuditEventLimit
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		parsedLimit, err := strconv.Atoi(limit)
+		if err != nil || parsedLimit < 1 {
+			wh.respondToError(c, &ValidationError{Field: "limit", Message: "must be a positive integer"})
+			return
+		}
+		filter.Limit = parsedLimit
+	}
+
+	if deviceID := c.Query("device_id"); deviceID != "" {
+		parsedDeviceID, err := strconv.ParseUint(deviceID, 10, 64)
 		if err != nil {
-			return err
+			wh.respondToError(c, &ValidationError{Field: "device_id", Message: "must be an integer"})
+			return
 		}
+		id := uint(parsedDeviceID)
+		filter.DeviceID = &id
+	}
 
-		return nil
+	since, err := timeQuery(c, "since")
+	if err != nil {
+		wh.respondToError(c, err)
+		return
 	}
-	err = wh.Database.RemoveDevice(wh.user(c), device, deleteFunc)
+
+	until, err := timeQuery(c, "until")
 	if err != nil {
 		wh.respondToError(c, err)
 		return
 	}
+	filter.Since, filter.Until = since, until
 
-	log.Printf("Deleted device %v for user %v", device, user)
+	events, err := wh.Database.AuditEvents(filter)
+	if err != nil {
+		wh.respondToError(c, err)
+		return
+	}
+
+	if !export {
+		c.JSON(http.StatusOK, events)
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", `attachment; filename="audit.jsonl"`)
+	c.Status(http.StatusOK)
+	encoder := json.NewEncoder(c.Writer)
+	for _, event := range events {
+		err = encoder.Encode(event)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+	}
+}
+
+// AdminWebhookDeliveriesHandler lists the latest webhook deliveries and their outcomes, newest first.
+// The limit query parameter overrides defaultWebhookDeliveryLimit.
+func (wh *WireguardHandlers) AdminWebhookDeliveriesHandler(c *gin.Context) {
+	limit := defaultWebhookDeliveryLimit
+	if query := c.Query("limit"); query != "" {
+		parsedLimit, err := strconv.Atoi(query)
+		if err != nil || parsedLimit < 1 {
+			wh.respondToError(c, &ValidationError{Field: "limit", Message: "must be a positive integer"})
+			return
+		}
+		limit = parsedLimit
+	}
+
+	deliveries, err := wh.Database.WebhookDeliveries(limit)
+	if err != nil {
+		wh.respondToError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, deliveries)
+}
+
+func (wh *WireguardHandlers) NewAPITokenHandler(c *gin.Context) {
+	var tokenRequest APITokenRequest
+	err := c.ShouldBindJSON(&tokenRequest)
+	if err != nil {
+		log.Println(err)
+		abortWithError(c, http.StatusBadRequest, ErrorCodeBadRequest, "request body must be valid JSON")
+		return
+	}
+
+	if tokenRequest.ExpiresInDays == 0 {
+		tokenRequest.ExpiresInDays = defaultAPITokenDays
+	}
+
+	if tokenRequest.ExpiresInDays < 0 || tokenRequest.ExpiresInDays > maxAPITokenDays {
+		wh.respondToError(c, &ValidationError{Field: "expires_in_days", Message: fmt.Sprintf("must be between 1 and %v", maxAPITokenDays)})
+		return
+	}
+
+	if len(tokenRequest.Scopes) == 0 {
+		wh.respondToError(c, &ValidationError{Field: "scopes", Message: "must not be empty"})
+		return
+	}
+
+	err = ValidateScopes(tokenRequest.Scopes)
+	if err != nil {
+		wh.respondToError(c, &ValidationError{Field: "scopes", Message: err.Error()})
+		return
+	}
+
+	secret, err := GenerateAPIToken()
+	if err != nil {
+		wh.respondToError(c, err)
+		return
+	}
+
+	user := wh.user(c)
+	token, err := wh.Database.CreateAPIToken(user, APIToken{
+		Name:      tokenRequest.Name,
+		TokenHash: HashAPIToken(secret),
+		Scopes:    strings.Join(tokenRequest.Scopes, ","),
+		ExpiresAt: time.Now().AddDate(0, 0, tokenRequest.ExpiresInDays),
+	})
+	if err != nil {
+		wh.respondToError(c, err)
+		return
+	}
+
+	wh.audit(c, AuditEvent{Action: AuditActionTokenCreate, Actor: user.AuthPlatformUserID, Details: fmt.Sprintf("%v: %v", token.ID, token.Scopes)})
+	log.Printf("Created API token %v for user %v", token.ID, user)
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusCreated, APITokenResponse{Token: secret, APIToken: token})
+}
+
+func (wh *WireguardHandlers) ListAPITokensHandler(c *gin.Context) {
+	tokens, err := wh.Database.APITokens(wh.user(c))
+	if err != nil {
+		wh.respondToError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+func (wh *WireguardHandlers) RevokeAPITokenHandler(c *gin.Context) {
+	user := wh.user(c)
+	tokenID, err := strconv.Atoi(c.Param("token_id"))
+	if err != nil {
+		wh.respondToError(c, &ValidationError{Field: "token_id", Message: "must be an integer"})
+		return
+	}
+
+	err = wh.Database.RevokeAPIToken(user, tokenID)
+	if err != nil {
+		wh.respondToError(c, err)
+		return
+	}
+
+	wh.audit(c, AuditEvent{Action: AuditActionTokenRevoke, Actor: user.AuthPlatformUserID, Details: strconv.Itoa(tokenID)})
+	log.Printf("Revoked API token %v for user %v", tokenID, user)
 	c.AbortWithStatus(http.StatusNoContent)
 }
@@ -4,12 +4,16 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
+	"text/template"
+	"time"
 
 	"github.com/joncooperworks/wgrpcd"
 	"github.com/markbates/goth"
@@ -35,7 +39,7 @@ DNS = ` + testDNSServer + `
 [Peer]
 PublicKey = ` + testServerPublicKey + `
 AllowedIPs = 0.0.0.0/0, ::/0
-Endpoint = ` + testServerName
+Endpoint = ` + testServerName + "\n"
 )
 
 var (
@@ -48,26 +52,109 @@ var (
 	}
 )
 
-type testwgrpcdClient struct{}
+var testEndpoint, _ = url.Parse(testServerName)
 
-func (t *testwgrpcdClient) CreatePeer(ctx context.Context, allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
+const (
+	testRemoteAddr = "192.0.2.10:51820"
+	testUserAgent  = "wireguardhttps-test"
+)
+
+func testTemplates(t *testing.T) map[string]*template.Template {
+	tmpl, err := template.New("peerconfig.tmpl").
+		Funcs(map[string]interface{}{"StringsJoin": strings.Join}).
+		ParseFiles("templates/ini/peerconfig.tmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string]*template.Template{"peer_config": tmpl}
+}
+
+// testwgrpcdClient stands in for wgrpcd.
+// peers is what ListPeers returns, and removedPeers records the public keys passed to RemovePeer.
+// presharedKeys records the preshared key set for each peer's public key.
+type testwgrpcdClient struct {
+	peers          []*wgrpcd.Peer
+	removedPeers   []string
+	listPeersCalls int
+	listPeersErr   error
+	presharedKeys  map[string]string
+	importedPeers  []string
+}
+
+func (t *testwgrpcdClient) CreatePeer(ctx context.Context, deviceName string, allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
 	return testPeerConfigInfo, nil
 }
 
-func (t *testwgrpcdClient) RekeyPeer(ctx context.Context, oldPublicKey wgtypes.Key, allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
-	return nil, nil
+func (t *testwgrpcdClient) RekeyPeer(ctx context.Context, deviceName string, oldPublicKey wgtypes.Key, allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
+	privateKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return &wgrpcd.PeerConfigInfo{
+		PrivateKey:      privateKey.String(),
+		PublicKey:       privateKey.PublicKey().String(),
+		AllowedIPs:      allowedIPs,
+		ServerPublicKey: testServerPublicKey,
+	}, nil
+}
+
+func (t *testwgrpcdClient) ImportPeer(ctx context.Context, deviceName string, publicKey wgtypes.Key, presharedKey *wgtypes.Key, allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
+	t.importedPeers = append(t.importedPeers, publicKey.String())
+	if presharedKey != nil {
+		t.setPresharedKey(publicKey.String(), *presharedKey)
+	}
+
+	return &wgrpcd.PeerConfigInfo{
+		PublicKey:       publicKey.String(),
+		AllowedIPs:      allowedIPs,
+		ServerPublicKey: testServerPublicKey,
+	}, nil
 }
 
-func (t *testwgrpcdClient) ChangeListenPort(ctx context.Context, listenPort int) (int32, error) {
+func (t *testwgrpcdClient) CreatePeerWithPresharedKey(ctx context.Context, deviceName string, presharedKey wgtypes.Key, allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
+	credentials, err := t.CreatePeer(ctx, deviceName, allowedIPs)
+	if err != nil {
+		return nil, err
+	}
+
+	t.setPresharedKey(credentials.PublicKey, presharedKey)
+	return credentials, nil
+}
+
+func (t *testwgrpcdClient) RekeyPeerWithPresharedKey(ctx context.Context, deviceName string, oldPublicKey, presharedKey wgtypes.Key, allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
+	credentials, err := t.RekeyPeer(ctx, deviceName, oldPublicKey, allowedIPs)
+	if err != nil {
+		return nil, err
+	}
+
+	t.setPresharedKey(credentials.PublicKey, presharedKey)
+	return credentials, nil
+}
+
+func (t *testwgrpcdClient) setPresharedKey(publicKey string, presharedKey wgtypes.Key) {
+	if t.presharedKeys == nil {
+		t.presharedKeys = map[string]string{}
+	}
+	t.presharedKeys[publicKey] = presharedKey.String()
+}
+
+func (t *testwgrpcdClient) ChangeListenPort(ctx context.Context, deviceName string, listenPort int) (int32, error) {
 	return int32(listenPort), nil
 }
 
-func (t *testwgrpcdClient) RemovePeer(ctx context.Context, publicKey wgtypes.Key) (bool, error) {
+func (t *testwgrpcdClient) RemovePeer(ctx context.Context, deviceName string, publicKey wgtypes.Key) (bool, error) {
+	t.removedPeers = append(t.removedPeers, publicKey.String())
 	return true, nil
 }
 
-func (t *testwgrpcdClient) ListPeers(ctx context.Context) ([]*wgrpcd.Peer, error) {
-	return []*wgrpcd.Peer{}, nil
+func (t *testwgrpcdClient) ListPeers(ctx context.Context, deviceName string) ([]*wgrpcd.Peer, error) {
+	t.listPeersCalls++
+	if t.listPeersErr != nil {
+		return nil, t.listPeersErr
+	}
+	return t.peers, nil
 }
 
 func (t *testwgrpcdClient) Devices(ctx context.Context) ([]string, error) {
@@ -87,12 +174,12 @@ func TestOnlyWhitelistedAuthProvidersAccepted(t *testing.T) {
 	writer := httptest.NewRecorder()
 
 	urls := []string{
-		"/auth/callback?provider=stripe",
-		"/auth/authenticate?provider=stripe",
-		"/auth/logout?provider=stripe",
-		"/auth/authenticate",
-		"/auth/logout",
-		"/auth/callback",
+		"/api/auth/callback?provider=stripe",
+		"/api/auth/authenticate?provider=stripe",
+		"/api/auth/logout?provider=stripe",
+		"/api/auth/authenticate",
+		"/api/auth/logout",
+		"/api/auth/callback",
 	}
 	for _, url := range urls {
 		request, err := http.NewRequest("GET", url, nil)
@@ -122,8 +209,8 @@ func TestAuthenticatedURLsFailWithoutSession(t *testing.T) {
 	writer := httptest.NewRecorder()
 
 	urls := []string{
-		"/me",
-		"/devices",
+		"/api/me",
+		"/api/devices",
 	}
 
 	for _, url := range urls {
@@ -142,6 +229,9 @@ func TestAuthenticatedURLsFailWithoutSession(t *testing.T) {
 func TestProfileEndpointReturnsCorrectInfo(t *testing.T) {
 	httpHost, _ := url.Parse("localhost")
 	sessionStore := gothic.Store
+	db := testDatabase(t)
+	defer db.Close()
+
 	config := &ServerConfig{
 		AuthProviders: []goth.Provider{
 			azuread.New("key", "secret", "localhost:80/callback", nil),
@@ -150,11 +240,12 @@ func TestProfileEndpointReturnsCorrectInfo(t *testing.T) {
 		IsDebug:      true,
 		SessionStore: sessionStore,
 		SessionName:  "wgsessions",
+		Database:     db,
 	}
 	testRouter := Router(config)
 	writer := httptest.NewRecorder()
 
-	request, err := http.NewRequest("GET", "/me", nil)
+	request, err := http.NewRequest("GET", "/api/me", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -164,9 +255,9 @@ func TestProfileEndpointReturnsCorrectInfo(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	expectedUser := UserProfile{
-		AuthPlatform:       "azuread",
-		AuthPlatformUserID: "jontom@adtenant.com",
+	expectedUser, err := db.RegisterUser("jontom@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
 	}
 	session.Values["user"] = &expectedUser
 	err = session.Save(request, writer)
@@ -219,6 +310,9 @@ func TestCreateDevicesRecordsCorrectInfoInDatabase(t *testing.T) {
 		SessionName:     "wgsessions",
 		Database:        db,
 		WireguardClient: &testwgrpcdClient{},
+		DNSServers:      []net.IP{net.ParseIP(testDNSServer)},
+		Endpoint:        testEndpoint,
+		Templates:       testTemplates(t),
 	}
 	testRouter := Router(config)
 	writer := httptest.NewRecorder()
@@ -229,7 +323,7 @@ func TestCreateDevicesRecordsCorrectInfoInDatabase(t *testing.T) {
 	}
 
 	jsonBody, _ := json.Marshal(deviceRequest)
-	request, err := http.NewRequest("POST", "/devices", bytes.NewReader(jsonBody))
+	request, err := http.NewRequest("POST", "/api/devices", bytes.NewReader(jsonBody))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -239,9 +333,9 @@ func TestCreateDevicesRecordsCorrectInfoInDatabase(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	expectedUser := UserProfile{
-		AuthPlatform:       "azuread",
-		AuthPlatformUserID: "jontom@adtenant.com",
+	expectedUser, err := db.RegisterUser("jontom@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
 	}
 	session.Values["user"] = &expectedUser
 	err = session.Save(request, writer)
@@ -257,7 +351,494 @@ func TestCreateDevicesRecordsCorrectInfoInDatabase(t *testing.T) {
 
 	actualPeerConfig, _ := ioutil.ReadAll(writer.Body)
 	if expectedPeerConfig != string(actualPeerConfig) {
-		t.Fatalf("Expected:\n%v\nGot:\n%v", expectedPeerConfig, actualPeerConfig)
+		t.Fatalf("Expected:\n%v\nGot:\n%v", expectedPeerConfig, string(actualPeerConfig))
+	}
+
+}
+
+// serveAsUser serves a request from user's session, sending body as JSON if it isn't nil.
+func serveAsUser(t *testing.T, config *ServerConfig, user *UserProfile, method, url string, body interface{}) *httptest.ResponseRecorder {
+	testRouter := Router(config)
+	writer := httptest.NewRecorder()
+	jsonBody := []byte{}
+	if body != nil {
+		jsonBody, _ = json.Marshal(body)
+	}
+
+	request, err := http.NewRequest(method, url, bytes.NewReader(jsonBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.RemoteAddr = testRemoteAddr
+	request.Header.Set("User-Agent", testUserAgent)
+
+	session, err := config.SessionStore.Get(request, config.SessionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session.Values["user"] = user
+	err = session.Save(request, writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testRouter.ServeHTTP(writer, request)
+	return writer
+}
+
+// testServerConfig serves requests for users in db with the fake wgrpcd client and the peer_config template.
+func testServerConfig(t *testing.T, db Database) *ServerConfig {
+	httpHost, _ := url.Parse("localhost")
+	return &ServerConfig{
+		AuthProviders: []goth.Provider{
+			azuread.New("key", "secret", "localhost:80/callback", nil),
+		},
+		HTTPHost:        httpHost,
+		IsDebug:         true,
+		SessionStore:    gothic.Store,
+		SessionName:     "wgsessions",
+		Database:        db,
+		WireguardClient: &testwgrpcdClient{},
+		DNSServers:      []net.IP{net.ParseIP(testDNSServer)},
+		Endpoint:        testEndpoint,
+		Templates:       testTemplates(t),
+	}
+}
+
+func TestAdminCanSearchAndRevokeAnyDevice(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	err := db.RegisterSubnet(mustParseCIDR("10.0.0.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owner, err := db.RegisterUser("jontom@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin, err := db.RegisterUser("admin@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin, err = db.SetAdmin(admin.AuthPlatform, admin.AuthPlatformUserID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privateKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicKey := privateKey.PublicKey().String()
+	deviceFunc := func(allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
+		return &wgrpcd.PeerConfigInfo{PublicKey: publicKey, AllowedIPs: allowedIPs}, nil
+	}
+	device, _, err := db.CreateDevice(owner, nil, Device{Name: "Stolen Laptop", OS: "Windows"}, nil, deviceFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := testServerConfig(t, db)
+
+	writer := serveAsUser(t, config, &owner, "GET", "/api/admin/devices", nil)
+	if writer.Code != 403 {
+		t.Fatalf("Expected status code 403 for non-admin, got %v", writer.Code)
+	}
+
+	writer = serveAsUser(t, config, &admin, "GET", "/api/admin/devices?search="+url.QueryEscape(publicKey), nil)
+	if writer.Code != 200 {
+		t.Fatalf("Expected status code 200 for admin, got %v", writer.Code)
+	}
+
+	var devices []Device
+	err = json.NewDecoder(writer.Body).Decode(&devices)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(devices) != 1 || devices[0].ID != device.ID {
+		t.Fatalf("Expected %v, got %v", device, devices)
+	}
+
+	writer = serveAsUser(t, config, &admin, "DELETE", fmt.Sprintf("/api/admin/devices/%v", device.ID), nil)
+	if writer.Code != 204 {
+		t.Fatalf("Expected status code 204 for revocation, got %v", writer.Code)
+	}
+
+	devices, err = db.Devices(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(devices) != 0 {
+		t.Fatalf("Expected device to be revoked, got %v", devices)
+	}
+}
+
+func TestDeletedUsersSessionIsRejected(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	err := db.RegisterSubnet(mustParseCIDR("10.0.0.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.RegisterUser("leaver@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := testServerConfig(t, db)
+	err = db.DeleteUser(int(user.ID), func(device Device) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer := serveAsUser(t, config, &user, "POST", "/api/devices", DeviceRequest{Name: "Laptop", OS: "Linux"})
+	if writer.Code != 401 {
+		t.Fatalf("Expected status code 401 for a deleted user's session, got %v", writer.Code)
+	}
+
+	_, err = db.GetUser(int(user.ID))
+	if _, ok := err.(*RecordNotFoundError); !ok {
+		t.Fatalf("Expected deleted user to stay deleted, got %v", err)
+	}
+}
+
+func TestDeviceListIncludesCachedPeerStatus(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	err := db.RegisterSubnet(mustParseCIDR("10.0.0.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.RegisterUser("jontom@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connectedKey := mustGenerateKey(t)
+	neverConnectedKey := mustGenerateKey(t)
+	for _, key := range []string{connectedKey, neverConnectedKey} {
+		deviceFunc := func(allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
+			return &wgrpcd.PeerConfigInfo{PublicKey: key, AllowedIPs: allowedIPs}, nil
+		}
+		_, _, err = db.CreateDevice(user, nil, Device{Name: key, OS: "Linux"}, nil, deviceFunc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lastSeen := time.Date(2020, 12, 8, 4, 31, 29, 0, time.UTC)
+	client := &testwgrpcdClient{
+		peers: []*wgrpcd.Peer{
+			{PublicKey: connectedKey, ReceivedBytes: 1024, TransmittedBytes: 2048, LastSeen: lastSeen.Unix()},
+			{PublicKey: neverConnectedKey, LastSeen: time.Time{}.Unix()},
+		},
+	}
+	config := testServerConfig(t, db)
+	config.WireguardClient = client
+
+	writer := serveAsUser(t, config, &user, "GET", "/api/devices", nil)
+	if writer.Code != 200 {
+		t.Fatalf("Expected status code 200 for /devices, got %v", writer.Code)
+	}
+
+	var devices []DeviceResponse
+	err = json.NewDecoder(writer.Body).Decode(&devices)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(devices) != 2 {
+		t.Fatalf("Expected 2 devices, got %v", devices)
+	}
+
+	connected := devices[0].Status
+	if connected == nil || connected.ReceivedBytes != 1024 || connected.TransmittedBytes != 2048 || !connected.LastHandshake.Equal(lastSeen) {
+		t.Fatalf("Expected status of %v to be merged in, got %v", connectedKey, connected)
 	}
 
+	if devices[1].Status == nil || devices[1].Status.LastHandshake != nil {
+		t.Fatalf("Expected %v to have no handshake, got %v", neverConnectedKey, devices[1].Status)
+	}
+
+	writer = serveAsUser(t, config, &user, "GET", fmt.Sprintf("/api/devices/%v", devices[0].ID), nil)
+	if writer.Code != 200 {
+		t.Fatalf("Expected status code 200 for /devices/%v, got %v", devices[0].ID, writer.Code)
+	}
+}
+
+func TestNewDeviceWithClientGeneratedKey(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	err := db.RegisterSubnet(mustParseCIDR("10.0.0.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.RegisterUser("jontom@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := testServerConfig(t, db)
+
+	writer := serveAsUser(t, config, &user, "POST", "/api/devices", DeviceRequest{Name: "iPhone", OS: "iOS", PublicKey: "not a key"})
+	if writer.Code != 400 {
+		t.Fatalf("Expected status code 400 for invalid public key, got %v", writer.Code)
+	}
+
+	publicKey := mustGenerateKey(t)
+	writer = serveAsUser(t, config, &user, "POST", "/api/devices", DeviceRequest{Name: "iPhone", OS: "iOS", PublicKey: publicKey})
+	if writer.Code != 200 {
+		t.Fatalf("Expected status code 200 for /devices, got %v", writer.Code)
+	}
+
+	expectedPrivateKeyLine := "PrivateKey = " + ClientPrivateKeyPlaceholder + "\n"
+	if !strings.Contains(writer.Body.String(), expectedPrivateKeyLine) {
+		t.Fatalf("Expected config with private key placeholder, got:\n%v", writer.Body.String())
+	}
+
+	devices, err := db.Devices(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(devices) != 1 || devices[0].PublicKey != publicKey || !devices[0].ClientGeneratedKey {
+		t.Fatalf("Expected device with client generated public key %v, got %v", publicKey, devices)
+	}
+
+	// Rekeying must not fall back to generating a private key on the server.
+	rekeyURL := fmt.Sprintf("/api/devices/%v", devices[0].ID)
+	for _, rekeyRequest := range []interface{}{nil, RekeyRequest{PublicKey: publicKey}} {
+		writer = serveAsUser(t, config, &user, "POST", rekeyURL, rekeyRequest)
+		if writer.Code != 400 {
+			t.Fatalf("Expected status code 400 for rekey with %v, got %v", rekeyRequest, writer.Code)
+		}
+	}
+
+	newPublicKey := mustGenerateKey(t)
+	writer = serveAsUser(t, config, &user, "POST", rekeyURL, RekeyRequest{PublicKey: newPublicKey})
+	if writer.Code != 200 || !strings.Contains(writer.Body.String(), expectedPrivateKeyLine) {
+		t.Fatalf("Expected status code 200 with a private key placeholder for rekey, got %v %v", writer.Code, writer.Body.String())
+	}
+
+	client := config.WireguardClient.(*testwgrpcdClient)
+	if len(client.removedPeers) != 1 || client.removedPeers[0] != publicKey {
+		t.Fatalf("Expected the replaced peer %v to be removed, got %v", publicKey, client.removedPeers)
+	}
+
+	device, err := db.Device(user, int(devices[0].ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if device.PublicKey != newPublicKey || !device.ClientGeneratedKey {
+		t.Fatalf("Expected device to have the new client generated key %v, got %v", newPublicKey, device.PublicKey)
+	}
+
+	// Importing a key that's in use would reconfigure the other device's peer, so it must be rejected before wgrpcd is called.
+	importedPeers := len(client.importedPeers)
+	writer = serveAsUser(t, config, &user, "POST", "/api/devices", DeviceRequest{Name: "iPad", OS: "iOS", PublicKey: newPublicKey})
+	if writer.Code != 400 || !strings.Contains(writer.Body.String(), "already used") {
+		t.Fatalf("Expected status code 400 for a public key in use, got %v %v", writer.Code, writer.Body.String())
+	}
+
+	otherDevice, _, err := db.CreateDevice(user, nil, Device{Name: "Laptop", OS: "Linux", ClientGeneratedKey: true}, nil, func(allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
+		return &wgrpcd.PeerConfigInfo{PublicKey: mustGenerateKey(t), AllowedIPs: allowedIPs}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer = serveAsUser(t, config, &user, "POST", fmt.Sprintf("/api/devices/%v", otherDevice.ID), RekeyRequest{PublicKey: newPublicKey})
+	if writer.Code != 400 || len(client.importedPeers) != importedPeers {
+		t.Fatalf("Expected status code 400 without importing a public key in use, got %v and imports %v", writer.Code, client.importedPeers)
+	}
+
+	// Clients that can't import keys should reject the request rather than silently generating one.
+	config.WireguardClient = &struct{ WireguardClient }{&testwgrpcdClient{}}
+	writer = serveAsUser(t, config, &user, "POST", "/api/devices", DeviceRequest{Name: "iPad", OS: "iOS", PublicKey: mustGenerateKey(t)})
+	if writer.Code != 501 {
+		t.Fatalf("Expected status code 501 without key import support, got %v", writer.Code)
+	}
+}
+
+func TestNewDeviceWithPresharedKey(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	err := db.RegisterSubnet(mustParseCIDR("10.0.0.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.RegisterUser("jontom@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &testwgrpcdClient{}
+	config := testServerConfig(t, db)
+	config.WireguardClient = client
+
+	publicKey := mustGenerateKey(t)
+	writer := serveAsUser(t, config, &user, "POST", "/api/devices", DeviceRequest{Name: "iPhone", OS: "iOS", PublicKey: publicKey, PresharedKey: true})
+	if writer.Code != 200 {
+		t.Fatalf("Expected status code 200 for /devices, got %v", writer.Code)
+	}
+
+	presharedKey, ok := client.presharedKeys[publicKey]
+	if !ok {
+		t.Fatalf("Expected preshared key to be set for %v", publicKey)
+	}
+
+	expectedPresharedKeyLine := "PresharedKey = " + presharedKey + "\n"
+	if !strings.Contains(writer.Body.String(), expectedPresharedKeyLine) {
+		t.Fatalf("Expected config with preshared key, got:\n%v", writer.Body.String())
+	}
+
+	devices, err := db.Devices(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(devices) != 1 || !devices[0].HasPresharedKey {
+		t.Fatalf("Expected device to be recorded as having a preshared key, got %v", devices)
+	}
+
+	// Devices without a preshared key get a config without the PresharedKey line.
+	writer = serveAsUser(t, config, &user, "POST", "/api/devices", DeviceRequest{Name: "iPad", OS: "iOS", PublicKey: mustGenerateKey(t)})
+	if writer.Code != 200 {
+		t.Fatalf("Expected status code 200 for /devices, got %v", writer.Code)
+	}
+
+	if strings.Contains(writer.Body.String(), "PresharedKey") {
+		t.Fatalf("Expected config without preshared key, got:\n%v", writer.Body.String())
+	}
+
+	// Server generated keys get their preshared key in the same wgrpcd call that creates or rekeys the peer.
+	writer = serveAsUser(t, config, &user, "POST", "/api/devices", DeviceRequest{Name: "Laptop", OS: "Linux", PresharedKey: true})
+	if writer.Code != 200 || !strings.Contains(writer.Body.String(), "PresharedKey = "+client.presharedKeys[testPublicKey]+"\n") {
+		t.Fatalf("Expected status code 200 with the laptop's preshared key, got %v %v", writer.Code, writer.Body.String())
+	}
+
+	deviceFunc := func(allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
+		return &wgrpcd.PeerConfigInfo{PublicKey: mustGenerateKey(t), AllowedIPs: allowedIPs}, nil
+	}
+	server, _, err := db.CreateDevice(user, nil, Device{Name: "Server", OS: "Linux", HasPresharedKey: true}, nil, deviceFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer = serveAsUser(t, config, &user, "POST", fmt.Sprintf("/api/devices/%v", server.ID), nil)
+	if writer.Code != 200 {
+		t.Fatalf("Expected status code 200 for rekey, got %v", writer.Code)
+	}
+
+	server, err = db.FindDevice(int(server.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rekeyedPresharedKey, ok := client.presharedKeys[server.PublicKey]
+	if !ok || !strings.Contains(writer.Body.String(), "PresharedKey = "+rekeyedPresharedKey+"\n") {
+		t.Fatalf("Expected rekeyed config with a new preshared key, got:\n%v", writer.Body.String())
+	}
+
+	config.WireguardClient = &struct {
+		WireguardClient
+		PeerImporter
+	}{client, client}
+	writer = serveAsUser(t, config, &user, "POST", "/api/devices", DeviceRequest{Name: "Desktop", OS: "Linux", PresharedKey: true})
+	if writer.Code != 501 {
+		t.Fatalf("Expected status code 501 without preshared key support, got %v", writer.Code)
+	}
+}
+
+func TestRoutingProfilesAreRenderedAndKeptOnRekey(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	err := db.RegisterSubnet(mustParseCIDR("10.0.0.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.RegisterUser("jontom@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin, err := db.RegisterUser("admin@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin, err = db.SetAdmin(admin.AuthPlatform, admin.AuthPlatformUserID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := testServerConfig(t, db)
+
+	profileRequest := RoutingProfileRequest{AllowedIPs: []string{"10.0.0.0/8", "192.168.0.0/16"}}
+	writer := serveAsUser(t, config, &user, "PUT", "/api/admin/routing-profiles/internal", profileRequest)
+	if writer.Code != 403 {
+		t.Fatalf("Expected status code 403 for non-admin, got %v", writer.Code)
+	}
+
+	writer = serveAsUser(t, config, &admin, "PUT", "/api/admin/routing-profiles/internal", RoutingProfileRequest{AllowedIPs: []string{"not a network"}})
+	if writer.Code != 400 {
+		t.Fatalf("Expected status code 400 for invalid routes, got %v", writer.Code)
+	}
+
+	writer = serveAsUser(t, config, &admin, "PUT", "/api/admin/routing-profiles/internal", profileRequest)
+	if writer.Code != 200 {
+		t.Fatalf("Expected status code 200 for /admin/routing-profiles, got %v", writer.Code)
+	}
+
+	writer = serveAsUser(t, config, &user, "POST", "/api/devices", DeviceRequest{Name: "iPhone", OS: "iOS", RoutingProfile: "missing"})
+	if writer.Code != 404 {
+		t.Fatalf("Expected status code 404 for unknown routing profile, got %v", writer.Code)
+	}
+
+	writer = serveAsUser(t, config, &user, "POST", "/api/devices", DeviceRequest{Name: "iPhone", OS: "iOS", PublicKey: mustGenerateKey(t), RoutingProfile: "internal"})
+	if writer.Code != 200 {
+		t.Fatalf("Expected status code 200 for /devices, got %v", writer.Code)
+	}
+
+	expectedAllowedIPsLine := "AllowedIPs = 10.0.0.0/8, 192.168.0.0/16\n"
+	if !strings.Contains(writer.Body.String(), expectedAllowedIPsLine) {
+		t.Fatalf("Expected config with routing profile routes, got:\n%v", writer.Body.String())
+	}
+
+	devices, err := db.Devices(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(devices) != 1 || devices[0].RoutingProfile == nil || devices[0].RoutingProfile.Name != "internal" {
+		t.Fatalf("Expected device with routing profile internal, got %v", devices)
+	}
+
+	writer = serveAsUser(t, config, &user, "POST", fmt.Sprintf("/api/devices/%v", devices[0].ID), RekeyRequest{PublicKey: mustGenerateKey(t)})
+	if writer.Code != 200 {
+		t.Fatalf("Expected status code 200 for rekey, got %v", writer.Code)
+	}
+
+	if !strings.Contains(writer.Body.String(), expectedAllowedIPsLine) {
+		t.Fatalf("Expected rekeyed config to keep routing profile routes, got:\n%v", writer.Body.String())
+	}
 }
@@ -1,15 +1,85 @@
 package wireguardhttps
 
+import "time"
+
 type DeviceRequest struct {
 	Name string `json:"name"`
 	OS   string `json:"os"`
+	Pool string `json:"pool"`
+	// PublicKey is set by clients that generate their own Wireguard keys, so the server never sees their private key.
+	PublicKey string `json:"public_key"`
+	// PresharedKey asks for a preshared key to be mixed into the handshake as a hedge against future quantum attacks.
+	PresharedKey bool `json:"preshared_key"`
+	// RoutingProfile names the admin defined RoutingProfile whose routes the client sends through the tunnel.
+	RoutingProfile string `json:"routing_profile"`
+	// ExpiresInDays asks for the device to expire sooner than the owner's device lifetime policy requires.
+	ExpiresInDays int `json:"expires_in_days"`
+	// DownloadLink asks for a one-time link to the config instead of the config itself, so it can be fetched on another device.
+	DownloadLink bool `json:"download_link"`
+}
+
+// RekeyRequest is the optional body of a rekey request.
+// PublicKey replaces the device's key with one the client generated, and is required for devices created with a client generated key.
+type RekeyRequest struct {
+	PublicKey string `json:"public_key"`
+}
+
+// RoutingProfileRequest defines a routing profile's routes in CIDR notation.
+type RoutingProfileRequest struct {
+	AllowedIPs []string `json:"allowed_ips"`
+}
+
+// APITokenRequest asks for a new API token that expires after ExpiresInDays.
+type APITokenRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expires_in_days"`
 }
 
+// APITokenResponse contains a newly minted API token.
+// Token is only ever shown in this response.
+type APITokenResponse struct {
+	Token    string   `json:"token"`
+	APIToken APIToken `json:"api_token"`
+}
+
+// ConfigDownloadResponse is returned instead of the config when a device is created with a download link.
+// URL works once, without logging in, until ExpiresAt.
+type ConfigDownloadResponse struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+	DeviceID  uint      `json:"device_id"`
+}
+
+// PeerConfigINI is the data every client config format is rendered from.
+// Its JSON form is the json config format.
 type PeerConfigINI struct {
-	PublicKey  string
-	PrivateKey string
-	AllowedIPs []string
-	Addresses  []string
-	DNSServers []string
-	ServerName string
+	PublicKey    string   `json:"public_key"`
+	PrivateKey   string   `json:"private_key"`
+	PresharedKey string   `json:"preshared_key,omitempty"`
+	AllowedIPs   []string `json:"allowed_ips"`
+	Addresses    []string `json:"addresses"`
+	DNSServers   []string `json:"dns_servers"`
+	ServerName   string   `json:"endpoint"`
+}
+
+// DeviceStatus is a device's live state on the Wireguard interface.
+// wgrpcd doesn't report peer endpoints, so the device's current endpoint isn't included.
+type DeviceStatus struct {
+	LastHandshake    *time.Time `json:"last_handshake"`
+	ReceivedBytes    int64      `json:"received_bytes"`
+	TransmittedBytes int64      `json:"transmitted_bytes"`
+}
+
+// DeviceResponse is a device merged with its live status.
+// Status is null if the device isn't configured on the Wireguard interface or wgrpcd couldn't be reached.
+// ExpiresIn is the number of seconds until the device is revoked, and is null if it never expires.
+// KeyRotationDueIn is the number of seconds until the device is disabled for having a stale key, and is null if there is no maximum key age.
+// KeyRotationWarning is set once the device is within the server's warning period of being disabled.
+type DeviceResponse struct {
+	Device
+	Status             *DeviceStatus `json:"status"`
+	ExpiresIn          *int64        `json:"expires_in"`
+	KeyRotationDueIn   *int64        `json:"key_rotation_due_in"`
+	KeyRotationWarning bool          `json:"key_rotation_warning"`
 }
@@ -1,7 +1,6 @@
 package wireguardhttps
 
 import (
-	"encoding/binary"
 	"fmt"
 	"net"
 )
@@ -23,13 +22,45 @@ func (i *IPsExhaustedError) Error() string {
 	return fmt.Sprintf("%v is out of IP addresses", i.Network)
 }
 
+// NoIPv4SubnetError is returned when a device is created in a pool that only has IPv6 subnets.
+// Every device needs an IPv4 address, so the pool can't be used until an IPv4 subnet is added to it.
+type NoIPv4SubnetError struct {
+	Pool string
+}
+
+func (n *NoIPv4SubnetError) Error() string {
+	return fmt.Sprintf("pool %v has no IPv4 subnet", n.Pool)
+}
+
 // AddressRange provides methods for assigning IP addresses within a subnet.
+// Both IPv4 and IPv6 subnets are supported.
 type AddressRange struct {
 	Network net.IPNet
 }
 
+// IsIPv6 reports whether the range is an IPv6 subnet.
+func (a *AddressRange) IsIPv6() bool {
+	return a.Network.IP.To4() == nil
+}
+
+// normalize returns ip in the 4 or 16 byte form matching the range's address family.
+func (a *AddressRange) normalize(ip net.IP) net.IP {
+	if a.IsIPv6() {
+		return ip.To16()
+	}
+	return ip.To4()
+}
+
+func (a *AddressRange) mask() net.IPMask {
+	mask := a.Network.Mask
+	if !a.IsIPv6() && len(mask) == net.IPv6len {
+		return mask[12:]
+	}
+	return mask
+}
+
 func (a *AddressRange) Start() net.IP {
-	return a.Network.IP
+	return a.normalize(a.Network.IP).Mask(a.mask())
 }
 
 // Next returns the next IP address within a subnet given the last IP address.
@@ -49,31 +80,70 @@ func (a *AddressRange) Next(current net.IP) (net.IP, error) {
 		}
 	}
 
-	ip := make(net.IP, 4)
-	next := binary.BigEndian.Uint32(current) + 1
-	binary.BigEndian.PutUint32(ip, next)
+	ip := make(net.IP, len(a.Start()))
+	copy(ip, a.normalize(current))
+	for i := len(ip) - 1; i >= 0; i-- {
+		ip[i]++
+		if ip[i] != 0 {
+			break
+		}
+	}
 	return ip, nil
 }
 
 // Addresses returns all IP addresses within a CIDR.
+// This is only practical for small subnets; IPv6 subnets should be allocated on demand with NextFree instead.
 func (a *AddressRange) Addresses() []net.IP {
-	addresses := []net.IP{}
-	start := binary.BigEndian.Uint32(a.Start())
-	finish := binary.BigEndian.Uint32(a.Finish())
-	// Don't allocate the VPN server's IP address to client devices
-	for i := start + 1; i <= finish; i++ {
-		ip := make(net.IP, 4)
-		binary.BigEndian.PutUint32(ip, i)
-		addresses = append(addresses, ip)
+	addresses := []net.IP{a.Start()}
+	for current := a.Start(); ; {
+		next, err := a.Next(current)
+		if err != nil {
+			return addresses
+		}
+		addresses = append(addresses, next)
+		current = next
 	}
-	return addresses
 }
 
 func (a *AddressRange) Finish() net.IP {
-	mask := binary.BigEndian.Uint32(a.Network.Mask)
-	start := binary.BigEndian.Uint32(a.Start())
-	finish := (start & mask) | (mask ^ 0xffffffff)
-	ip := make(net.IP, 4)
-	binary.BigEndian.PutUint32(ip, finish)
+	mask := a.mask()
+	start := a.Start()
+	ip := make(net.IP, len(start))
+	for i := range start {
+		ip[i] = start[i] | ^mask[i]
+	}
 	return ip
 }
+
+// Overlaps reports whether any address in network is also in the range.
+func (a *AddressRange) Overlaps(network net.IPNet) bool {
+	return a.Network.Contains(network.IP) || network.Contains(a.Network.IP)
+}
+
+// IsReserved reports whether ip must never be assigned to a client device.
+// The network address and the first host address, which belongs to the Wireguard server, are reserved in every subnet, as is the broadcast address in IPv4 subnets.
+func (a *AddressRange) IsReserved(ip net.IP) bool {
+	if ip.Equal(a.Start()) || (!a.IsIPv6() && ip.Equal(a.Finish())) {
+		return true
+	}
+
+	server, err := a.Next(a.Start())
+	return err == nil && ip.Equal(server)
+}
+
+// NextFree returns the lowest unreserved address in the range that isn't in assigned.
+// assigned is keyed by the string form of each address already in use.
+// This lets large subnets be allocated on demand without storing every address up front.
+func (a *AddressRange) NextFree(assigned map[string]bool) (net.IP, error) {
+	for current := a.Start(); ; {
+		if !a.IsReserved(current) && !assigned[current.String()] {
+			return current, nil
+		}
+
+		next, err := a.Next(current)
+		if err != nil {
+			return nil, err
+		}
+		current = next
+	}
+}
@@ -87,6 +87,58 @@ func TestErrorReturnedEndOfSubnet(t *testing.T) {
 	}
 }
 
+func TestIPv6AddressRangeStartAndFinish(t *testing.T) {
+	network := mustParseCIDR("fd00::/64")
+	addressRange := &AddressRange{network}
+	expectedStart := net.ParseIP("fd00::")
+	if !addressRange.Start().Equal(expectedStart) {
+		t.Fatalf("Expected %v, got %v", expectedStart, addressRange.Start())
+	}
+
+	expectedFinish := net.ParseIP("fd00::ffff:ffff:ffff:ffff")
+	if !addressRange.Finish().Equal(expectedFinish) {
+		t.Fatalf("Expected %v, got %v", expectedFinish, addressRange.Finish())
+	}
+}
+
+func TestIPv6NextAddressCarries(t *testing.T) {
+	network := mustParseCIDR("fd00::/64")
+	addressRange := &AddressRange{network}
+	expectedNext := net.ParseIP("fd00::1:0")
+	actualNext, err := addressRange.Next(net.ParseIP("fd00::ffff"))
+	if err != nil {
+		t.Fatalf("Error getting next IP: %v", err)
+	}
+
+	if !actualNext.Equal(expectedNext) {
+		t.Fatalf("Expected %v, got %v", expectedNext, actualNext)
+	}
+}
+
+func TestNextFreeSkipsReservedAndAssignedAddresses(t *testing.T) {
+	network := mustParseCIDR("fd00::/64")
+	addressRange := &AddressRange{network}
+	assigned := map[string]bool{"fd00::2": true}
+	expectedFree := net.ParseIP("fd00::3")
+	actualFree, err := addressRange.NextFree(assigned)
+	if err != nil {
+		t.Fatalf("Error getting free IP: %v", err)
+	}
+
+	if !actualFree.Equal(expectedFree) {
+		t.Fatalf("Expected %v, got %v", expectedFree, actualFree)
+	}
+}
+
+func TestNextFreeErrorsWhenIPv4SubnetFull(t *testing.T) {
+	network := mustParseCIDR("10.0.0.0/30")
+	addressRange := &AddressRange{network}
+	_, err := addressRange.NextFree(map[string]bool{"10.0.0.2": true})
+	if _, ok := err.(*IPsExhaustedError); !ok {
+		t.Fatalf("Expected IPsExhaustedError, got %v", err)
+	}
+}
+
 func mustParseCIDR(cidr string) net.IPNet {
 	_, network, err := net.ParseCIDR(cidr)
 	if err != nil {
@@ -0,0 +1,63 @@
+package wireguardhttps
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// KeyRotationEnforcer disables devices whose keys are older than MaxKeyAge.
+// Disabled devices are removed from the Wireguard interface but keep their records and addresses, and are enabled again when their owner rekeys them.
+// Disabled devices are sent to WebhookDispatcher's webhooks.
+type KeyRotationEnforcer struct {
+	Database            Database
+	WireguardClient     WireguardClient
+	WireguardDeviceName string
+	MaxKeyAge           time.Duration
+	WebhookDispatcher   *WebhookDispatcher
+}
+
+// DisableStale disables every device whose key is older than MaxKeyAge at now and returns them.
+// Devices that can't be disabled are skipped and their errors returned together in a *BatchError.
+func (k *KeyRotationEnforcer) DisableStale(now time.Time) ([]Device, error) {
+	devices, err := k.Database.StaleDevices(now.Add(-k.MaxKeyAge))
+	if err != nil {
+		return nil, err
+	}
+
+	removePeer := RemovePeer(k.WireguardClient, k.WireguardDeviceName)
+	disabled := []Device{}
+	errs := []error{}
+	for _, device := range devices {
+		device := device
+		disabledDevice, err := k.Database.DisableDevice(device, func() error { return removePeer(device) })
+		if err != nil {
+			log.Printf("Failed to disable device %v: %v", device.ID, err)
+			errs = append(errs, err)
+			continue
+		}
+		device = disabledDevice
+		PublishAuditEvent(k.Database, k.WebhookDispatcher, AuditEvent{Action: AuditActionDeviceDisable, Actor: SystemActor, Subject: device.Owner.AuthPlatformUserID, DeviceID: &device.ID, Details: device.Name})
+		log.Printf("Disabled device %v for user %v until its key is rotated", device.ID, device.Owner.AuthPlatformUserID)
+		disabled = append(disabled, device)
+	}
+	return disabled, batchError(errs)
+}
+
+// Run disables stale devices every interval until ctx is cancelled.
+func (k *KeyRotationEnforcer) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			_, err := k.DisableStale(now)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package wireguardhttps
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/joncooperworks/wgrpcd"
+)
+
+func TestKeyRotationEnforcerDisablesStaleDevicesUntilRekeyed(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	err := db.RegisterSubnet(mustParseCIDR("10.0.0.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.RegisterUser("jontom@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicKey := mustGenerateKey(t)
+	deviceFunc := func(allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
+		return &wgrpcd.PeerConfigInfo{PublicKey: publicKey, AllowedIPs: allowedIPs}, nil
+	}
+	device, _, err := db.CreateDevice(user, nil, Device{Name: "Laptop", OS: "Linux"}, nil, deviceFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	maxKeyAge := 90 * 24 * time.Hour
+	client := &testwgrpcdClient{}
+	enforcer := &KeyRotationEnforcer{
+		Database:            db,
+		WireguardClient:     client,
+		WireguardDeviceName: "wg0",
+		MaxKeyAge:           maxKeyAge,
+	}
+
+	disabled, err := enforcer.DisableStale(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(disabled) != 0 {
+		t.Fatalf("Expected no devices to be disabled with fresh keys, got %v", disabled)
+	}
+
+	disabled, err = enforcer.DisableStale(time.Now().Add(maxKeyAge + time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(disabled) != 1 || len(client.removedPeers) != 1 || client.removedPeers[0] != publicKey {
+		t.Fatalf("Expected %v to be disabled and removed from the interface, got %v", publicKey, client.removedPeers)
+	}
+
+	device, err = db.Device(user, int(device.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if device.DisabledAt == nil {
+		t.Fatal("Expected disabled device record to be kept with DisabledAt set")
+	}
+
+	reconciler := &Reconciler{Database: db, WireguardClient: client, WireguardDeviceName: "wg0"}
+	report, err := reconciler.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.MissingPeers) != 0 {
+		t.Fatalf("Expected disabled devices not to be reported missing, got %v", report.MissingPeers)
+	}
+
+	config := testServerConfig(t, db)
+	config.WireguardClient = client
+	config.MaxKeyAge = maxKeyAge
+	config.KeyRotationWarning = maxKeyAge + time.Hour
+
+	writer := serveAsUser(t, config, &user, "GET", fmt.Sprintf("/api/devices/%v", device.ID), nil)
+	if writer.Code != 200 {
+		t.Fatalf("Expected status code 200 for /devices/%v, got %v", device.ID, writer.Code)
+	}
+
+	var response DeviceResponse
+	err = json.NewDecoder(writer.Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.KeyRotationDueIn == nil || !response.KeyRotationWarning {
+		t.Fatalf("Expected key rotation warning, got %v", response)
+	}
+
+	writer = serveAsUser(t, config, &user, "POST", fmt.Sprintf("/api/devices/%v", device.ID), nil)
+	if writer.Code != 200 {
+		t.Fatalf("Expected status code 200 for rekey, got %v", writer.Code)
+	}
+
+	device, err = db.Device(user, int(device.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if device.DisabledAt != nil || device.PublicKey != testPublicKey {
+		t.Fatalf("Expected rekey to re-enable the device with a new peer, got %v", device)
+	}
+}
@@ -0,0 +1,107 @@
+package wireguardhttps
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/markbates/goth"
+)
+
+// LoginPolicy restricts which users of a login provider may register.
+// A user is allowed if any of their ID token's groups or roles, or their email domain, is on one of the lists.
+// Email domains are only checked when the ID token's email_verified claim is true, unless VerifiedEmailClaim is set.
+// A policy with empty lists allows everyone who completes the provider's login flow.
+// Groups and roles are read from the ID token claims, which only OpenID Connect providers expose in goth.User.RawData.
+type LoginPolicy struct {
+	GroupsClaim         string
+	RolesClaim          string
+	AllowedGroups       []string
+	AllowedRoles        []string
+	AllowedEmailDomains []string
+	// VerifiedEmailClaim names a claim holding an address whose domain the provider has verified, checked against AllowedEmailDomains instead of the email.
+	// Azure AD doesn't send email_verified, but a user's userPrincipalName must be on a domain the tenant has verified.
+	VerifiedEmailClaim string
+}
+
+// LoginDeniedError is returned when a user doesn't satisfy their provider's LoginPolicy.
+type LoginDeniedError struct {
+	Provider string
+	UserID   string
+}
+
+func (l *LoginDeniedError) Error() string {
+	return fmt.Sprintf("%v user %v is not in an allowed group, role or email domain", l.Provider, l.UserID)
+}
+
+func (l *LoginPolicy) isRestricted() bool {
+	return len(l.AllowedGroups) > 0 || len(l.AllowedRoles) > 0 || len(l.AllowedEmailDomains) > 0
+}
+
+// Authorize checks user against the policy and returns the claim that allowed them in, such as "group:engineering", so admins can see why a user has access.
+func (l *LoginPolicy) Authorize(user goth.User) (string, error) {
+	if !l.isRestricted() {
+		return "unrestricted", nil
+	}
+
+	groupsClaim := l.GroupsClaim
+	if groupsClaim == "" {
+		groupsClaim = "groups"
+	}
+
+	rolesClaim := l.RolesClaim
+	if rolesClaim == "" {
+		rolesClaim = "roles"
+	}
+
+	if group, ok := matchClaim(user.RawData[groupsClaim], l.AllowedGroups); ok {
+		return "group:" + group, nil
+	}
+
+	if role, ok := matchClaim(user.RawData[rolesClaim], l.AllowedRoles); ok {
+		return "role:" + role, nil
+	}
+
+	// Many providers let users set an email address without proving they own it, so only verified addresses count.
+	email := user.Email
+	verified, _ := user.RawData["email_verified"].(bool)
+	if l.VerifiedEmailClaim != "" {
+		email, verified = user.RawData[l.VerifiedEmailClaim].(string)
+	}
+
+	if at := strings.LastIndex(email, "@"); verified && at != -1 {
+		domain := strings.ToLower(email[at+1:])
+		for _, allowed := range l.AllowedEmailDomains {
+			if domain == strings.ToLower(allowed) {
+				return "email_domain:" + domain, nil
+			}
+		}
+	}
+
+	return "", &LoginDeniedError{Provider: user.Provider, UserID: user.UserID}
+}
+
+// matchClaim returns the first value of claim, which may be a single string or a list, that is in allowed.
+func matchClaim(claim interface{}, allowed []string) (string, bool) {
+	values := []string{}
+	switch claim := claim.(type) {
+	case string:
+		values = append(values, claim)
+	case []interface{}:
+		for _, value := range claim {
+			if value, ok := value.(string); ok {
+				values = append(values, value)
+			}
+		}
+	case []string:
+		values = claim
+	}
+
+	for _, value := range values {
+		for _, allowedValue := range allowed {
+			if value == allowedValue {
+				return value, true
+			}
+		}
+	}
+	return "", false
+}
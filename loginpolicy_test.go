@@ -0,0 +1,104 @@
+package wireguardhttps
+
+import (
+	"testing"
+
+	"github.com/markbates/goth"
+)
+
+func TestLoginPolicyAuthorize(t *testing.T) {
+	policy := &LoginPolicy{
+		AllowedGroups:       []string{"engineering"},
+		AllowedRoles:        []string{"vpn-user"},
+		AllowedEmailDomains: []string{"Example.com"},
+	}
+
+	cases := []struct {
+		user                 goth.User
+		expectedAuthorizedBy string
+	}{
+		{
+			user:                 goth.User{RawData: map[string]interface{}{"groups": []interface{}{"sales", "engineering"}}},
+			expectedAuthorizedBy: "group:engineering",
+		},
+		{
+			user:                 goth.User{RawData: map[string]interface{}{"roles": "vpn-user"}},
+			expectedAuthorizedBy: "role:vpn-user",
+		},
+		{
+			user:                 goth.User{Email: "jontom@example.com", RawData: map[string]interface{}{"email_verified": true}},
+			expectedAuthorizedBy: "email_domain:example.com",
+		},
+	}
+
+	for _, testCase := range cases {
+		authorizedBy, err := policy.Authorize(testCase.user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if authorizedBy != testCase.expectedAuthorizedBy {
+			t.Fatalf("Expected %v, got %v", testCase.expectedAuthorizedBy, authorizedBy)
+		}
+	}
+
+	outsider := goth.User{
+		Email:   "contractor@example.org",
+		RawData: map[string]interface{}{"groups": []interface{}{"sales"}},
+	}
+	_, err := policy.Authorize(outsider)
+	if _, ok := err.(*LoginDeniedError); !ok {
+		t.Fatalf("Expected LoginDeniedError, got %v", err)
+	}
+
+	for _, verified := range []interface{}{nil, false, "true"} {
+		unverified := goth.User{
+			Email:   "jontom@example.com",
+			RawData: map[string]interface{}{"email_verified": verified},
+		}
+		_, err = policy.Authorize(unverified)
+		if _, ok := err.(*LoginDeniedError); !ok {
+			t.Fatalf("Expected LoginDeniedError for email_verified %v, got %v", verified, err)
+		}
+	}
+}
+
+func TestLoginPolicyChecksAzureADUserPrincipalName(t *testing.T) {
+	policy := &LoginPolicy{AllowedEmailDomains: []string{"adtenant.com"}, VerifiedEmailClaim: "userPrincipalName"}
+	// azureadv2 sets UserID to the user's Graph object ID, so the user principal name is only in RawData.
+	authorizedBy, err := policy.Authorize(goth.User{
+		UserID:  "6b3f2c1e-8a4d-4f7b-9c2e-1d5a7e9b3f40",
+		Email:   "jontom@gmail.com",
+		RawData: map[string]interface{}{"userPrincipalName": "jontom@adtenant.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if authorizedBy != "email_domain:adtenant.com" {
+		t.Fatalf("Expected email_domain:adtenant.com, got %v", authorizedBy)
+	}
+
+	for _, rawData := range []map[string]interface{}{{"userPrincipalName": "guest@gmail.com"}, {}} {
+		_, err = policy.Authorize(goth.User{
+			UserID:  "0f9e8d7c-6b5a-4c3d-2e1f-0a9b8c7d6e5f",
+			Email:   "guest@adtenant.com",
+			RawData: rawData,
+		})
+		if _, ok := err.(*LoginDeniedError); !ok {
+			t.Fatalf("Expected LoginDeniedError for user principal name %v, got %v", rawData["userPrincipalName"], err)
+		}
+	}
+}
+
+func TestEmptyLoginPolicyAllowsEveryone(t *testing.T) {
+	policy := &LoginPolicy{}
+	authorizedBy, err := policy.Authorize(goth.User{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if authorizedBy != "unrestricted" {
+		t.Fatalf("Expected unrestricted, got %v", authorizedBy)
+	}
+}
@@ -0,0 +1,141 @@
+package wireguardhttps
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Emails sent to device owners.
+// Each is rendered from the "email_" prefixed template of the same name in ServerConfig.Templates, which must define a "subject" template for the subject line.
+const (
+	EmailDeviceCreated  = "device_created"
+	EmailDeviceRekeyed  = "device_rekeyed"
+	EmailDeviceDeleted  = "device_deleted"
+	EmailDeviceExpiring = "device_expiring"
+)
+
+// SMTPConfig is the mail server emails are sent through.
+// Username and Password are optional; when set, they're sent with PLAIN auth, which net/smtp only allows over TLS or to localhost.
+type SMTPConfig struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+// DeviceEmail is the data email templates are rendered with.
+type DeviceEmail struct {
+	Owner    UserProfile
+	Device   Device
+	SourceIP string
+	Time     time.Time
+}
+
+// Mailer emails device owners about changes to their devices in the background.
+// A nil *Mailer sends nothing.
+type Mailer struct {
+	SMTP      SMTPConfig
+	Templates map[string]*template.Template
+	sendMail  func(addr string, auth smtp.Auth, from string, to []string, msg []byte) error
+	pending   sync.WaitGroup
+}
+
+// NewMailer creates a Mailer that sends through config with templates.
+func NewMailer(config SMTPConfig, templates map[string]*template.Template) *Mailer {
+	return &Mailer{
+		SMTP:      config,
+		Templates: templates,
+		sendMail:  smtp.SendMail,
+	}
+}
+
+// Notify emails data.Owner using the email template, skipping owners without an email address.
+// Failures are logged rather than returned since the change has already happened.
+func (m *Mailer) Notify(email string, data DeviceEmail) {
+	if m == nil || data.Owner.Email == "" {
+		return
+	}
+
+	if data.Time.IsZero() {
+		data.Time = time.Now()
+	}
+
+	message, err := m.render(email, data)
+	if err != nil {
+		log.Printf("Failed to render %v email: %v", email, err)
+		return
+	}
+
+	m.pending.Add(1)
+	go func() {
+		defer m.pending.Done()
+		err := m.sendMail(m.SMTP.Addr, m.auth(), m.SMTP.From, []string{data.Owner.Email}, message)
+		if err != nil {
+			log.Printf("Failed to send %v email to %v: %v", email, data.Owner.AuthPlatformUserID, err)
+		}
+	}()
+}
+
+// Wait blocks until every email queued by Notify has been sent.
+func (m *Mailer) Wait() {
+	if m == nil {
+		return
+	}
+	m.pending.Wait()
+}
+
+func (m *Mailer) auth() smtp.Auth {
+	if m.SMTP.Username == "" {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(m.SMTP.Addr)
+	if err != nil {
+		host = m.SMTP.Addr
+	}
+	return smtp.PlainAuth("", m.SMTP.Username, m.SMTP.Password, host)
+}
+
+// render builds the RFC 5322 message for email.
+func (m *Mailer) render(email string, data DeviceEmail) ([]byte, error) {
+	tmpl, ok := m.Templates["email_"+email]
+	if !ok {
+		return nil, fmt.Errorf("email_%v template is not loaded", email)
+	}
+
+	var subject bytes.Buffer
+	err := tmpl.ExecuteTemplate(&subject, "subject", data)
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	err = tmpl.Execute(&body, data)
+	if err != nil {
+		return nil, err
+	}
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %v\r\n", m.SMTP.From)
+	fmt.Fprintf(&message, "To: %v\r\n", data.Owner.Email)
+	fmt.Fprintf(&message, "Subject: %v\r\n", headerValue(subject.String()))
+	fmt.Fprintf(&message, "Date: %v\r\n", data.Time.Format(time.RFC1123Z))
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	message.WriteString("\r\n")
+	message.WriteString(strings.ReplaceAll(strings.TrimSpace(body.String()), "\n", "\r\n"))
+	message.WriteString("\r\n")
+	return message.Bytes(), nil
+}
+
+// headerValue folds value onto one line so user supplied text can't inject headers.
+func headerValue(value string) string {
+	return strings.Join(strings.Fields(value), " ")
+}
@@ -0,0 +1,179 @@
+package wireguardhttps
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/joncooperworks/wgrpcd"
+)
+
+const testEmail = "jontom@example.com"
+
+// testMailbox records the messages a Mailer sends instead of connecting to a mail server.
+type testMailbox struct {
+	mutex    sync.Mutex
+	messages []string
+}
+
+func (t *testMailbox) sendMail(addr string, auth smtp.Auth, from string, to []string, msg []byte) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.messages = append(t.messages, fmt.Sprintf("%v\n%s", strings.Join(to, ","), msg))
+	return nil
+}
+
+func testMailer(t *testing.T) (*Mailer, *testMailbox) {
+	templates := testTemplates(t)
+	for _, email := range []string{EmailDeviceCreated, EmailDeviceRekeyed, EmailDeviceDeleted, EmailDeviceExpiring} {
+		tmpl, err := template.ParseFiles("templates/email/" + email + ".tmpl")
+		if err != nil {
+			t.Fatal(err)
+		}
+		templates["email_"+email] = tmpl
+	}
+
+	mailbox := &testMailbox{}
+	mailer := NewMailer(SMTPConfig{Addr: "localhost:25", From: "vpn@example.com"}, templates)
+	mailer.sendMail = mailbox.sendMail
+	return mailer, mailbox
+}
+
+func TestRegisterUserKeepsLastKnownEmail(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	_, err := db.RegisterUser("jontom@adtenant.com", "azuread", "unrestricted", testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.RegisterUser("jontom@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.Email != testEmail {
+		t.Fatalf("Expected email %v to be kept, got %v", testEmail, user.Email)
+	}
+}
+
+func TestDeviceChangesAreEmailedToOwner(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	err := db.RegisterSubnet(mustParseCIDR("10.0.0.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.RegisterUser("jontom@adtenant.com", "azuread", "unrestricted", testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mailer, mailbox := testMailer(t)
+	config := testServerConfig(t, db)
+	config.Templates = mailer.Templates
+	config.Mailer = mailer
+
+	writer := serveAsUser(t, config, &user, "POST", "/api/devices", DeviceRequest{Name: "Work Laptop", OS: "Linux", PublicKey: mustGenerateKey(t)})
+	if writer.Code != 200 {
+		t.Fatalf("Expected status code 200 for /devices, got %v", writer.Code)
+	}
+
+	devices, err := db.Devices(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer = serveAsUser(t, config, &user, "DELETE", fmt.Sprintf("/api/devices/%v", devices[0].ID), nil)
+	if writer.Code != 204 {
+		t.Fatalf("Expected status code 204 for DELETE /devices, got %v", writer.Code)
+	}
+	mailer.Wait()
+
+	if len(mailbox.messages) != 2 {
+		t.Fatalf("Expected 2 emails, got %v", mailbox.messages)
+	}
+
+	// Emails are sent in the background, so they may arrive in either order.
+	for _, subject := range []string{"Subject: New device added to your VPN account: Work Laptop", "Subject: Device removed from your VPN account: Work Laptop"} {
+		found := false
+		for _, message := range mailbox.messages {
+			if strings.HasPrefix(message, testEmail+"\n") && strings.Contains(message, subject+"\r\n") && strings.Contains(message, "From: 192.0.2.10") {
+				found = true
+			}
+		}
+
+		if !found {
+			t.Fatalf("Expected email to %v with %v sent from the request's IP, got %v", testEmail, subject, mailbox.messages)
+		}
+	}
+}
+
+func TestExpirySchedulerWarnsOwnersOnce(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	err := db.RegisterSubnet(mustParseCIDR("10.0.0.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.RegisterUser("contractor@adtenant.com", "azuread", "unrestricted", testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(48 * time.Hour)
+	deviceFunc := func(allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
+		return &wgrpcd.PeerConfigInfo{PublicKey: mustGenerateKey(t), AllowedIPs: allowedIPs}, nil
+	}
+	device, _, err := db.CreateDevice(user, nil, Device{Name: "Phone", OS: "iOS", ExpiresAt: &expiresAt}, nil, deviceFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mailer, mailbox := testMailer(t)
+	scheduler := &ExpiryScheduler{
+		Database:            db,
+		WireguardClient:     &testwgrpcdClient{},
+		WireguardDeviceName: "wg0",
+		Mailer:              mailer,
+		ExpiryWarning:       72 * time.Hour,
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err = scheduler.WarnExpiring(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	mailer.Wait()
+
+	if len(mailbox.messages) != 1 || !strings.Contains(mailbox.messages[0], "Subject: Your VPN device Phone expires soon") {
+		t.Fatalf("Expected 1 expiry warning, got %v", mailbox.messages)
+	}
+
+	extendedTo := now.Add(60 * time.Hour)
+	_, err = db.ExtendDevice(user, device, &extendedTo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	warned, err := scheduler.WarnExpiring(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(warned) != 1 {
+		t.Fatalf("Expected extended device to be warned again, got %v", warned)
+	}
+}
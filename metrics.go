@@ -0,0 +1,240 @@
+package wireguardhttps
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// Login results recorded by Metrics.
+const (
+	LoginResultSuccess = "success"
+	LoginResultDenied  = "denied"
+	LoginResultFailed  = "failed"
+)
+
+// defaultPoolName labels the pool devices are assigned from when they don't ask for a named one.
+const defaultPoolName = "default"
+
+// Metrics collects Prometheus metrics for the HTTP API, wgrpcd calls, logins, devices and address pools.
+// Each Metrics has its own registry so several servers can run in one process.
+// A nil *Metrics records nothing.
+type Metrics struct {
+	registry        *prometheus.Registry
+	requestDuration *prometheus.HistogramVec
+	wgrpcdDuration  *prometheus.HistogramVec
+	wgrpcdErrors    *prometheus.CounterVec
+	logins          *prometheus.CounterVec
+}
+
+// NewMetrics registers the server's metrics, reading device counts and pool utilisation from database at scrape time.
+func NewMetrics(database Database) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "wireguardhttps_http_request_duration_seconds",
+			Help: "Latency of HTTP requests by route.",
+		}, []string{"method", "route", "status"}),
+		wgrpcdDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "wireguardhttps_wgrpcd_request_duration_seconds",
+			Help: "Latency of wgrpcd calls by gRPC method.",
+		}, []string{"method"}),
+		wgrpcdErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "wireguardhttps_wgrpcd_errors_total",
+			Help: "Failed wgrpcd calls by gRPC method and status code.",
+		}, []string{"method", "code"}),
+		logins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "wireguardhttps_logins_total",
+			Help: "Login attempts by provider and result.",
+		}, []string{"provider", "result"}),
+	}
+
+	m.registry.MustRegister(
+		m.requestDuration,
+		m.wgrpcdDuration,
+		m.wgrpcdErrors,
+		m.logins,
+		&databaseCollector{database: database},
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Middleware records the latency of each request against its route pattern rather than its path, so device IDs don't create a series per device.
+func (m *Metrics) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		m.requestDuration.
+			WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).
+			Observe(time.Since(start).Seconds())
+	}
+}
+
+// UnaryClientInterceptor records the latency and errors of every wgrpcd call.
+func (m *Metrics) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		start := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		m.wgrpcdDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+		if err != nil {
+			m.wgrpcdErrors.WithLabelValues(method, status.Code(err).String()).Inc()
+		}
+		return err
+	}
+}
+
+// ObserveLogin counts a login attempt through provider.
+func (m *Metrics) ObserveLogin(provider, result string) {
+	if m == nil {
+		return
+	}
+	m.logins.WithLabelValues(provider, result).Inc()
+}
+
+var (
+	devicesDesc = prometheus.NewDesc(
+		"wireguardhttps_devices",
+		"Devices by state.",
+		[]string{"state"}, nil,
+	)
+	poolAddressesDesc = prometheus.NewDesc(
+		"wireguardhttps_pool_addresses",
+		"IPv4 addresses available to devices in each pool.",
+		[]string{"pool"}, nil,
+	)
+	poolAssignedDesc = prometheus.NewDesc(
+		"wireguardhttps_pool_addresses_assigned",
+		"IPv4 addresses assigned to devices in each pool.",
+		[]string{"pool"}, nil,
+	)
+)
+
+// databaseCollector reads device counts and pool utilisation from the Database on every scrape.
+type databaseCollector struct {
+	database Database
+}
+
+func (d *databaseCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- devicesDesc
+	ch <- poolAddressesDesc
+	ch <- poolAssignedDesc
+}
+
+func (d *databaseCollector) Collect(ch chan<- prometheus.Metric) {
+	devices, err := d.database.AllDevices()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	capacity, err := d.poolCapacity()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	states := map[string]int{"active": 0, "disabled": 0}
+	assigned := map[string]int{}
+	for pool := range capacity {
+		assigned[pool] = 0
+	}
+	for _, device := range devices {
+		if device.DisabledAt != nil {
+			states["disabled"]++
+		} else {
+			states["active"]++
+		}
+		assigned[devicePoolName(device)]++
+	}
+
+	for state, count := range states {
+		ch <- prometheus.MustNewConstMetric(devicesDesc, prometheus.GaugeValue, float64(count), state)
+	}
+	for pool, count := range capacity {
+		ch <- prometheus.MustNewConstMetric(poolAddressesDesc, prometheus.GaugeValue, count, pool)
+	}
+	for pool, count := range assigned {
+		ch <- prometheus.MustNewConstMetric(poolAssignedDesc, prometheus.GaugeValue, float64(count), pool)
+	}
+}
+
+// poolCapacity counts the IPv4 addresses each pool can hand out.
+// The default pool has the addresses allocated up front in Database.Addresses as well as its lazily allocated subnets.
+func (d *databaseCollector) poolCapacity() (map[string]float64, error) {
+	addresses, err := d.database.Addresses()
+	if err != nil {
+		return nil, err
+	}
+
+	subnets, err := d.database.Subnets()
+	if err != nil {
+		return nil, err
+	}
+
+	pools, err := d.database.AllPools()
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[uint]string{}
+	capacity := map[string]float64{defaultPoolName: float64(len(addresses))}
+	for _, pool := range pools {
+		names[pool.ID] = pool.Name
+		capacity[pool.Name] = 0
+	}
+
+	for _, subnet := range subnets {
+		addressRange, err := subnet.AddressRange()
+		if err != nil {
+			return nil, err
+		}
+
+		if addressRange.IsIPv6() {
+			continue
+		}
+
+		pool := defaultPoolName
+		if subnet.AddressPoolID != nil {
+			pool = names[*subnet.AddressPoolID]
+		}
+		capacity[pool] += assignableIPv4Addresses(addressRange)
+	}
+	return capacity, nil
+}
+
+// assignableIPv4Addresses returns the number of addresses in addressRange that aren't reserved by IsReserved.
+func assignableIPv4Addresses(addressRange *AddressRange) float64 {
+	ones, bits := addressRange.mask().Size()
+	size := float64(uint64(1) << uint(bits-ones))
+	if size < 3 {
+		return 0
+	}
+	return size - 3
+}
+
+func devicePoolName(device Device) string {
+	if device.AddressPool != nil {
+		return device.AddressPool.Name
+	}
+	return defaultPoolName
+}
@@ -0,0 +1,113 @@
+package wireguardhttps
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/joncooperworks/wgrpcd"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func scrapeMetrics(t *testing.T, metrics *Metrics) string {
+	writer := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(writer, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := ioutil.ReadAll(writer.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func expectMetric(t *testing.T, scraped, metric string) {
+	if !strings.Contains(scraped, metric+"\n") {
+		t.Fatalf("Expected %v in metrics, got\n%v", metric, scraped)
+	}
+}
+
+func TestMetricsReportDevicesAndPoolUtilisation(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	err := db.AllocateSubnet([]net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool, err := db.SavePool(AddressPool{Name: "engineering"}, []net.IPNet{mustParseCIDR("10.1.0.0/29"), mustParseCIDR("fd01::/64")}, []AddressPoolMember{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.RegisterUser("jontom@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deviceFunc := func(allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
+		return &wgrpcd.PeerConfigInfo{PublicKey: mustGenerateKey(t), AllowedIPs: allowedIPs}, nil
+	}
+	_, _, err = db.CreateDevice(user, nil, Device{Name: "Laptop", OS: "Linux"}, nil, deviceFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	device, _, err := db.CreateDevice(user, &pool, Device{Name: "Phone", OS: "Android"}, nil, deviceFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.DisableDevice(device, func() error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scraped := scrapeMetrics(t, NewMetrics(db))
+	expectMetric(t, scraped, `wireguardhttps_devices{state="active"} 1`)
+	expectMetric(t, scraped, `wireguardhttps_devices{state="disabled"} 1`)
+	expectMetric(t, scraped, `wireguardhttps_pool_addresses{pool="default"} 2`)
+	expectMetric(t, scraped, `wireguardhttps_pool_addresses_assigned{pool="default"} 1`)
+	expectMetric(t, scraped, `wireguardhttps_pool_addresses{pool="engineering"} 5`)
+	expectMetric(t, scraped, `wireguardhttps_pool_addresses_assigned{pool="engineering"} 1`)
+}
+
+func TestMetricsRecordRequestsLoginsAndWgrpcdCalls(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	user, err := db.RegisterUser("jontom@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := NewMetrics(db)
+	config := testServerConfig(t, db)
+	config.Metrics = metrics
+
+	writer := serveAsUser(t, config, &user, "GET", "/api/devices/1", nil)
+	if writer.Code != 404 {
+		t.Fatalf("Expected status code 404 for unknown device, got %v", writer.Code)
+	}
+
+	metrics.ObserveLogin("azuread", LoginResultDenied)
+
+	interceptor := metrics.UnaryClientInterceptor()
+	failing := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		return status.Error(codes.Unavailable, "connection refused")
+	}
+	err = interceptor(context.Background(), "/wgrpcd.WireguardRPC/CreatePeer", nil, nil, nil, failing)
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("Expected interceptor to return the wgrpcd error, got %v", err)
+	}
+
+	scraped := scrapeMetrics(t, metrics)
+	expectMetric(t, scraped, `wireguardhttps_http_request_duration_seconds_count{method="GET",route="/api/devices/:device_id",status="404"} 1`)
+	expectMetric(t, scraped, `wireguardhttps_logins_total{provider="azuread",result="denied"} 1`)
+	expectMetric(t, scraped, `wireguardhttps_wgrpcd_request_duration_seconds_count{method="/wgrpcd.WireguardRPC/CreatePeer"} 1`)
+	expectMetric(t, scraped, `wireguardhttps_wgrpcd_errors_total{code="Unavailable",method="/wgrpcd.WireguardRPC/CreatePeer"} 1`)
+}
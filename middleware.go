@@ -1,10 +1,13 @@
 package wireguardhttps
 
 import (
+	"fmt"
 	"log"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/csrf"
 	"github.com/gorilla/sessions"
 	"github.com/markbates/goth"
 	"github.com/markbates/goth/gothic"
@@ -12,7 +15,7 @@ import (
 
 func ProviderWhitelistMiddleware(c *gin.Context) {
 	if !isAllowedProvider(c) {
-		c.AbortWithStatus(http.StatusBadRequest)
+		abortWithError(c, http.StatusBadRequest, ErrorCodeBadRequest, "unsupported login provider")
 		return
 	}
 
@@ -31,22 +34,112 @@ func isAllowedProvider(c *gin.Context) bool {
 	return false
 }
 
-func AuthenticationRequiredMiddleware(store sessions.Store, sessionName string) func(*gin.Context) {
+// AuthenticationRequiredMiddleware reloads the session's user from the database on every request.
+// Deleted users are rejected straight away, and changes to a user's limits take effect without waiting for their session to expire.
+func AuthenticationRequiredMiddleware(database Database, store sessions.Store, sessionName string) func(*gin.Context) {
 	return func(c *gin.Context) {
 		session, err := store.Get(c.Request, sessionName)
 		if err != nil {
 			log.Println(err)
-			c.AbortWithStatus(http.StatusInternalServerError)
+			abortWithError(c, http.StatusInternalServerError, ErrorCodeInternalError, "internal error")
 			return
 		}
 
-		user, ok := session.Values["user"]
+		sessionUser, ok := session.Values["user"].(*UserProfile)
 		if !ok {
-			c.AbortWithStatus(http.StatusUnauthorized)
+			abortWithError(c, http.StatusUnauthorized, ErrorCodeUnauthorized, "not logged in")
 			return
 		}
 
-		c.Set("user", user)
+		user, err := database.GetUser(int(sessionUser.ID))
+		if _, notFound := err.(*RecordNotFoundError); notFound {
+			abortWithError(c, http.StatusUnauthorized, ErrorCodeUnauthorized, "not logged in")
+			return
+		}
+
+		if err != nil {
+			log.Println(err)
+			abortWithError(c, http.StatusInternalServerError, ErrorCodeInternalError, "internal error")
+			return
+		}
+
+		c.Set("user", &user)
+		c.Next()
+	}
+}
+
+// TokenOrSessionAuthenticationMiddleware is a variant of AuthenticationRequiredMiddleware that also accepts API tokens sent as "Authorization: Bearer <token>".
+// Token-authenticated requests don't rely on cookies, so they can't be forged cross-site and skip the CSRF check.
+func TokenOrSessionAuthenticationMiddleware(database Database, store sessions.Store, sessionName string) func(*gin.Context) {
+	sessionMiddleware := AuthenticationRequiredMiddleware(database, store, sessionName)
+	return func(c *gin.Context) {
+		authorization := c.GetHeader("Authorization")
+		if !strings.HasPrefix(authorization, "Bearer ") {
+			sessionMiddleware(c)
+			return
+		}
+
+		token, err := database.AuthenticateAPIToken(HashAPIToken(strings.TrimPrefix(authorization, "Bearer ")))
+		if err != nil {
+			log.Println(err)
+			abortWithError(c, http.StatusUnauthorized, ErrorCodeUnauthorized, "invalid or expired API token")
+			return
+		}
+
+		c.Set("user", &token.Owner)
+		c.Set("api_token", &token)
+		c.Request = csrf.UnsafeSkipCheck(c.Request)
+		c.Next()
+	}
+}
+
+// ScopeRequiredMiddleware rejects token-authenticated requests whose token wasn't granted scope.
+// Session-authenticated requests are always allowed.
+func ScopeRequiredMiddleware(scope string) func(*gin.Context) {
+	return func(c *gin.Context) {
+		token, ok := c.Get("api_token")
+		if ok && !token.(*APIToken).HasScope(scope) {
+			abortWithError(c, http.StatusForbidden, ErrorCodeForbidden, fmt.Sprintf("API token is missing the %v scope", scope))
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// SessionRequiredMiddleware rejects token-authenticated requests, so API tokens can't mint new tokens or use admin routes.
+func SessionRequiredMiddleware(c *gin.Context) {
+	if _, ok := c.Get("api_token"); ok {
+		abortWithError(c, http.StatusForbidden, ErrorCodeForbidden, "API tokens can't be used here")
+		return
+	}
+
+	c.Next()
+}
+
+// AdminRequiredMiddleware must run after AuthenticationRequiredMiddleware.
+// It reloads the user from the database so revoking admin rights takes effect without waiting for the session to expire.
+func AdminRequiredMiddleware(database Database) func(*gin.Context) {
+	return func(c *gin.Context) {
+		sessionUser, ok := c.Get("user")
+		if !ok {
+			abortWithError(c, http.StatusUnauthorized, ErrorCodeUnauthorized, "not logged in")
+			return
+		}
+
+		user, err := database.GetUser(int(sessionUser.(*UserProfile).ID))
+		if err != nil {
+			log.Println(err)
+			abortWithError(c, http.StatusForbidden, ErrorCodeForbidden, "admin rights required")
+			return
+		}
+
+		if !user.IsAdmin {
+			abortWithError(c, http.StatusForbidden, ErrorCodeForbidden, "admin rights required")
+			return
+		}
+
+		c.Set("user", &user)
 		c.Next()
 	}
 }
@@ -0,0 +1,177 @@
+package wireguardhttps
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+	"strings"
+
+	"go.mozilla.org/pkcs7"
+	"howett.net/plist"
+)
+
+// ConfigFormatMobileConfig is an Apple configuration profile that installs the wg-quick config as a WireGuard VPN on iOS and macOS.
+const ConfigFormatMobileConfig = "mobileconfig"
+
+const (
+	mobileConfigFileName    = "wg0.mobileconfig"
+	mobileConfigContentType = "application/x-apple-aspen-config"
+)
+
+// MobileConfigSettings controls the Apple configuration profiles devices can be downloaded as.
+// OnDemand makes the VPN connect automatically on every network except the TrustedSSIDs Wi-Fi networks.
+// Profiles are signed with Certificate and PrivateKey if they're set, so iOS and macOS show them as verified.
+// Intermediates are included in the signature so devices can build a chain to a trusted root.
+type MobileConfigSettings struct {
+	OnDemand      bool
+	TrustedSSIDs  []string
+	Certificate   *x509.Certificate
+	PrivateKey    crypto.PrivateKey
+	Intermediates []*x509.Certificate
+}
+
+// MobileConfigProfile is the top level payload of a configuration profile.
+type MobileConfigProfile struct {
+	PayloadDisplayName string
+	PayloadType        string
+	PayloadVersion     int
+	PayloadIdentifier  string
+	PayloadUUID        string
+	PayloadContent     []MobileConfigVPNPayload
+}
+
+// MobileConfigVPNPayload installs a WireGuard VPN from its wg-quick config.
+// VPNSubType is the bundle identifier of the WireGuard app for the device's platform.
+type MobileConfigVPNPayload struct {
+	PayloadDisplayName string
+	PayloadType        string
+	PayloadVersion     int
+	PayloadIdentifier  string
+	PayloadUUID        string
+	UserDefinedName    string
+	VPNType            string
+	VPNSubType         string
+	VendorConfig       MobileConfigVendorConfig
+	VPN                MobileConfigVPN
+}
+
+type MobileConfigVendorConfig struct {
+	WgQuickConfig string
+}
+
+type MobileConfigVPN struct {
+	RemoteAddress        string
+	AuthenticationMethod string
+	OnDemandEnabled      int
+	OnDemandRules        []MobileConfigOnDemandRule `plist:",omitempty"`
+}
+
+// MobileConfigOnDemandRule is evaluated in order when the network changes; the first matching rule's Action is taken.
+type MobileConfigOnDemandRule struct {
+	Action             string
+	InterfaceTypeMatch string   `plist:",omitempty"`
+	SSIDMatch          []string `plist:",omitempty"`
+}
+
+// MobileConfig builds a configuration profile installing wgQuickConfig as a VPN named after device.
+// identifier is the reverse DNS prefix of the profile's payload identifiers. It's combined with the device ID so downloading a device's profile again replaces the old one.
+// The profile is returned as an XML property list, signed if settings has a Certificate.
+func MobileConfig(settings MobileConfigSettings, identifier string, device Device, endpoint string, wgQuickConfig []byte) ([]byte, error) {
+	profileUUID, err := randomUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	payloadUUID, err := randomUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	vpnSubType := "com.wireguard.ios"
+	if device.OS == "macOS" {
+		vpnSubType = "com.wireguard.macos"
+	}
+
+	vpn := MobileConfigVPN{
+		RemoteAddress:        endpoint,
+		AuthenticationMethod: "Password",
+	}
+	if settings.OnDemand {
+		vpn.OnDemandEnabled = 1
+		if len(settings.TrustedSSIDs) > 0 {
+			vpn.OnDemandRules = append(vpn.OnDemandRules, MobileConfigOnDemandRule{Action: "Disconnect", InterfaceTypeMatch: "WiFi", SSIDMatch: settings.TrustedSSIDs})
+		}
+		vpn.OnDemandRules = append(vpn.OnDemandRules, MobileConfigOnDemandRule{Action: "Connect"})
+	}
+
+	deviceIdentifier := fmt.Sprintf("%v.device.%v", identifier, device.ID)
+	profile := MobileConfigProfile{
+		PayloadDisplayName: fmt.Sprintf("WireGuard VPN (%v)", device.Name),
+		PayloadType:        "Configuration",
+		PayloadVersion:     1,
+		PayloadIdentifier:  deviceIdentifier,
+		PayloadUUID:        profileUUID,
+		PayloadContent: []MobileConfigVPNPayload{
+			{
+				PayloadDisplayName: "VPN",
+				PayloadType:        "com.apple.vpn.managed",
+				PayloadVersion:     1,
+				PayloadIdentifier:  deviceIdentifier + ".vpn",
+				PayloadUUID:        payloadUUID,
+				UserDefinedName:    device.Name,
+				VPNType:            "VPN",
+				VPNSubType:         vpnSubType,
+				VendorConfig:       MobileConfigVendorConfig{WgQuickConfig: string(wgQuickConfig)},
+				VPN:                vpn,
+			},
+		},
+	}
+
+	data, err := plist.MarshalIndent(profile, plist.XMLFormat, "\t")
+	if err != nil {
+		return nil, err
+	}
+
+	if settings.Certificate == nil {
+		return data, nil
+	}
+	return signMobileConfig(settings, data)
+}
+
+// signMobileConfig wraps profile in a CMS signed-data envelope, the format iOS and macOS expect for signed profiles.
+func signMobileConfig(settings MobileConfigSettings, profile []byte) ([]byte, error) {
+	signedData, err := pkcs7.NewSignedData(profile)
+	if err != nil {
+		return nil, err
+	}
+	signedData.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+
+	err = signedData.AddSignerChain(settings.Certificate, settings.PrivateKey, settings.Intermediates, pkcs7.SignerInfoConfig{})
+	if err != nil {
+		return nil, err
+	}
+	return signedData.Finish()
+}
+
+// mobileConfigIdentifier reverses host's labels into a payload identifier prefix, as Apple recommends.
+func mobileConfigIdentifier(host string) string {
+	labels := strings.Split(host, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return strings.Join(labels, ".") + ".wireguardhttps"
+}
+
+// randomUUID returns a random version 4 UUID in upper case, as Apple's tools generate them.
+func randomUUID() (string, error) {
+	uuid := make([]byte, 16)
+	_, err := rand.Read(uuid)
+	if err != nil {
+		return "", err
+	}
+
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	return fmt.Sprintf("%X-%X-%X-%X-%X", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16]), nil
+}
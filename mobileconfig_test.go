@@ -0,0 +1,147 @@
+package wireguardhttps
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mozilla.org/pkcs7"
+	"howett.net/plist"
+)
+
+func mustParseMobileConfig(t *testing.T, data []byte) MobileConfigProfile {
+	var profile MobileConfigProfile
+	_, err := plist.Unmarshal(data, &profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(profile.PayloadContent) != 1 {
+		t.Fatalf("Expected 1 VPN payload, got %v", profile.PayloadContent)
+	}
+	return profile
+}
+
+func TestMobileConfigInstallsWireguardVPN(t *testing.T) {
+	settings := MobileConfigSettings{OnDemand: true, TrustedSSIDs: []string{"Office"}}
+	device := Device{Name: "Jon's MacBook", OS: "macOS"}
+	device.ID = 7
+	data, err := MobileConfig(settings, mobileConfigIdentifier("vpn.example.com"), device, testServerName, []byte(expectedPeerConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	profile := mustParseMobileConfig(t, data)
+	if profile.PayloadType != "Configuration" || profile.PayloadIdentifier != "com.example.vpn.wireguardhttps.device.7" {
+		t.Fatalf("Expected a configuration profile identified by the device, got %v %v", profile.PayloadType, profile.PayloadIdentifier)
+	}
+
+	payload := profile.PayloadContent[0]
+	if payload.PayloadType != "com.apple.vpn.managed" || payload.VPNSubType != "com.wireguard.macos" || payload.UserDefinedName != device.Name {
+		t.Fatalf("Expected a WireGuard VPN payload for macOS named %v, got %v", device.Name, payload)
+	}
+
+	if payload.VendorConfig.WgQuickConfig != expectedPeerConfig || payload.VPN.RemoteAddress != testServerName {
+		t.Fatalf("Expected the wg-quick config for %v, got %v", testServerName, payload.VendorConfig.WgQuickConfig)
+	}
+
+	expectedRules := []MobileConfigOnDemandRule{
+		{Action: "Disconnect", InterfaceTypeMatch: "WiFi", SSIDMatch: []string{"Office"}},
+		{Action: "Connect"},
+	}
+	if payload.VPN.OnDemandEnabled != 1 || !reflect.DeepEqual(payload.VPN.OnDemandRules, expectedRules) {
+		t.Fatalf("Expected on demand rules %v, got %v", expectedRules, payload.VPN.OnDemandRules)
+	}
+}
+
+func TestSignedMobileConfig(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "vpn.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings := MobileConfigSettings{Certificate: certificate, PrivateKey: privateKey}
+	data, err := MobileConfig(settings, mobileConfigIdentifier("vpn.example.com"), Device{Name: "iPhone", OS: "iOS"}, testServerName, []byte(expectedPeerConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := pkcs7.Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = signed.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if signer := signed.GetOnlySigner(); signer == nil || !signer.Equal(certificate) {
+		t.Fatalf("Expected profile to be signed by %v", certificate.Subject)
+	}
+
+	profile := mustParseMobileConfig(t, signed.Content)
+	if payload := profile.PayloadContent[0]; payload.VPNSubType != "com.wireguard.ios" || payload.VPN.OnDemandEnabled != 0 || len(payload.VPN.OnDemandRules) != 0 {
+		t.Fatalf("Expected an iOS VPN payload without on demand rules, got %v", payload)
+	}
+}
+
+func TestNewDeviceAsMobileConfig(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	err := db.RegisterSubnet(mustParseCIDR("10.0.0.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.RegisterUser("jontom@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := testServerConfig(t, db)
+	config.HTTPHost, _ = url.Parse("vpn.example.com")
+	config.MobileConfig = MobileConfigSettings{OnDemand: true}
+
+	writer := serveAsUser(t, config, &user, "POST", "/api/devices?config=mobileconfig", DeviceRequest{Name: "iPhone", OS: "iOS"})
+	if writer.Code != 200 || writer.Header().Get("Content-Type") != mobileConfigContentType {
+		t.Fatalf("Expected status code 200 with a configuration profile, got %v %v", writer.Code, writer.Header().Get("Content-Type"))
+	}
+
+	data, err := ioutil.ReadAll(writer.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := mustParseMobileConfig(t, data).PayloadContent[0]
+	if !strings.Contains(payload.VendorConfig.WgQuickConfig, "PrivateKey = "+testPrivateKey+"\n") || payload.VPN.OnDemandEnabled != 1 {
+		t.Fatalf("Expected an on demand profile with the new device's private key, got %v", payload)
+	}
+}
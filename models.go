@@ -1,6 +1,11 @@
 package wireguardhttps
 
 import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
 	"github.com/jinzhu/gorm"
 )
 
@@ -12,24 +17,254 @@ type IPAddress struct {
 	Address string `gorm:"PRIMARY_KEY;UNIQUE"`
 }
 
+// Subnet is a network whose addresses are allocated on demand as devices are created, rather than stored in the `IPAddress` table up front.
+// Only assigned addresses are stored, on the `Device` they belong to.
+// IPv6 subnets are far too large to store every address, so they are always allocated this way. IPv4 subnets can opt in to it.
+// Subnets without an AddressPoolID belong to the default pool.
+type Subnet struct {
+	gorm.Model
+	Network       string `gorm:"UNIQUE"`
+	AddressPoolID *uint
+}
+
+// AddressRange parses the subnet's network into an AddressRange.
+func (s *Subnet) AddressRange() (*AddressRange, error) {
+	_, network, err := net.ParseCIDR(s.Network)
+	if err != nil {
+		return nil, err
+	}
+	return &AddressRange{Network: *network}, nil
+}
+
+// AddressPool is a named group of subnets with its own client DNS servers and routes.
+// DNSServers and AllowedIPs are stored comma separated; empty values fall back to the server defaults.
+// A pool with no members can be used by anyone, otherwise only by the listed members.
+// DeviceLifetime overrides the server's default device lifetime for devices in the pool; zero falls back to the default.
+type AddressPool struct {
+	gorm.Model
+	Name           string `gorm:"UNIQUE"`
+	DNSServers     string
+	AllowedIPs     string
+	DeviceLifetime time.Duration
+	Members        []AddressPoolMember `json:"-"`
+}
+
+// DNSServerList returns the pool's client DNS servers.
+func (p *AddressPool) DNSServerList() []string {
+	return splitList(p.DNSServers)
+}
+
+// AllowedIPList returns the routes clients in the pool send through the tunnel.
+func (p *AddressPool) AllowedIPList() []string {
+	return splitList(p.AllowedIPs)
+}
+
+// HasMember reports whether user may create devices in the pool.
+func (p *AddressPool) HasMember(user UserProfile) bool {
+	if len(p.Members) == 0 {
+		return true
+	}
+
+	for _, member := range p.Members {
+		if member.AuthPlatform == user.AuthPlatform && member.AuthPlatformUserID == user.AuthPlatformUserID {
+			return true
+		}
+	}
+	return false
+}
+
+// AddressPoolMember grants a user access to a restricted AddressPool.
+// Members are identified by their auth platform and its user ID so they can be added before they first log in.
+type AddressPoolMember struct {
+	gorm.Model
+	AddressPoolID      uint
+	AuthPlatform       string
+	AuthPlatformUserID string
+}
+
+func splitList(list string) []string {
+	values := []string{}
+	for _, value := range strings.Split(list, ",") {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// RoutingProfile is an admin defined set of routes, such as a full tunnel or only internal ranges, that users pick for their devices.
+// AllowedIPs is stored comma separated and rendered into the client's `[Peer] AllowedIPs`.
+type RoutingProfile struct {
+	gorm.Model
+	Name       string `gorm:"UNIQUE"`
+	AllowedIPs string
+}
+
+// AllowedIPList returns the routes clients using the profile send through the tunnel.
+func (r *RoutingProfile) AllowedIPList() []string {
+	return splitList(r.AllowedIPs)
+}
+
 // Device is a connected Wireguard peer.
 // Devices must be assigned an unassigned IP address from the `IPAddress` table
+// Devices created in a named `AddressPool` are assigned addresses from that pool's subnets instead.
+// Devices may also be assigned an IPv6 address from an IPv6 `Subnet`. IPv6Address is NULL for IPv4-only deployments so the UNIQUE constraint isn't violated.
 // Each device must have a unique IP address and public key, and we use the UNIQUE SQL constraint to enforce this.
+// RoutingProfile is stored on the device so rekeyed configs keep the routes the user picked.
+// Devices with an ExpiresAt are revoked by the ExpiryScheduler once it passes; NULL means the device never expires.
+// KeyRotatedAt is when the device's key was last generated, and DisabledAt is set when a stale key gets the device removed from the interface until its owner rekeys it.
+// HasPresharedKey records that the device was issued a preshared key so rekeying issues a new one; the key itself is never stored.
+// ClientGeneratedKey records that the device's owner generated its key pair, so rekeying must import a new public key instead of generating a private key on the server.
 type Device struct {
 	gorm.Model
-	IP        IPAddress `gorm:"foreignkey:IPAddress;auto_preload"`
-	IPAddress string    `gorm:"UNIQUE"`
-	Name      string
-	OS        string
-	Owner     UserProfile `gorm:"foreignkey:OwnerID;auto_preload"`
-	OwnerID   int
-	PublicKey string `gorm:"UNIQUE"`
+	IP                  IPAddress `gorm:"foreignkey:IPAddress;auto_preload"`
+	IPAddress           string    `gorm:"UNIQUE"`
+	IPv6Address         *string   `gorm:"column:ipv6_address;UNIQUE"`
+	Name                string
+	OS                  string
+	Owner               UserProfile `gorm:"foreignkey:OwnerID;auto_preload;association_autoupdate:false;association_autocreate:false"`
+	OwnerID             int
+	PublicKey           string       `gorm:"UNIQUE"`
+	AddressPool         *AddressPool `gorm:"foreignkey:AddressPoolID;association_autoupdate:false;association_autocreate:false"`
+	AddressPoolID       *uint
+	RoutingProfile      *RoutingProfile `gorm:"foreignkey:RoutingProfileID;association_autoupdate:false;association_autocreate:false"`
+	RoutingProfileID    *uint
+	HasPresharedKey     bool
+	ClientGeneratedKey  bool
+	ExpiresAt           *time.Time
+	ExpiryWarningSentAt *time.Time
+	KeyRotatedAt        *time.Time
+	DisabledAt          *time.Time
+}
+
+// KeyRotatedTime returns when the device's key was last rotated.
+// Devices created before key rotation was tracked fall back to their creation time.
+func (d *Device) KeyRotatedTime() time.Time {
+	if d.KeyRotatedAt != nil {
+		return *d.KeyRotatedAt
+	}
+	return d.CreatedAt
+}
+
+// AllowedIPs returns the host routes for each of the device's addresses, as configured on the Wireguard interface.
+func (d *Device) AllowedIPs() []net.IPNet {
+	allowedIPs := []net.IPNet{}
+	addresses := []string{d.IPAddress}
+	if d.IPv6Address != nil {
+		addresses = append(addresses, *d.IPv6Address)
+	}
+
+	for _, address := range addresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			continue
+		}
+
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		allowedIPs = append(allowedIPs, net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return allowedIPs
 }
 
 // UserProfile represents a user who authenticated using an OpenID integration.
 // We maintain as little information as possible about users to make this application a less attractive target to hackers.
+// Admins can see and revoke every user's devices.
+// Users are identified by their auth platform and its user ID together, since user IDs from different providers can collide.
+// AuthorizedBy records the claim that satisfied the provider's LoginPolicy at the user's latest login, so admins can see why a user has access.
+// DeviceLifetime overrides the pool and server device lifetimes for the user's devices; zero falls back to them.
+// DeviceLimit likewise overrides the server's device limit for the user's role.
 type UserProfile struct {
 	gorm.Model
-	AuthPlatformUserID string `gorm:"UNIQUE;PRIMARY_KEY"`
-	AuthPlatform       string
+	AuthPlatformUserID string `gorm:"PRIMARY_KEY;unique_index:idx_user_profiles_auth_platform_user"`
+	AuthPlatform       string `gorm:"unique_index:idx_user_profiles_auth_platform_user"`
+	IsAdmin            bool
+	AuthorizedBy       string
+	Email              string
+	DeviceLifetime     time.Duration
+	DeviceLimit        int
+}
+
+// ParseQualifiedUserID splits a provider-qualified user ID such as "okta:00u1abcd" into its auth platform and user ID.
+// User IDs are only unique within their provider, so the CLI needs both to find a user.
+func ParseQualifiedUserID(qualifiedID string) (string, string, error) {
+	parts := strings.SplitN(qualifiedID, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("expected provider:user-id, got %v", qualifiedID)
+	}
+	return parts[0], parts[1], nil
+}
+
+// APIToken lets a user manage their devices from scripts without a session cookie.
+// Only a SHA-256 hash of the token is stored, so a database leak doesn't leak usable tokens.
+// Scopes are stored comma separated.
+type APIToken struct {
+	gorm.Model
+	Name       string
+	Owner      UserProfile `gorm:"foreignkey:OwnerID;association_autoupdate:false;association_autocreate:false" json:"-"`
+	OwnerID    uint
+	TokenHash  string `gorm:"UNIQUE" json:"-"`
+	Scopes     string
+	ExpiresAt  time.Time
+	LastUsedAt *time.Time
+}
+
+// HasScope reports whether the token grants scope.
+func (a *APIToken) HasScope(scope string) bool {
+	for _, granted := range splitList(a.Scopes) {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// AuditEvent records who did what to which device or user, and from where.
+// The audit log is append-only: Database implementations only ever insert AuditEvents, so it has no UpdatedAt or DeletedAt.
+// Actor is the auth platform user ID of whoever took the action, or SystemActor for background jobs.
+// Subject is the auth platform user ID of the user the action affected, if it's different from Actor.
+type AuditEvent struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	Action    string `gorm:"index"`
+	Actor     string `gorm:"index"`
+	Subject   string
+	DeviceID  *uint `gorm:"index"`
+	Details   string
+	SourceIP  string
+	UserAgent string
+}
+
+// WebhookDelivery is a queued notification of an event to a webhook URL.
+// Deliveries are kept once they succeed or give up, so the table doubles as the delivery log.
+type WebhookDelivery struct {
+	gorm.Model
+	URL            string `gorm:"index"`
+	Event          string
+	Payload        string `gorm:"type:text"`
+	Attempts       int
+	NextAttemptAt  time.Time `gorm:"index"`
+	LastStatusCode int
+	LastError      string
+	DeliveredAt    *time.Time
+	FailedAt       *time.Time
+}
+
+// ConfigDownload holds a device's rendered client config until it's fetched from a one-time download link.
+// The config is encrypted with a key derived from the link's token and only the token's hash is stored, so the Database alone can't decrypt it.
+// Ciphertext is cleared when the link is claimed, and the row is deleted once it expires.
+type ConfigDownload struct {
+	gorm.Model
+	Owner        UserProfile `gorm:"foreignkey:OwnerID;association_autoupdate:false;association_autocreate:false" json:"-"`
+	OwnerID      uint
+	DeviceID     uint
+	TokenHash    string `gorm:"UNIQUE" json:"-"`
+	ConfigFormat string
+	Ciphertext   []byte    `json:"-"`
+	ExpiresAt    time.Time `gorm:"index"`
+	ClaimedAt    *time.Time
 }
@@ -0,0 +1,108 @@
+package wireguardhttps
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/markbates/goth"
+	"github.com/markbates/goth/providers/openidConnect"
+)
+
+// OIDCProviderConfig configures a generic OpenID Connect login provider such as Okta, Google Workspace, Keycloak or GitLab.
+type OIDCProviderConfig struct {
+	Name         string
+	DiscoveryURL string
+	ClientID     string
+	ClientSecret string
+	CallbackURL  string
+	Scopes       []string
+	Policy       LoginPolicy
+}
+
+// ParseOIDCProviderConfig parses a provider spec of semicolon separated key=value pairs, for example:
+//
+//	name=okta;discovery-url=https://example.okta.com/.well-known/openid-configuration;client-id=id;client-secret=secret;scopes=openid email
+//
+// name, discovery-url, client-id and client-secret are required.
+// scopes are space separated and default to openid, and callback-url defaults to the /api/auth/callback route on httpHost.
+// allowed-groups, allowed-roles and allowed-email-domains are space separated and set the provider's LoginPolicy.
+// groups-claim and roles-claim name the ID token claims holding groups and roles if the provider doesn't use "groups" and "roles".
+func ParseOIDCProviderConfig(spec string, httpHost *url.URL) (*OIDCProviderConfig, error) {
+	config := &OIDCProviderConfig{}
+	for _, pair := range strings.Split(spec, ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected key=value in OpenID Connect provider spec, got %v", pair)
+		}
+
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		switch key {
+		case "name":
+			config.Name = value
+		case "discovery-url":
+			config.DiscoveryURL = value
+		case "client-id":
+			config.ClientID = value
+		case "client-secret":
+			config.ClientSecret = value
+		case "callback-url":
+			config.CallbackURL = value
+		case "scopes":
+			config.Scopes = strings.Fields(value)
+		case "allowed-groups":
+			config.Policy.AllowedGroups = strings.Fields(value)
+		case "allowed-roles":
+			config.Policy.AllowedRoles = strings.Fields(value)
+		case "allowed-email-domains":
+			config.Policy.AllowedEmailDomains = strings.Fields(value)
+		case "groups-claim":
+			config.Policy.GroupsClaim = value
+		case "roles-claim":
+			config.Policy.RolesClaim = value
+		default:
+			return nil, fmt.Errorf("unknown OpenID Connect provider option %v", key)
+		}
+	}
+
+	if config.Name == "" || config.DiscoveryURL == "" || config.ClientID == "" || config.ClientSecret == "" {
+		return nil, fmt.Errorf("OpenID Connect providers need a name, discovery-url, client-id and client-secret")
+	}
+
+	// The CLI identifies users as provider:user-id, so provider names can't contain a colon.
+	if strings.Contains(config.Name, ":") {
+		return nil, fmt.Errorf("OpenID Connect provider names can't contain a colon, got %v", config.Name)
+	}
+
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid"}
+	}
+
+	if config.CallbackURL == "" {
+		callbackURL := url.URL{
+			Scheme:   "https",
+			Host:     httpHost.String(),
+			Path:     "/api/auth/callback",
+			RawQuery: url.Values{"provider": []string{config.Name}}.Encode(),
+		}
+		config.CallbackURL = callbackURL.String()
+	}
+	return config, nil
+}
+
+// Provider builds the goth provider for the config.
+// This fetches the provider's discovery document, so it makes a network request.
+func (o *OIDCProviderConfig) Provider() (goth.Provider, error) {
+	provider, err := openidConnect.New(o.ClientID, o.ClientSecret, o.CallbackURL, o.DiscoveryURL, o.Scopes...)
+	if err != nil {
+		return nil, err
+	}
+
+	provider.SetName(o.Name)
+	return provider, nil
+}
@@ -0,0 +1,44 @@
+package wireguardhttps
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseOIDCProviderConfig(t *testing.T) {
+	httpHost, _ := url.Parse("vpn.example.com")
+	spec := "name=okta; discovery-url=https://example.okta.com/.well-known/openid-configuration; client-id=id; client-secret=secret; scopes=openid email groups"
+	config, err := ParseOIDCProviderConfig(spec, httpHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Name != "okta" || config.ClientID != "id" || config.ClientSecret != "secret" {
+		t.Fatalf("Unexpected config %v", config)
+	}
+
+	if len(config.Scopes) != 3 || config.Scopes[2] != "groups" {
+		t.Fatalf("Expected [openid email groups], got %v", config.Scopes)
+	}
+
+	expectedCallbackURL := "https://vpn.example.com/api/auth/callback?provider=okta"
+	if config.CallbackURL != expectedCallbackURL {
+		t.Fatalf("Expected %v, got %v", expectedCallbackURL, config.CallbackURL)
+	}
+}
+
+func TestParseOIDCProviderConfigRejectsIncompleteSpecs(t *testing.T) {
+	httpHost, _ := url.Parse("vpn.example.com")
+	specs := []string{
+		"name=okta;client-id=id;client-secret=secret",
+		"name=okta;discovery-url=https://example.okta.com;client-id=id;client-secret=secret;tenant=acme",
+		"okta",
+	}
+
+	for _, spec := range specs {
+		_, err := ParseOIDCProviderConfig(spec, httpHost)
+		if err == nil {
+			t.Fatalf("Expected error for %v", spec)
+		}
+	}
+}
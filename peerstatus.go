@@ -0,0 +1,79 @@
+package wireguardhttps
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/joncooperworks/wgrpcd"
+)
+
+// PeerStatusCache caches the peers listed by wgrpcd so listing devices doesn't make a gRPC call on every request.
+// Failures are cached too, so an unreachable wgrpcd isn't called, and waited on, by every request either.
+type PeerStatusCache struct {
+	client     WireguardClient
+	deviceName string
+	ttl        time.Duration
+
+	mutex   sync.Mutex
+	fetched time.Time
+	peers   map[string]*wgrpcd.Peer
+	err     error
+}
+
+// NewPeerStatusCache returns a PeerStatusCache that lists the peers on deviceName at most once every ttl.
+func NewPeerStatusCache(client WireguardClient, deviceName string, ttl time.Duration) *PeerStatusCache {
+	return &PeerStatusCache{
+		client:     client,
+		deviceName: deviceName,
+		ttl:        ttl,
+	}
+}
+
+// Peers returns the peers on the Wireguard interface keyed by public key.
+func (p *PeerStatusCache) Peers() (map[string]*wgrpcd.Peer, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if (p.peers != nil || p.err != nil) && time.Since(p.fetched) < p.ttl {
+		return p.peers, p.err
+	}
+
+	peers, err := p.client.ListPeers(context.Background(), p.deviceName)
+	p.fetched = time.Now()
+	if err != nil {
+		p.peers, p.err = nil, err
+		return nil, err
+	}
+
+	p.err = nil
+	p.peers = map[string]*wgrpcd.Peer{}
+	for _, peer := range peers {
+		p.peers[peer.PublicKey] = peer
+	}
+	return p.peers, nil
+}
+
+// Status returns the live status of the device's peer, or nil if it isn't on the Wireguard interface.
+func (p *PeerStatusCache) Status(device Device) (*DeviceStatus, error) {
+	peers, err := p.Peers()
+	if err != nil {
+		return nil, err
+	}
+
+	peer, ok := peers[device.PublicKey]
+	if !ok {
+		return nil, nil
+	}
+
+	status := &DeviceStatus{
+		ReceivedBytes:    peer.ReceivedBytes,
+		TransmittedBytes: peer.TransmittedBytes,
+	}
+	// wgrpcd reports the zero time as a negative Unix timestamp for peers that have never completed a handshake.
+	if peer.LastSeen > 0 {
+		lastHandshake := time.Unix(peer.LastSeen, 0).UTC()
+		status.LastHandshake = &lastHandshake
+	}
+	return status, nil
+}
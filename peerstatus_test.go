@@ -0,0 +1,56 @@
+package wireguardhttps
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestPeerStatusCacheListsPeersOncePerTTL(t *testing.T) {
+	client := &testwgrpcdClient{}
+	cache := NewPeerStatusCache(client, "wg0", time.Hour)
+	for i := 0; i < 3; i++ {
+		_, err := cache.Peers()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if client.listPeersCalls != 1 {
+		t.Fatalf("Expected 1 ListPeers call, got %v", client.listPeersCalls)
+	}
+
+	cache.ttl = 0
+	_, err := cache.Peers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if client.listPeersCalls != 2 {
+		t.Fatalf("Expected expired cache to list peers again, got %v calls", client.listPeersCalls)
+	}
+}
+
+func TestPeerStatusCacheCachesFailuresPerTTL(t *testing.T) {
+	client := &testwgrpcdClient{listPeersErr: status.Error(codes.Unavailable, "wgrpcd unreachable")}
+	cache := NewPeerStatusCache(client, "wg0", time.Hour)
+	for i := 0; i < 3; i++ {
+		_, err := cache.Peers()
+		if err != client.listPeersErr {
+			t.Fatalf("Expected %v, got %v", client.listPeersErr, err)
+		}
+	}
+
+	if client.listPeersCalls != 1 {
+		t.Fatalf("Expected 1 ListPeers call while wgrpcd is failing, got %v", client.listPeersCalls)
+	}
+
+	client.listPeersErr = nil
+	cache.ttl = 0
+	_, err := cache.Peers()
+	if err != nil {
+		t.Fatalf("Expected the failure to expire with the TTL, got %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package wireguardhttps
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	peerConfigFormatText = "text"
+	peerConfigFormatPNG  = "png"
+	peerConfigFormatSVG  = "svg"
+
+	qrCodePNGSize = 512
+)
+
+// peerConfigFormat picks how a rendered peer config is returned, either from the format query parameter or the Accept header.
+// Phones can scan the png and svg QR codes from the Wireguard app instead of copying the private key by hand.
+// It returns false if the format query parameter isn't a known format.
+func peerConfigFormat(c *gin.Context) (string, bool) {
+	switch format := c.Query("format"); format {
+	case peerConfigFormatText, peerConfigFormatPNG, peerConfigFormatSVG:
+		return format, true
+	case "":
+	default:
+		return "", false
+	}
+
+	switch c.NegotiateFormat("text/plain", "image/png", "image/svg+xml") {
+	case "image/png":
+		return peerConfigFormatPNG, true
+	case "image/svg+xml":
+		return peerConfigFormatSVG, true
+	default:
+		return peerConfigFormatText, true
+	}
+}
+
+// writePeerConfig writes a rendered peer config in the requested format.
+// Configs contain private keys, so they must never be cached.
+func writePeerConfig(c *gin.Context, format string, peerConfig []byte) error {
+	c.Header("Cache-Control", "no-store")
+	switch format {
+	case peerConfigFormatPNG:
+		png, err := qrcode.Encode(string(peerConfig), qrcode.Medium, qrCodePNGSize)
+		if err != nil {
+			return err
+		}
+		c.Data(http.StatusOK, "image/png", png)
+
+	case peerConfigFormatSVG:
+		svg, err := QRCodeSVG(peerConfig)
+		if err != nil {
+			return err
+		}
+		c.Data(http.StatusOK, "image/svg+xml", svg)
+
+	default:
+		c.Data(http.StatusOK, "text/plain", peerConfig)
+	}
+	return nil
+}
+
+// QRCodeSVG encodes data as a QR code drawn with one SVG rect per dark module.
+func QRCodeSVG(data []byte) ([]byte, error) {
+	code, err := qrcode.New(string(data), qrcode.Medium)
+	if err != nil {
+		return nil, err
+	}
+
+	bitmap := code.Bitmap()
+	buffer := &bytes.Buffer{}
+	fmt.Fprintf(buffer, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, len(bitmap), len(bitmap))
+	fmt.Fprintf(buffer, `<rect width="%d" height="%d" fill="#ffffff"/>`, len(bitmap), len(bitmap))
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(buffer, `<rect x="%d" y="%d" width="1" height="1" fill="#000000"/>`, x, y)
+			}
+		}
+	}
+	buffer.WriteString("</svg>")
+	return buffer.Bytes(), nil
+}
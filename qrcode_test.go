@@ -0,0 +1,69 @@
+package wireguardhttps
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestNewDeviceReturnsQRCodes(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	err := db.RegisterSubnet(mustParseCIDR("10.0.0.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.RegisterUser("jontom@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := testServerConfig(t, db)
+
+	cases := []struct {
+		url                 string
+		expectedContentType string
+		expectedPrefix      []byte
+	}{
+		{"/api/devices?format=png", "image/png", []byte("\x89PNG")},
+		{"/api/devices?format=svg", "image/svg+xml", []byte("<svg")},
+	}
+	for _, testCase := range cases {
+		// The test wgrpcd client always returns the same public key, so remove the previous device first.
+		devices, err := db.Devices(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, device := range devices {
+			err = db.RemoveDevice(user, device, func() error { return nil })
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		writer := serveAsUser(t, config, &user, "POST", testCase.url, DeviceRequest{Name: "Pixel", OS: "Android"})
+		if writer.Code != 200 {
+			t.Fatalf("Expected status code 200 for %v, got %v", testCase.url, writer.Code)
+		}
+
+		if !strings.HasPrefix(writer.Header().Get("Content-Type"), testCase.expectedContentType) {
+			t.Fatalf("Expected %v, got %v", testCase.expectedContentType, writer.Header().Get("Content-Type"))
+		}
+
+		if writer.Header().Get("Cache-Control") != "no-store" {
+			t.Fatalf("Expected Cache-Control: no-store for %v, got %v", testCase.url, writer.Header().Get("Cache-Control"))
+		}
+
+		if !bytes.HasPrefix(writer.Body.Bytes(), testCase.expectedPrefix) {
+			t.Fatalf("Expected %v to start with %q", testCase.url, testCase.expectedPrefix)
+		}
+	}
+
+	writer := serveAsUser(t, config, &user, "POST", "/api/devices?format=gif", DeviceRequest{Name: "Pixel", OS: "Android"})
+	if writer.Code != 400 {
+		t.Fatalf("Expected status code 400 for unknown format, got %v", writer.Code)
+	}
+}
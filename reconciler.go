@@ -0,0 +1,184 @@
+package wireguardhttps
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// ReconciliationReport describes how the devices table has drifted from the peers configured on the Wireguard interface.
+type ReconciliationReport struct {
+	// OrphanPeers are public keys of peers on the interface with no matching device.
+	OrphanPeers []string `json:"orphan_peers"`
+	// MissingPeers are devices with no matching peer on the interface.
+	MissingPeers []Device `json:"missing_peers"`
+}
+
+// InSync reports whether the database and the Wireguard interface agree.
+func (r *ReconciliationReport) InSync() bool {
+	return len(r.OrphanPeers) == 0 && len(r.MissingPeers) == 0
+}
+
+// Reconciler detects and repairs drift between the Database and the live Wireguard interface.
+// Orphan peers can always be safely removed from the interface.
+// wgrpcd can't add a peer with an existing public key, so missing peers can only be repaired by deleting their device records, which forces their owners to create them again.
+// This is destructive if the interface was wiped by a restart, so PruneMissing must be opted in to.
+// A Reconciler remembers the orphans found by its last Reconcile call, so it must not be used concurrently.
+type Reconciler struct {
+	Database            Database
+	WireguardClient     WireguardClient
+	WireguardDeviceName string
+	PruneMissing        bool
+
+	// previousOrphans are the orphan peers found by the last call to Reconcile.
+	previousOrphans map[string]bool
+}
+
+// Check compares the devices table with the peers on the Wireguard interface without changing either.
+// Peers are listed before devices are read, so a device created in between is reported missing rather than its live peer reported as an orphan.
+func (r *Reconciler) Check() (*ReconciliationReport, error) {
+	peers, err := r.WireguardClient.ListPeers(context.Background(), r.WireguardDeviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	devices, err := r.Database.AllDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	configured := map[string]bool{}
+	for _, peer := range peers {
+		configured[peer.PublicKey] = true
+	}
+
+	known := map[string]bool{}
+	report := &ReconciliationReport{OrphanPeers: []string{}, MissingPeers: []Device{}}
+	for _, device := range devices {
+		// Disabled devices are kept off the interface on purpose, so their peers are orphans if they're still configured.
+		if device.DisabledAt != nil {
+			continue
+		}
+
+		known[device.PublicKey] = true
+		if !configured[device.PublicKey] {
+			report.MissingPeers = append(report.MissingPeers, device)
+		}
+	}
+
+	for _, peer := range peers {
+		if !known[peer.PublicKey] {
+			report.OrphanPeers = append(report.OrphanPeers, peer.PublicKey)
+		}
+	}
+	return report, nil
+}
+
+// Repair removes the report's orphan peers from the Wireguard interface, and deletes its missing devices if PruneMissing is set.
+// A new device's peer is added to the interface before its record is committed, so it can look orphaned for as long as CreateDevice takes.
+// Orphans are only removed if the previous call to Reconcile found them too, which means they've been orphaned for at least one full interval.
+// Devices can be created and deleted while the server is running, so the report is checked again first and only drift found both times is repaired.
+// Peers and devices that can't be repaired are skipped and their errors returned together in a *BatchError.
+func (r *Reconciler) Repair(report *ReconciliationReport) error {
+	current, err := r.Check()
+	if err != nil {
+		return err
+	}
+
+	stillOrphaned := map[string]bool{}
+	for _, orphan := range current.OrphanPeers {
+		stillOrphaned[orphan] = true
+	}
+
+	stillMissing := map[uint]bool{}
+	for _, device := range current.MissingPeers {
+		stillMissing[device.ID] = true
+	}
+
+	errs := []error{}
+	for _, orphan := range report.OrphanPeers {
+		if !stillOrphaned[orphan] || !r.previousOrphans[orphan] {
+			continue
+		}
+
+		publicKey, err := wgtypes.ParseKey(orphan)
+		if err != nil {
+			log.Printf("Failed to parse orphan peer %v: %v", orphan, err)
+			errs = append(errs, err)
+			continue
+		}
+
+		_, err = r.WireguardClient.RemovePeer(context.Background(), r.WireguardDeviceName, publicKey)
+		if err != nil {
+			log.Printf("Failed to remove orphan peer %v: %v", orphan, err)
+			errs = append(errs, err)
+			continue
+		}
+		log.Printf("Removed orphan peer %v", orphan)
+	}
+
+	if !r.PruneMissing {
+		return batchError(errs)
+	}
+
+	for _, device := range report.MissingPeers {
+		if !stillMissing[device.ID] {
+			continue
+		}
+
+		// The peer is already gone from the interface, so there's nothing to delete there.
+		err := r.Database.RemoveDevice(device.Owner, device, func() error { return nil })
+		if err != nil {
+			log.Printf("Failed to prune device %v: %v", device.ID, err)
+			errs = append(errs, err)
+			continue
+		}
+		log.Printf("Pruned device %v missing from the Wireguard interface", device)
+	}
+	return batchError(errs)
+}
+
+// Reconcile checks for drift, logs what it finds and repairs it if repair is true.
+// The orphans it finds are remembered so the next call can remove the ones that are still there.
+func (r *Reconciler) Reconcile(repair bool) (*ReconciliationReport, error) {
+	report, err := r.Check()
+	if err != nil {
+		return nil, err
+	}
+
+	orphans := map[string]bool{}
+	for _, orphan := range report.OrphanPeers {
+		orphans[orphan] = true
+	}
+	defer func() { r.previousOrphans = orphans }()
+
+	if report.InSync() {
+		return report, nil
+	}
+
+	log.Printf("Found %v orphan peers and %v devices missing from %v", len(report.OrphanPeers), len(report.MissingPeers), r.WireguardDeviceName)
+	if repair {
+		err = r.Repair(report)
+	}
+	return report, err
+}
+
+// Run reconciles every interval until ctx is cancelled.
+func (r *Reconciler) Run(ctx context.Context, interval time.Duration, repair bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := r.Reconcile(repair)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
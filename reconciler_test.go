@@ -0,0 +1,177 @@
+package wireguardhttps
+
+import (
+	"net"
+	"testing"
+
+	"github.com/joncooperworks/wgrpcd"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func mustGenerateKey(t *testing.T) string {
+	privateKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return privateKey.PublicKey().String()
+}
+
+func TestReconcilerDetectsAndRepairsDrift(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	err := db.RegisterSubnet(mustParseCIDR("10.0.0.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.RegisterUser("jontom@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	syncedKey := mustGenerateKey(t)
+	missingKey := mustGenerateKey(t)
+	orphanKey := mustGenerateKey(t)
+	for _, key := range []string{syncedKey, missingKey} {
+		deviceFunc := func(allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
+			return &wgrpcd.PeerConfigInfo{PublicKey: key, AllowedIPs: allowedIPs}, nil
+		}
+		_, _, err = db.CreateDevice(user, nil, Device{Name: key, OS: "Linux"}, nil, deviceFunc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client := &testwgrpcdClient{
+		peers: []*wgrpcd.Peer{{PublicKey: syncedKey}, {PublicKey: orphanKey}},
+	}
+	reconciler := &Reconciler{
+		Database:            db,
+		WireguardClient:     client,
+		WireguardDeviceName: "wg0",
+	}
+
+	report, err := reconciler.Reconcile(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.OrphanPeers) != 1 || report.OrphanPeers[0] != orphanKey {
+		t.Fatalf("Expected orphan peer %v, got %v", orphanKey, report.OrphanPeers)
+	}
+
+	if len(report.MissingPeers) != 1 || report.MissingPeers[0].PublicKey != missingKey {
+		t.Fatalf("Expected missing peer %v, got %v", missingKey, report.MissingPeers)
+	}
+
+	if len(client.removedPeers) != 0 {
+		t.Fatalf("Expected dry run to leave the interface alone, got %v removed", client.removedPeers)
+	}
+
+	reconciler.PruneMissing = true
+	_, err = reconciler.Reconcile(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(client.removedPeers) != 1 || client.removedPeers[0] != orphanKey {
+		t.Fatalf("Expected %v to be removed, got %v", orphanKey, client.removedPeers)
+	}
+
+	devices, err := db.Devices(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(devices) != 1 || devices[0].PublicKey != syncedKey {
+		t.Fatalf("Expected only %v to remain, got %v", syncedKey, devices)
+	}
+}
+
+func TestReconcilerRepairSkipsDriftThatResolvedItself(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	err := db.RegisterSubnet(mustParseCIDR("10.0.0.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.RegisterUser("jontom@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newKey := mustGenerateKey(t)
+	client := &testwgrpcdClient{peers: []*wgrpcd.Peer{{PublicKey: newKey}}}
+	reconciler := &Reconciler{
+		Database:            db,
+		WireguardClient:     client,
+		WireguardDeviceName: "wg0",
+		PruneMissing:        true,
+	}
+
+	report, err := reconciler.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.OrphanPeers) != 1 {
+		t.Fatalf("Expected the new peer to look orphaned before its device is saved, got %v", report.OrphanPeers)
+	}
+
+	// The device finishes being created after the check.
+	deviceFunc := func(allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
+		return &wgrpcd.PeerConfigInfo{PublicKey: newKey, AllowedIPs: allowedIPs}, nil
+	}
+	_, _, err = db.CreateDevice(user, nil, Device{Name: "Laptop", OS: "Linux"}, nil, deviceFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = reconciler.Repair(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(client.removedPeers) != 0 {
+		t.Fatalf("Expected the live peer to be kept, got %v removed", client.removedPeers)
+	}
+}
+
+func TestReconcilerOnlyRemovesOrphansSeenOnAnEarlierRun(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	orphanKey := mustGenerateKey(t)
+	client := &testwgrpcdClient{peers: []*wgrpcd.Peer{{PublicKey: orphanKey}}}
+	reconciler := &Reconciler{
+		Database:            db,
+		WireguardClient:     client,
+		WireguardDeviceName: "wg0",
+	}
+
+	report, err := reconciler.Reconcile(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.OrphanPeers) != 1 {
+		t.Fatalf("Expected %v to be reported as an orphan, got %v", orphanKey, report.OrphanPeers)
+	}
+
+	if len(client.removedPeers) != 0 {
+		t.Fatalf("Expected a newly seen orphan to be kept, got %v removed", client.removedPeers)
+	}
+
+	_, err = reconciler.Reconcile(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(client.removedPeers) != 1 || client.removedPeers[0] != orphanKey {
+		t.Fatalf("Expected %v to be removed once it was seen twice, got %v", orphanKey, client.removedPeers)
+	}
+}
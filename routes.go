@@ -2,6 +2,7 @@ package wireguardhttps
 
 import (
 	"encoding/gob"
+	"time"
 
 	"github.com/gin-contrib/gzip"
 	"github.com/gin-contrib/secure"
@@ -16,6 +17,11 @@ func Router(config *ServerConfig) *gin.Engine {
 	goth.UseProviders(config.AuthProviders...)
 	gob.Register(&UserProfile{})
 	router := gin.Default()
+	router.ForwardedByClientIP = config.TrustProxyHeaders
+
+	if config.Metrics != nil {
+		router.Use(config.Metrics.Middleware())
+	}
 
 	router.Use(gzip.Gzip(gzip.DefaultCompression, gzip.WithExcludedPaths([]string{"/api/"})))
 
@@ -34,7 +40,15 @@ func Router(config *ServerConfig) *gin.Engine {
 	// JavaScript SPA frontend
 	router.Use(static.Serve("/", static.LocalFile(config.StaticAssetsDir, true)))
 
-	handlers := &WireguardHandlers{ServerConfig: config}
+	peerStatusTTL := config.PeerStatusTTL
+	if peerStatusTTL == 0 {
+		peerStatusTTL = 10 * time.Second
+	}
+
+	handlers := &WireguardHandlers{
+		ServerConfig: config,
+		peerStatus:   NewPeerStatusCache(config.WireguardClient, config.WireguardDeviceName, peerStatusTTL),
+	}
 
 	// API
 	api := router.Group("/api")
@@ -46,21 +60,58 @@ func Router(config *ServerConfig) *gin.Engine {
 	auth.GET("/authenticate", handlers.AuthenticateHandler)
 	auth.GET("/logout", handlers.LogoutHandler)
 
+	// One-time config download links are authenticated by their token, so they can be opened on a device that isn't logged in.
+	// Opening a link only shows a page; the link is claimed when that page's form is posted.
+	api.GET("/downloads/:token", handlers.ConfigDownloadPageHandler)
+	api.POST("/downloads/:token", handlers.ClaimConfigDownloadHandler)
+
 	// Private routes
 	private := api.Group("/")
-	private.Use(AuthenticationRequiredMiddleware(config.SessionStore, config.SessionName))
+	private.Use(TokenOrSessionAuthenticationMiddleware(config.Database, config.SessionStore, config.SessionName))
 
 	if !config.IsDebug {
 		csrfMiddleware := csrf.Protect(config.CSRFKey)
 		private.Use(adapter.Wrap(csrfMiddleware))
 	}
+	readDevices := ScopeRequiredMiddleware(ScopeDevicesRead)
+	writeDevices := ScopeRequiredMiddleware(ScopeDevicesWrite)
+
 	// Devices
-	private.POST("/devices", handlers.NewDeviceHandler)
-	private.POST("/devices/:device_id", handlers.RekeyDeviceHandler)
-	private.DELETE("/devices/:device_id", handlers.DeleteDeviceHandler)
-	private.GET("/devices", handlers.ListUserDevicesHandler)
+	private.POST("/devices", writeDevices, handlers.NewDeviceHandler)
+	private.POST("/devices/:device_id", writeDevices, handlers.RekeyDeviceHandler)
+	private.POST("/devices/:device_id/extend", writeDevices, handlers.ExtendDeviceHandler)
+	private.DELETE("/devices/:device_id", writeDevices, handlers.DeleteDeviceHandler)
+	private.GET("/devices", readDevices, handlers.ListUserDevicesHandler)
+	private.GET("/devices/:device_id", readDevices, handlers.DeviceHandler)
+
+	// Address Pools
+	private.GET("/pools", readDevices, handlers.ListUserPoolsHandler)
+
+	// Routing Profiles
+	private.GET("/routing-profiles", readDevices, handlers.ListRoutingProfilesHandler)
+
+	// Client Config Formats
+	private.GET("/config-formats", readDevices, handlers.ListConfigFormatsHandler)
+
+	// API Tokens
+	tokens := private.Group("/tokens")
+	tokens.Use(SessionRequiredMiddleware)
+	tokens.POST("", handlers.NewAPITokenHandler)
+	tokens.GET("", handlers.ListAPITokensHandler)
+	tokens.DELETE("/:token_id", handlers.RevokeAPITokenHandler)
 
 	// User Profile
 	private.GET("/me", handlers.UserProfileInfoHandler)
+
+	// Admin
+	admin := private.Group("/admin")
+	admin.Use(SessionRequiredMiddleware, AdminRequiredMiddleware(config.Database))
+	admin.GET("/users", handlers.AdminListUsersHandler)
+	admin.DELETE("/users/:user_id", handlers.AdminDeleteUserHandler)
+	admin.GET("/devices", handlers.AdminListDevicesHandler)
+	admin.DELETE("/devices/:device_id", handlers.AdminDeleteDeviceHandler)
+	admin.PUT("/routing-profiles/:name", handlers.AdminSaveRoutingProfileHandler)
+	admin.GET("/audit", handlers.AdminAuditLogHandler)
+	admin.GET("/webhooks/deliveries", handlers.AdminWebhookDeliveriesHandler)
 	return router
 }
@@ -10,5 +10,8 @@ func NewSQLiteDatabase(path string) (Database, error) {
 	if err != nil {
 		return nil, wrapPackageError(err)
 	}
+
+	// SQLite doesn't support concurrent writers, and each connection to an in-memory database gets its own copy of the database.
+	db.DB().SetMaxOpenConns(1)
 	return &dataOperations{db: db}, nil
 }
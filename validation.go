@@ -0,0 +1,57 @@
+package wireguardhttps
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// MaxDeviceNameLength is the longest device name users can pick.
+const MaxDeviceNameLength = 64
+
+// DeviceOperatingSystems are the operating systems a device can be registered with.
+var DeviceOperatingSystems = []string{"Windows", "macOS", "Linux", "iOS", "Android", "ChromeOS", "Other"}
+
+var deviceNamePattern = regexp.MustCompile(`^[\p{L}\p{N} '._()-]+$`)
+
+// ValidationError describes a request field that failed validation.
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (v *ValidationError) Error() string {
+	return fmt.Sprintf("%v: %v", v.Field, v.Message)
+}
+
+// Validate checks the device's name and operating system.
+// Names must be 1 to MaxDeviceNameLength letters, numbers, spaces or simple punctuation, and OS must be one of DeviceOperatingSystems.
+func (r *DeviceRequest) Validate() error {
+	nameLength := len([]rune(r.Name))
+	if nameLength == 0 || nameLength > MaxDeviceNameLength {
+		return &ValidationError{Field: "name", Message: fmt.Sprintf("must be between 1 and %v characters", MaxDeviceNameLength)}
+	}
+
+	if !deviceNamePattern.MatchString(r.Name) {
+		return &ValidationError{Field: "name", Message: "may only contain letters, numbers, spaces and ' . _ ( ) -"}
+	}
+
+	for _, os := range DeviceOperatingSystems {
+		if r.OS == os {
+			return nil
+		}
+	}
+	return &ValidationError{Field: "os", Message: fmt.Sprintf("must be one of %v", DeviceOperatingSystems)}
+}
+
+// DeviceLimit returns how many devices user may have.
+// The user's own limit takes precedence over the limit for their role. Zero means there is no limit.
+func DeviceLimit(userLimit, adminLimit int, user UserProfile) int {
+	if user.DeviceLimit > 0 {
+		return user.DeviceLimit
+	}
+
+	if user.IsAdmin {
+		return adminLimit
+	}
+	return userLimit
+}
@@ -0,0 +1,113 @@
+package wireguardhttps
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDeviceRequestValidation(t *testing.T) {
+	tests := []struct {
+		request DeviceRequest
+		field   string
+	}{
+		{DeviceRequest{Name: "Jon's Macbook Pro (2019)", OS: "macOS"}, ""},
+		{DeviceRequest{Name: "Pixel-4a_work", OS: "Android"}, ""},
+		{DeviceRequest{Name: "", OS: "Linux"}, "name"},
+		{DeviceRequest{Name: strings.Repeat("a", MaxDeviceNameLength+1), OS: "Linux"}, "name"},
+		{DeviceRequest{Name: "<script>", OS: "Linux"}, "name"},
+		{DeviceRequest{Name: "Laptop", OS: "TempleOS"}, "os"},
+		{DeviceRequest{Name: "Laptop", OS: ""}, "os"},
+	}
+
+	for _, test := range tests {
+		err := test.request.Validate()
+		if test.field == "" {
+			if err != nil {
+				t.Fatalf("Expected %v to be valid, got %v", test.request, err)
+			}
+			continue
+		}
+
+		validationErr, ok := err.(*ValidationError)
+		if !ok || validationErr.Field != test.field {
+			t.Fatalf("Expected %v to fail validation on %v, got %v", test.request, test.field, err)
+		}
+	}
+}
+
+func TestDeviceLimitPrecedence(t *testing.T) {
+	if limit := DeviceLimit(3, 10, UserProfile{}); limit != 3 {
+		t.Fatalf("Expected user limit 3, got %v", limit)
+	}
+
+	if limit := DeviceLimit(3, 10, UserProfile{IsAdmin: true}); limit != 10 {
+		t.Fatalf("Expected admin limit 10, got %v", limit)
+	}
+
+	if limit := DeviceLimit(3, 10, UserProfile{IsAdmin: true, DeviceLimit: 1}); limit != 1 {
+		t.Fatalf("Expected per-user limit 1, got %v", limit)
+	}
+}
+
+func TestNewDeviceEnforcesLimitAndValidation(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	err := db.RegisterSubnet(mustParseCIDR("10.0.0.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.RegisterUser("jontom@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := testServerConfig(t, db)
+	config.DeviceLimit = 1
+
+	writer := serveAsUser(t, config, &user, "POST", "/api/devices", DeviceRequest{Name: strings.Repeat("a", 1<<20), OS: "Linux"})
+	if writer.Code != 400 {
+		t.Fatalf("Expected status code 400 for oversized name, got %v", writer.Code)
+	}
+
+	var validationErr APIError
+	err = json.NewDecoder(writer.Body).Decode(&validationErr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if validationErr.Code != ErrorCodeValidationFailed || validationErr.Field != "name" || validationErr.Message == "" {
+		t.Fatalf("Expected error explaining the invalid name, got %v", validationErr)
+	}
+
+	writer = serveAsUser(t, config, &user, "POST", "/api/devices", DeviceRequest{Name: "Laptop", OS: "Linux", PublicKey: mustGenerateKey(t)})
+	if writer.Code != 200 {
+		t.Fatalf("Expected status code 200 for /devices, got %v", writer.Code)
+	}
+
+	writer = serveAsUser(t, config, &user, "POST", "/api/devices", DeviceRequest{Name: "Phone", OS: "Android", PublicKey: mustGenerateKey(t)})
+	if writer.Code != 403 {
+		t.Fatalf("Expected status code 403 over the device limit, got %v", writer.Code)
+	}
+
+	var limitErr APIError
+	err = json.NewDecoder(writer.Body).Decode(&limitErr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if limitErr.Code != ErrorCodeDeviceLimitReached || limitErr.Message == "" {
+		t.Fatalf("Expected error explaining the device limit, got %v", limitErr)
+	}
+
+	devices, err := db.Devices(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(devices) != 1 {
+		t.Fatalf("Expected 1 device within the limit, got %v", len(devices))
+	}
+}
@@ -0,0 +1,239 @@
+package wireguardhttps
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers sent with every webhook delivery.
+// The signature is the hex encoded HMAC-SHA256 of the request body keyed with the webhook's secret, prefixed with "sha256=".
+const (
+	WebhookEventHeader     = "X-Wireguardhttps-Event"
+	WebhookDeliveryHeader  = "X-Wireguardhttps-Delivery"
+	WebhookSignatureHeader = "X-Wireguardhttps-Signature"
+)
+
+// defaultWebhookDeliveryLimit is how many deliveries the admin delivery log API returns unless asked for more.
+const defaultWebhookDeliveryLimit = 100
+
+// Webhook is an endpoint notified of audited events.
+// Events lists the AuditEvent actions it's sent. When it's empty the webhook is sent every device and admin event.
+type Webhook struct {
+	URL    string
+	Secret []byte
+	Events []string
+}
+
+// Subscribes reports whether the webhook should be sent events with action.
+func (w *Webhook) Subscribes(action string) bool {
+	if len(w.Events) == 0 {
+		return strings.HasPrefix(action, "device.") || strings.HasPrefix(action, "admin.")
+	}
+
+	for _, event := range w.Events {
+		if event == action {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookPayload is the JSON body of a webhook delivery.
+type WebhookPayload struct {
+	Event     string    `json:"event"`
+	Timestamp time.Time `json:"timestamp"`
+	Actor     string    `json:"actor"`
+	Subject   string    `json:"subject,omitempty"`
+	DeviceID  *uint     `json:"device_id,omitempty"`
+	Details   string    `json:"details,omitempty"`
+	SourceIP  string    `json:"source_ip,omitempty"`
+}
+
+// SignWebhookPayload returns the WebhookSignatureHeader value for payload signed with secret.
+func SignWebhookPayload(secret, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookDispatcher queues events for each subscribed Webhook in the Database and delivers them, retrying failures with exponential backoff.
+// Queued deliveries survive restarts. A nil *WebhookDispatcher notifies nobody.
+type WebhookDispatcher struct {
+	Database    Database
+	Webhooks    []Webhook
+	Client      *http.Client
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	wake        chan struct{}
+}
+
+// NewWebhookDispatcher creates a WebhookDispatcher that gives up on a delivery after 8 attempts, backing off from 30 seconds up to an hour between them.
+func NewWebhookDispatcher(database Database, webhooks []Webhook) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		Database:    database,
+		Webhooks:    webhooks,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		MaxAttempts: 8,
+		Backoff:     30 * time.Second,
+		MaxBackoff:  time.Hour,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Notify queues event for every webhook subscribed to it and wakes Run to deliver them.
+// Failures are logged rather than returned since the event has already happened.
+func (w *WebhookDispatcher) Notify(event AuditEvent) {
+	if w == nil {
+		return
+	}
+
+	payload, err := json.Marshal(WebhookPayload{
+		Event:     event.Action,
+		Timestamp: time.Now().UTC(),
+		Actor:     event.Actor,
+		Subject:   event.Subject,
+		DeviceID:  event.DeviceID,
+		Details:   event.Details,
+		SourceIP:  event.SourceIP,
+	})
+	if err != nil {
+		log.Printf("Failed to encode webhook payload for %v: %v", event.Action, err)
+		return
+	}
+
+	queued := false
+	for _, webhook := range w.Webhooks {
+		if !webhook.Subscribes(event.Action) {
+			continue
+		}
+
+		_, err = w.Database.EnqueueWebhookDelivery(WebhookDelivery{
+			URL:           webhook.URL,
+			Event:         event.Action,
+			Payload:       string(payload),
+			NextAttemptAt: time.Now(),
+		})
+		if err != nil {
+			log.Printf("Failed to queue %v webhook for %v: %v", event.Action, webhook.URL, err)
+			continue
+		}
+		queued = true
+	}
+
+	if queued {
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// DeliverPending attempts every delivery due at now.
+func (w *WebhookDispatcher) DeliverPending(now time.Time) error {
+	deliveries, err := w.Database.DueWebhookDeliveries(now)
+	if err != nil {
+		return err
+	}
+
+	for _, delivery := range deliveries {
+		delivery.Attempts++
+		delivery.LastStatusCode, err = w.deliver(delivery)
+		switch {
+		case err == nil:
+			delivery.LastError = ""
+			delivery.DeliveredAt = &now
+		case delivery.Attempts >= w.MaxAttempts:
+			delivery.LastError = err.Error()
+			delivery.FailedAt = &now
+			log.Printf("Giving up on webhook delivery %v to %v after %v attempts: %v", delivery.ID, delivery.URL, delivery.Attempts, err)
+		default:
+			delivery.LastError = err.Error()
+			delivery.NextAttemptAt = now.Add(w.backoff(delivery.Attempts))
+		}
+
+		_, err = w.Database.SaveWebhookDelivery(delivery)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backoff returns how long to wait after a delivery's attempts'th failure.
+func (w *WebhookDispatcher) backoff(attempts int) time.Duration {
+	backoff := w.Backoff
+	for i := 1; i < attempts && backoff < w.MaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > w.MaxBackoff {
+		return w.MaxBackoff
+	}
+	return backoff
+}
+
+func (w *WebhookDispatcher) deliver(delivery WebhookDelivery) (int, error) {
+	var webhook *Webhook
+	for i := range w.Webhooks {
+		if w.Webhooks[i].URL == delivery.URL {
+			webhook = &w.Webhooks[i]
+			break
+		}
+	}
+
+	if webhook == nil {
+		return 0, fmt.Errorf("webhook %v is no longer configured", delivery.URL)
+	}
+
+	payload := []byte(delivery.Payload)
+	request, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(WebhookEventHeader, delivery.Event)
+	request.Header.Set(WebhookDeliveryHeader, strconv.FormatUint(uint64(delivery.ID), 10))
+	request.Header.Set(WebhookSignatureHeader, SignWebhookPayload(webhook.Secret, payload))
+
+	response, err := w.Client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("webhook responded with %v", response.Status)
+	}
+	return response.StatusCode, nil
+}
+
+// Run delivers due webhooks every interval, and as soon as Notify queues new ones, until ctx is cancelled.
+func (w *WebhookDispatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-w.wake:
+		}
+
+		err := w.DeliverPending(time.Now())
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
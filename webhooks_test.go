@@ -0,0 +1,273 @@
+package wireguardhttps
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joncooperworks/wgrpcd"
+)
+
+const testWebhookSecret = "webhook-secret"
+
+type testWebhookReceiver struct {
+	server   *httptest.Server
+	failures int
+	payloads []WebhookPayload
+}
+
+// newTestWebhookReceiver starts a webhook endpoint that responds with 500 to the first failures requests.
+func newTestWebhookReceiver(t *testing.T, failures int) *testWebhookReceiver {
+	receiver := &testWebhookReceiver{failures: failures}
+	receiver.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if signature := r.Header.Get(WebhookSignatureHeader); signature != SignWebhookPayload([]byte(testWebhookSecret), body) {
+			t.Errorf("Expected a valid signature, got %v", signature)
+			return
+		}
+
+		if receiver.failures > 0 {
+			receiver.failures--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		var payload WebhookPayload
+		err = json.Unmarshal(body, &payload)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if event := r.Header.Get(WebhookEventHeader); event != payload.Event {
+			t.Errorf("Expected %v header %v, got %v", WebhookEventHeader, payload.Event, event)
+		}
+		receiver.payloads = append(receiver.payloads, payload)
+	}))
+	return receiver
+}
+
+func TestWebhookDeliveriesAreRetriedWithBackoff(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	receiver := newTestWebhookReceiver(t, 2)
+	defer receiver.server.Close()
+
+	dispatcher := NewWebhookDispatcher(db, []Webhook{{URL: receiver.server.URL, Secret: []byte(testWebhookSecret)}})
+	dispatcher.MaxAttempts = 3
+
+	deviceID := uint(1)
+	dispatcher.Notify(AuditEvent{Action: AuditActionLogin, Actor: "jontom@adtenant.com"})
+	dispatcher.Notify(AuditEvent{Action: AuditActionDeviceDelete, Actor: "jontom@adtenant.com", DeviceID: &deviceID})
+
+	now := time.Now()
+	for _, attempt := range []time.Time{now, now.Add(10 * time.Second), now.Add(31 * time.Second), now.Add(2 * time.Minute)} {
+		err := dispatcher.DeliverPending(attempt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(receiver.payloads) != 1 || receiver.payloads[0].Event != AuditActionDeviceDelete || *receiver.payloads[0].DeviceID != deviceID {
+		t.Fatalf("Expected only the device.delete event to be delivered, got %v", receiver.payloads)
+	}
+
+	deliveries, err := db.WebhookDeliveries(defaultWebhookDeliveryLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(deliveries) != 1 {
+		t.Fatalf("Expected 1 delivery, got %v", len(deliveries))
+	}
+
+	if delivery := deliveries[0]; delivery.Attempts != 3 || delivery.DeliveredAt == nil || delivery.LastStatusCode != http.StatusOK {
+		t.Fatalf("Expected the delivery to succeed on its third attempt, got %v", delivery)
+	}
+}
+
+func TestWebhookDeliveriesGiveUpAfterMaxAttempts(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	receiver := newTestWebhookReceiver(t, 5)
+	defer receiver.server.Close()
+
+	dispatcher := NewWebhookDispatcher(db, []Webhook{{URL: receiver.server.URL, Secret: []byte(testWebhookSecret)}})
+	dispatcher.MaxAttempts = 2
+	dispatcher.Notify(AuditEvent{Action: AuditActionDeviceCreate, Actor: "jontom@adtenant.com"})
+
+	now := time.Now()
+	for _, attempt := range []time.Time{now, now.Add(time.Hour), now.Add(2 * time.Hour)} {
+		err := dispatcher.DeliverPending(attempt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deliveries, err := db.WebhookDeliveries(defaultWebhookDeliveryLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if delivery := deliveries[0]; delivery.Attempts != 2 || delivery.FailedAt == nil || delivery.LastStatusCode != http.StatusInternalServerError {
+		t.Fatalf("Expected the delivery to fail after 2 attempts, got %v", delivery)
+	}
+}
+
+func TestDeviceHandlersNotifyWebhooks(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	err := db.RegisterSubnet(mustParseCIDR("10.0.0.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin, err := db.RegisterUser("admin@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin, err = db.SetAdmin(admin.AuthPlatform, admin.AuthPlatformUserID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver := newTestWebhookReceiver(t, 0)
+	defer receiver.server.Close()
+
+	dispatcher := NewWebhookDispatcher(db, []Webhook{{URL: receiver.server.URL, Secret: []byte(testWebhookSecret), Events: []string{AuditActionDeviceCreate}}})
+	config := testServerConfig(t, db)
+	config.WebhookDispatcher = dispatcher
+
+	writer := serveAsUser(t, config, &admin, "POST", "/api/devices", DeviceRequest{Name: "Laptop", OS: "Linux", PublicKey: mustGenerateKey(t)})
+	if writer.Code != 200 {
+		t.Fatalf("Expected status code 200 for /devices, got %v", writer.Code)
+	}
+
+	err = dispatcher.DeliverPending(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(receiver.payloads) != 1 || receiver.payloads[0].Event != AuditActionDeviceCreate || receiver.payloads[0].Actor != admin.AuthPlatformUserID {
+		t.Fatalf("Expected a device.create webhook from %v, got %v", admin.AuthPlatformUserID, receiver.payloads)
+	}
+
+	writer = serveAsUser(t, config, &admin, "GET", "/api/admin/webhooks/deliveries", nil)
+	if writer.Code != 200 {
+		t.Fatalf("Expected status code 200 for /admin/webhooks/deliveries, got %v", writer.Code)
+	}
+
+	var deliveries []WebhookDelivery
+	err = json.NewDecoder(writer.Body).Decode(&deliveries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(deliveries) != 1 || deliveries[0].DeliveredAt == nil {
+		t.Fatalf("Expected 1 delivered webhook in the delivery log, got %v", deliveries)
+	}
+}
+
+func TestExpiryKeyRotationAndUserDeletionNotifyWebhooks(t *testing.T) {
+	db := testDatabase(t)
+	defer db.Close()
+
+	err := db.RegisterSubnet(mustParseCIDR("10.0.0.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin, err := db.RegisterUser("admin@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin, err = db.SetAdmin(admin.AuthPlatform, admin.AuthPlatformUserID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.RegisterUser("leaver@adtenant.com", "azuread", "unrestricted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	expired := now.Add(-time.Minute)
+	devices := map[string]*time.Time{"Expired": &expired, "Stale": nil, "Remaining": nil}
+	for name, expiresAt := range devices {
+		key := mustGenerateKey(t)
+		deviceFunc := func(allowedIPs []net.IPNet) (*wgrpcd.PeerConfigInfo, error) {
+			return &wgrpcd.PeerConfigInfo{PublicKey: key, AllowedIPs: allowedIPs}, nil
+		}
+		_, _, err = db.CreateDevice(user, nil, Device{Name: name, OS: "Linux", ExpiresAt: expiresAt}, nil, deviceFunc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	receiver := newTestWebhookReceiver(t, 0)
+	defer receiver.server.Close()
+
+	dispatcher := NewWebhookDispatcher(db, []Webhook{{URL: receiver.server.URL, Secret: []byte(testWebhookSecret)}})
+	client := &testwgrpcdClient{}
+	scheduler := &ExpiryScheduler{Database: db, WireguardClient: client, WireguardDeviceName: "wg0", WebhookDispatcher: dispatcher}
+	_, err = scheduler.RevokeExpired(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	maxKeyAge := time.Hour
+	enforcer := &KeyRotationEnforcer{Database: db, WireguardClient: client, WireguardDeviceName: "wg0", MaxKeyAge: maxKeyAge, WebhookDispatcher: dispatcher}
+	_, err = enforcer.DisableStale(now.Add(2 * maxKeyAge))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := testServerConfig(t, db)
+	config.WireguardClient = client
+	config.WebhookDispatcher = dispatcher
+	writer := serveAsUser(t, config, &admin, "DELETE", fmt.Sprintf("/api/admin/users/%v", user.ID), nil)
+	if writer.Code != 204 {
+		t.Fatalf("Expected status code 204 for /admin/users/%v, got %v %v", user.ID, writer.Code, writer.Body.String())
+	}
+
+	err = dispatcher.DeliverPending(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := []string{}
+	for _, payload := range receiver.payloads {
+		events = append(events, payload.Event+" "+payload.Details)
+	}
+	sort.Strings(events)
+
+	expectedEvents := []string{
+		AuditActionAdminDeviceDelete + " Remaining",
+		AuditActionAdminDeviceDelete + " Stale",
+		AuditActionAdminUserDelete + " ",
+		AuditActionDeviceDisable + " Remaining",
+		AuditActionDeviceDisable + " Stale",
+		AuditActionDeviceExpire + " Expired",
+	}
+	if strings.Join(events, ",") != strings.Join(expectedEvents, ",") {
+		t.Fatalf("Expected webhooks for %v, got %v", expectedEvents, events)
+	}
+}